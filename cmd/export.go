@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tilezen/go-zaloa/pkg/archive"
+	"github.com/tilezen/go-zaloa/pkg/config"
+	"github.com/tilezen/go-zaloa/pkg/logging"
+	"github.com/tilezen/go-zaloa/pkg/service"
+)
+
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	configFlags := config.RegisterFlags(fs, "fetcher", "tilesets")
+	bbox := fs.String("bbox", "", "Area to export as west,south,east,north")
+	geojsonPath := fs.String("geojson", "", "GeoJSON file with the polygons to export, instead of bbox")
+	minZoom := fs.Uint("minzoom", 0, "Lowest zoom to export")
+	maxZoom := fs.Uint("maxzoom", 10, "Highest zoom to export")
+	version := fs.String("version", "v2", "Version of the tiles to export")
+	tileset := fs.String("tileset", "terrarium", "Tileset to export")
+	size := fs.Uint64("size", 512, "Size of the tiles to export")
+	format := fs.String("format", "webp", "Format of the tiles to export")
+	style := fs.String("style", "", "Style parameters for rendered tilesets as a query string, e.g. ramp=srtm&blend=0.5")
+	concurrency := fs.Int("concurrency", 8, "Number of tiles to render at once")
+	output := fs.String("output", "", "Archive to write, ending in .mbtiles or .pmtiles")
+	progressInterval := fs.Duration("progress-interval", 10*time.Second, "How often to report progress")
+	logLevel := fs.String("log-level", "info", "Minimum level of log messages. Use debug, info, warn or error.")
+	_ = fs.Parse(args)
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		log.Fatalf("Invalid config: %s", err.Error())
+	}
+
+	logger, err := logging.New(os.Stderr, "text", *logLevel)
+	if err != nil {
+		log.Fatalf("Unable to set up logging: %s", err.Error())
+	}
+	slog.SetDefault(logger)
+
+	area, err := parseArea(*bbox, *geojsonPath)
+	if err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+
+	if *minZoom > *maxZoom {
+		log.Fatalf("minzoom must not be greater than maxzoom")
+	}
+
+	styleParams, err := url.ParseQuery(*style)
+	if err != nil {
+		log.Fatalf("Invalid style: %s", err.Error())
+	}
+
+	limiters := cfg.NewFetchLimiters(nil, nil)
+	tileFetcher, err := cfg.NewFetcher(logger, nil, limiters)
+	if err != nil {
+		log.Fatalf("Unable to set up fetcher: %s", err.Error())
+	}
+
+	registry, tilesetOptions, err := cfg.TilesetOptions(logger, nil, limiters, tileFetcher)
+	if err != nil {
+		log.Fatalf("Unable to load tilesets: %s", err.Error())
+	}
+
+	serviceOptions := append([]service.Option{service.WithLogger(logger)}, tilesetOptions...)
+	zaloaService := service.NewZaloaService(tileFetcher, serviceOptions...)
+
+	layer := seedLayer{tileset: *tileset, tileSize: *size, format: *format}
+	if err := validateLayers(zaloaService, []seedLayer{layer}, *version, styleParams); err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+
+	metadata := archiveMetadata(registry, layer, *version, area, *minZoom, *maxZoom)
+
+	var archiveWriter archive.Writer
+	switch filepath.Ext(*output) {
+	case ".mbtiles":
+		archiveWriter, err = archive.NewMBTilesWriter(*output, metadata)
+	case ".pmtiles":
+		archiveWriter, err = archive.NewPMTilesWriter(*output, metadata)
+	default:
+		log.Fatalf("output must end in .mbtiles or .pmtiles")
+	}
+	if err != nil {
+		log.Fatalf("Unable to create %s: %s", *output, err.Error())
+	}
+
+	run := &seedRun{
+		service:          zaloaService,
+		archive:          archiveWriter,
+		layers:           []seedLayer{layer},
+		area:             area,
+		minZoom:          *minZoom,
+		maxZoom:          *maxZoom,
+		version:          *version,
+		style:            styleParams,
+		concurrency:      *concurrency,
+		progressInterval: *progressInterval,
+	}
+	progress := run.run(0)
+
+	if progress.failed > 0 {
+		// A partial archive is of no use offline
+		_ = archiveWriter.Close()
+		_ = os.Remove(*output)
+		log.Fatalf("%d tiles failed", progress.failed)
+	}
+
+	if err := archiveWriter.Close(); err != nil {
+		log.Fatalf("Error closing archive: %s", err.Error())
+	}
+
+	logger.Info("Wrote archive", "output", *output)
+}
@@ -2,79 +2,69 @@ package main
 
 import (
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
 
 	"github.com/akrylysov/algnhsa"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/gorilla/mux"
 
-	"github.com/tilezen/go-zaloa/pkg/fetcher"
-	"github.com/tilezen/go-zaloa/pkg/service"
+	"github.com/tilezen/go-zaloa/pkg/auth"
+	"github.com/tilezen/go-zaloa/pkg/config"
+	"github.com/tilezen/go-zaloa/pkg/metrics"
 )
 
 func main() {
-	fetchMethod, _ := os.LookupEnv("ZALOA_FETCH_METHOD")
-	httpPrefix, _ := os.LookupEnv("ZALOA_HTTP_PREFIX")
-	s3Bucket, _ := os.LookupEnv("ZALOA_S3_BUCKET")
-	awsRegion, _ := os.LookupEnv("ZALOA_AWS_REGION")
-	iamRole, _ := os.LookupEnv("ZALOA_AWS_ROLE")
-	_, requesterPays := os.LookupEnv("ZALOA_S3_REQUESTER_PAYS")
-
-	var tileFetcher fetcher.TileFetcher
-	switch fetchMethod {
-	case "http":
-		if httpPrefix == "" {
-			log.Fatalf("http-prefix must be set when using the http fetch method")
+	// ZALOA_RENDER_CACHE_MB used to turn on the memory render cache by itself. Warm Lambda instances keep their memory
+	// between invocations.
+	if _, ok := os.LookupEnv("ZALOA_RENDER_CACHE_MB"); ok {
+		if _, ok := os.LookupEnv("ZALOA_RENDER_CACHE"); !ok {
+			_ = os.Setenv("ZALOA_RENDER_CACHE", "memory")
 		}
+	}
 
-		log.Printf("Using '%s' as http prefix", httpPrefix)
-
-		tileFetcher = fetcher.NewHTTPTileFetcher(httpPrefix)
-	case "s3":
-		if s3Bucket == "" {
-			log.Fatalf("s3-bucket must be set when using the s3 fetch method")
-		}
+	cfg, err := config.Load(os.Getenv("ZALOA_CONFIG"))
+	if err != nil {
+		log.Fatalf("Invalid config: %s", err.Error())
+	}
 
-		if awsRegion == "" {
-			log.Fatalf("region must be set when using the s3 fetch method")
-		}
+	// The instance is frozen between invocations, which would stall the background writes to the store and lose the
+	// queued tiles when it's shut down
+	if cfg.Store.Type != "" {
+		log.Fatalf("Invalid config: the store isn't supported on Lambda")
+	}
 
-		var awsSession *session.Session
-		var err error
-		if iamRole == "" {
-			awsSession, err = session.NewSessionWithOptions(session.Options{
-				Config: aws.Config{Region: aws.String(awsRegion)},
-			})
-		} else {
-			log.Printf("Configured to use AWS role %s", iamRole)
-			awsSession, err = session.NewSessionWithOptions(session.Options{
-				Config: aws.Config{
-					Credentials: stscreds.NewCredentials(session.Must(session.NewSession()), iamRole),
-					Region:      aws.String(awsRegion),
-				},
-				SharedConfigState: session.SharedConfigEnable,
-			})
-		}
-		if err != nil {
-			log.Fatalf("Unable to set up AWS session: %s", err.Error())
-		}
+	logger, err := cfg.NewLogger(os.Stderr)
+	if err != nil {
+		log.Fatalf("Unable to set up logging: %s", err.Error())
+	}
+	slog.SetDefault(logger)
 
-		s3Client := s3.New(awsSession)
+	// CloudWatch extracts metrics from embedded metric format lines written to stdout
+	metricsRecorder := metrics.NewEMFRecorder(os.Stdout, "Zaloa")
 
-		tileFetcher = fetcher.NewS3TileFetcher(s3Client, s3Bucket, requesterPays)
-	default:
-		log.Fatalf("No fetch-method specified")
+	// Without a store, there are no background writes to wait for
+	zaloaService, _, err := cfg.NewService(logger, metricsRecorder, nil)
+	if err != nil {
+		log.Fatalf("%s", err.Error())
 	}
 
-	zaloaService := service.NewZaloaService(tileFetcher)
+	// Each Lambda instance keeps its own API key usage, so the limits apply per instance
+	authMiddleware, _, err := cfg.NewAuth(logger, metricsRecorder, auth.NewUsage())
+	if err != nil {
+		log.Fatalf("%s", err.Error())
+	}
 
-	r := mux.NewRouter()
+	tileAuthMiddleware, err := cfg.NewTileAuth(logger, metricsRecorder, authMiddleware)
+	if err != nil {
+		log.Fatalf("%s", err.Error())
+	}
 
-	r.HandleFunc("/tilezen/terrain/{version:v[0-9]+}/{tilesize:[0-9]+}/{tileset}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", zaloaService.GetTileHandler())
-	r.HandleFunc("/tilezen/terrain/{version:v[0-9]+}/{tileset}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", zaloaService.GetTileHandler())
+	router := cfg.NewRouter(zaloaService, authMiddleware, tileAuthMiddleware)
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		router.ServeHTTP(writer, request)
+		// One EMF document per request, before the instance is frozen
+		metricsRecorder.Flush()
+	})
 
-	algnhsa.ListenAndServe(r, &algnhsa.Options{BinaryContentTypes: []string{"*/*"}})
+	algnhsa.ListenAndServe(handler, &algnhsa.Options{BinaryContentTypes: []string{"*/*"}})
 }
@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,16 +13,14 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
 
-	"github.com/tilezen/go-zaloa/pkg/fetcher"
-	"github.com/tilezen/go-zaloa/pkg/service"
+	"github.com/tilezen/go-zaloa/pkg/auth"
+	"github.com/tilezen/go-zaloa/pkg/config"
+	"github.com/tilezen/go-zaloa/pkg/metrics"
 )
 
 const (
@@ -32,83 +31,105 @@ const (
 )
 
 func main() {
-	port := flag.Int("port", 8080, "The port to listen on")
-	fetchMethod := flag.String("fetch-method", "", "Method to use when fetching tiles. Use http or s3.")
-	s3Bucket := flag.String("s3-bucket", "", "S3 bucket to fetch tiles from when using S3 fetch method")
-	iamRole := flag.String("iam-role", "", "IAM role to assume when setting up connection to S3")
-	awsRegion := flag.String("region", "", "Region to use when setting up connection to S3")
-	requesterPays := flag.Bool("requester-pays", false, "Set the requester pays flag when using the S3 fetch method")
-	httpPrefix := flag.String("http-prefix", "", "HTTP prefix when fetching tiles using HTTP fetch method")
-	flag.Parse()
-
-	var tileFetcher fetcher.TileFetcher
-	switch *fetchMethod {
-	case "http":
-		if *httpPrefix == "" {
-			log.Fatalf("http-prefix must be set when using the http fetch method")
-		}
-
-		tileFetcher = fetcher.NewHTTPTileFetcher(*httpPrefix)
-	case "s3":
-		if *s3Bucket == "" {
-			log.Fatalf("s3-bucket must be set when using the s3 fetch method")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "seed":
+			runSeed(os.Args[2:])
+			return
+		case "export":
+			runExport(os.Args[2:])
+			return
+		case "render":
+			runRender(os.Args[2:])
+			return
+		case "sign":
+			runSign(os.Args[2:])
+			return
 		}
+	}
 
-		if *awsRegion == "" {
-			log.Fatalf("region must be set when using the s3 fetch method")
-		}
+	flags := config.RegisterFlags(flag.CommandLine)
+	flag.Parse()
 
-		var awsSession *session.Session
-		var err error
-		if *iamRole == "" {
-			awsSession, err = session.NewSessionWithOptions(session.Options{
-				Config: aws.Config{Region: awsRegion},
-			})
-		} else {
-			log.Printf("Configured to use AWS role %s", *iamRole)
-			awsSession, err = session.NewSessionWithOptions(session.Options{
-				Config: aws.Config{
-					Credentials: stscreds.NewCredentials(session.Must(session.NewSession()), *iamRole),
-					Region:      awsRegion,
-				},
-				SharedConfigState: session.SharedConfigEnable,
-			})
-		}
-		if err != nil {
-			log.Fatalf("Unable to set up AWS session: %s", err.Error())
-		}
+	cfg, err := flags.Load()
+	if err != nil {
+		log.Fatalf("Invalid config: %s", err.Error())
+	}
 
-		s3Client := s3.New(awsSession)
+	logger, err := cfg.NewLogger(os.Stderr)
+	if err != nil {
+		log.Fatalf("Unable to set up logging: %s", err.Error())
+	}
+	slog.SetDefault(logger)
 
-		tileFetcher = fetcher.NewS3TileFetcher(s3Client, *s3Bucket, *requesterPays)
-	default:
-		log.Fatalf("No fetch-method specified")
+	shutdownTracing, err := cfg.SetupTracing(context.Background())
+	if err != nil {
+		log.Fatalf("Unable to set up tracing: %s", err.Error())
 	}
 
-	zaloaService := service.NewZaloaService(tileFetcher)
+	metricsRecorder := metrics.NewPrometheusRecorder(prometheus.DefaultRegisterer)
 
-	r := mux.NewRouter()
+	// API key usage carries over reloads, so that reloading doesn't reset the rate limits and quotas
+	apiKeyUsage := auth.NewUsage()
+	// So do the memory render cache and the limiters, as long as their options don't change
+	resources := config.NewResources()
 
 	// Readiness probe for graceful shutdown support
 	readinessResponseCode := uint32(http.StatusOK)
-	r.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(int(atomic.LoadUint32(&readinessResponseCode)))
-	})
 
-	r.HandleFunc("/live", zaloaService.GetHealthCheckHandler())
+	// The service is built again from the configuration on SIGHUP
+	handler, err := newReloadableHandler(cfg, logger, flags, metricsRecorder, func(cfg *config.Config, logger *slog.Logger) (http.Handler, func(context.Context) error, error) {
+		zaloaService, closeService, err := cfg.NewService(logger, metricsRecorder, resources)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		authMiddleware, stopAuth, err := cfg.NewAuth(logger, metricsRecorder, apiKeyUsage)
+		if err != nil {
+			_ = closeService(context.Background())
+			return nil, nil, err
+		}
+
+		tileAuthMiddleware, err := cfg.NewTileAuth(logger, metricsRecorder, authMiddleware)
+		if err != nil {
+			stopAuth()
+			_ = closeService(context.Background())
+			return nil, nil, err
+		}
+
+		r := cfg.NewRouter(zaloaService, authMiddleware, tileAuthMiddleware)
+		r.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(int(atomic.LoadUint32(&readinessResponseCode)))
+		})
+		r.Handle("/metrics", promhttp.Handler())
+
+		return r, func(ctx context.Context) error {
+			stopAuth()
+			return closeService(ctx)
+		}, nil
+	})
+	if err != nil {
+		log.Fatalf("%s", err.Error())
+	}
 
-	r.HandleFunc("/tilezen/terrain/{version:v[0-9]+}/{tilesize:[0-9]+}/{tileset}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", zaloaService.GetTileHandler())
-	r.HandleFunc("/tilezen/terrain/{version:v[0-9]+}/{tileset}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", zaloaService.GetTileHandler())
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP)
+		for range signals {
+			slog.Info("SIGHUP received. Reloading configuration.")
+			handler.reload()
+		}
+	}()
 
-	addr := fmt.Sprintf(":%d", *port)
-	log.Printf("Listening to %s", addr)
+	addr := fmt.Sprintf(":%d", cfg.Port)
+	slog.Info("Listening", "addr", addr)
 
 	// Support for upgrading an http/1.1 connection to http/2
 	// See https://github.com/thrawn01/h2c-golang-example
 	http2Server := &http2.Server{}
 	server := &http.Server{
 		Addr:    addr,
-		Handler: h2c.NewHandler(r, http2Server),
+		Handler: h2c.NewHandler(handler, http2Server),
 	}
 
 	// Code to handle shutdown gracefully
@@ -121,7 +142,7 @@ func main() {
 		signal.Notify(signals, syscall.SIGTERM)
 		<-signals
 
-		log.Printf("SIGTERM received. Starting graceful shutdown.")
+		slog.Info("SIGTERM received. Starting graceful shutdown.")
 
 		// Start failing readiness probes
 		atomic.StoreUint32(&readinessResponseCode, http.StatusInternalServerError)
@@ -130,14 +151,23 @@ func main() {
 		// Begin shutdown of in-flight requests
 		shutdownCtx, shutdownCtxCancel := context.WithTimeout(context.Background(), gracefulShutdownTimeout)
 		if err := server.Shutdown(shutdownCtx); err != nil {
-			log.Printf("Error waiting for server shutdown: %+v", err)
+			slog.Error("Error waiting for server shutdown", "error", err)
 		}
 		shutdownCtxCancel()
 	}()
 
-	log.Printf("Service started")
+	slog.Info("Service started")
 	if err := server.ListenAndServe(); err != nil {
-		log.Printf("Couldn't start HTTP server: %+v", err)
+		slog.Error("Couldn't start HTTP server", "error", err)
 	}
 	<-shutdownChan
+
+	shutdownCtx, shutdownCtxCancel := context.WithTimeout(context.Background(), gracefulShutdownTimeout)
+	if err := handler.shutdown(shutdownCtx); err != nil {
+		slog.Error("Error waiting for tiles to be written to the store", "error", err)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Error flushing traces", "error", err)
+	}
+	shutdownCtxCancel()
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tilezen/go-zaloa/pkg/config"
+	"github.com/tilezen/go-zaloa/pkg/metrics"
+)
+
+// generation is the handler built from one version of the configuration.
+type generation struct {
+	cfg     *config.Config
+	handler http.Handler
+	close   func(context.Context) error
+
+	// Requests hold the read lock while they're served, so that retiring the generation waits for them
+	mu      sync.RWMutex
+	retired bool
+}
+
+// reloadableHandler serves each request with the latest generation. Requests that are in flight when the configuration
+// is reloaded finish on the generation they started on.
+type reloadableHandler struct {
+	current atomic.Pointer[generation]
+
+	flags    *config.Flags
+	recorder metrics.Recorder
+	// build sets up the service and the routes of a generation
+	build func(cfg *config.Config, logger *slog.Logger) (http.Handler, func(context.Context) error, error)
+
+	reloadMu sync.Mutex
+}
+
+func newReloadableHandler(cfg *config.Config, logger *slog.Logger, flags *config.Flags, recorder metrics.Recorder, build func(cfg *config.Config, logger *slog.Logger) (http.Handler, func(context.Context) error, error)) (*reloadableHandler, error) {
+	h := &reloadableHandler{
+		flags:    flags,
+		recorder: recorder,
+		build:    build,
+	}
+
+	handler, closer, err := build(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	h.current.Store(&generation{cfg: cfg, handler: handler, close: closer})
+
+	return h, nil
+}
+
+func (h *reloadableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for {
+		g := h.current.Load()
+		g.mu.RLock()
+		if g.retired {
+			// The configuration was reloaded between loading the generation and locking it
+			g.mu.RUnlock()
+			continue
+		}
+
+		g.handler.ServeHTTP(w, r)
+		g.mu.RUnlock()
+		return
+	}
+}
+
+// reload loads the configuration again and swaps in a new generation built from it. The current generation is kept if
+// the configuration is invalid or can't be built.
+func (h *reloadableHandler) reload() {
+	h.reloadMu.Lock()
+	defer h.reloadMu.Unlock()
+
+	err := h.swap()
+	h.recorder.ObserveReload(err)
+	if err != nil {
+		slog.Error("Configuration reload failed, keeping the current configuration", "error", err)
+		return
+	}
+	slog.Info("Configuration reloaded")
+}
+
+func (h *reloadableHandler) swap() error {
+	cfg, err := h.flags.Load()
+	if err != nil {
+		return err
+	}
+
+	old := h.current.Load()
+	if cfg.Port != old.cfg.Port || cfg.Tracing != old.cfg.Tracing {
+		slog.Warn("Changes to the port and tracing take effect after a restart")
+	}
+
+	logger, err := cfg.NewLogger(os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	handler, closer, err := h.build(cfg, logger)
+	if err != nil {
+		return err
+	}
+
+	slog.SetDefault(logger)
+	h.current.Store(&generation{cfg: cfg, handler: handler, close: closer})
+
+	go func() {
+		old.mu.Lock()
+		old.retired = true
+		old.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), gracefulShutdownTimeout)
+		defer cancel()
+		if err := old.close(ctx); err != nil {
+			slog.Error("Error waiting for tiles to be written to the store", "error", err)
+		}
+	}()
+
+	return nil
+}
+
+// shutdown waits for the tiles of the current generation to be written to the store.
+func (h *reloadableHandler) shutdown(ctx context.Context) error {
+	h.reloadMu.Lock()
+	defer h.reloadMu.Unlock()
+
+	return h.current.Load().close(ctx)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/tilezen/go-zaloa/pkg/common"
+	"github.com/tilezen/go-zaloa/pkg/config"
+	"github.com/tilezen/go-zaloa/pkg/fetcher"
+	"github.com/tilezen/go-zaloa/pkg/logging"
+	"github.com/tilezen/go-zaloa/pkg/service"
+)
+
+func runRender(args []string) {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	configFlags := config.RegisterFlags(fs, "fetcher", "tilesets")
+	tile := fs.String("tile", "", "Tile to render as z/x/y")
+	version := fs.String("version", "v2", "Version of the tile")
+	tileset := fs.String("tileset", "terrarium", "Tileset of the tile")
+	size := fs.Uint64("size", 256, "Size of the tile")
+	format := fs.String("format", "png", "Format of the tile")
+	style := fs.String("style", "", "Style parameters for rendered tilesets as a query string, e.g. ramp=srtm&blend=0.5")
+	output := fs.String("output", "-", "File to write the tile to, or - for stdout")
+	explain := fs.Bool("explain", false, "Print the source tiles, crops and locations used to build the tile as JSON to stdout. The tile is only rendered if output is a file.")
+	logLevel := fs.String("log-level", "info", "Minimum level of log messages. Use debug, info, warn or error.")
+	_ = fs.Parse(args)
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		log.Fatalf("Invalid config: %s", err.Error())
+	}
+
+	logger, err := logging.New(os.Stderr, "text", *logLevel)
+	if err != nil {
+		log.Fatalf("Unable to set up logging: %s", err.Error())
+	}
+	slog.SetDefault(logger)
+
+	coords := strings.Split(*tile, "/")
+	if len(coords) != 3 {
+		log.Fatalf("tile must be z/x/y")
+	}
+	parsedTile, err := common.ParseTile(coords[0], coords[1], coords[2])
+	if err != nil {
+		log.Fatalf("Invalid tile: %s", err.Error())
+	}
+
+	styleParams, err := url.ParseQuery(*style)
+	if err != nil {
+		log.Fatalf("Invalid style: %s", err.Error())
+	}
+
+	params := service.TileParams{
+		Version:  *version,
+		Tileset:  *tileset,
+		TileSize: *size,
+		Format:   *format,
+		Tile:     *parsedTile,
+		Query:    styleParams,
+	}
+
+	// Planning doesn't fetch anything, so the fetcher is only needed to show where source tiles come from
+	limiters := cfg.NewFetchLimiters(nil, nil)
+	var tileFetcher fetcher.TileFetcher
+	if cfg.Fetcher.Method != "" || !*explain || *output != "-" {
+		tileFetcher, err = cfg.NewFetcher(logger, nil, limiters)
+		if err != nil {
+			log.Fatalf("Unable to set up fetcher: %s", err.Error())
+		}
+	}
+
+	_, tilesetOptions, err := cfg.TilesetOptions(logger, nil, limiters, tileFetcher)
+	if err != nil {
+		log.Fatalf("Unable to load tilesets: %s", err.Error())
+	}
+	serviceOptions := append([]service.Option{service.WithLogger(logger)}, tilesetOptions...)
+	zaloaService := service.NewZaloaService(tileFetcher, serviceOptions...)
+
+	if *explain {
+		plan, err := zaloaService.PlanTile(params)
+		if err != nil {
+			log.Fatalf("Unable to plan tile: %s", err.Error())
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(plan); err != nil {
+			log.Fatalf("Error writing plan: %s", err.Error())
+		}
+
+		if *output == "-" {
+			return
+		}
+	}
+
+	entry, err := zaloaService.RenderTile(context.Background(), params)
+	if err != nil {
+		log.Fatalf("Unable to render tile: %s", err.Error())
+	}
+
+	if *output == "-" {
+		_, err = os.Stdout.Write(entry.Data)
+	} else {
+		err = os.WriteFile(*output, entry.Data, 0o644)
+	}
+	if err != nil {
+		log.Fatalf("Error writing tile: %s", err.Error())
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"math"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/tilezen/go-zaloa/pkg/archive"
+	"github.com/tilezen/go-zaloa/pkg/cache"
+	"github.com/tilezen/go-zaloa/pkg/common"
+	"github.com/tilezen/go-zaloa/pkg/config"
+	"github.com/tilezen/go-zaloa/pkg/coverage"
+	"github.com/tilezen/go-zaloa/pkg/logging"
+	"github.com/tilezen/go-zaloa/pkg/service"
+	"github.com/tilezen/go-zaloa/pkg/tilesets"
+)
+
+// seedLayer is one combination of tileset, size and format to seed.
+type seedLayer struct {
+	tileset  string
+	tileSize uint64
+	format   string
+}
+
+type seedJob struct {
+	index int
+	layer seedLayer
+	tile  common.Tile
+}
+
+// seedCheckpoint is saved periodically so that an interrupted seed can carry on where it stopped.
+type seedCheckpoint struct {
+	// Fingerprint identifies the seed the checkpoint belongs to
+	Fingerprint string `json:"fingerprint"`
+	// Completed is the number of tiles, in enumeration order, that have all been seeded
+	Completed int `json:"completed"`
+}
+
+// seedProgress keeps track of finished tiles. Tiles finish out of order, so the checkpoint only covers the tiles up to
+// the first one that hasn't finished yet.
+type seedProgress struct {
+	mu        sync.Mutex
+	total     int
+	resumed   int
+	completed int
+	finished  map[int]bool
+	rendered  int
+	skipped   int
+	failed    int
+	start     time.Time
+}
+
+func (p *seedProgress) finish(index int, outcome string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch outcome {
+	case "rendered":
+		p.rendered++
+	case "skipped":
+		p.skipped++
+	case "failed":
+		// Failed tiles hold back the checkpoint so that they're retried when resuming
+		p.failed++
+		return
+	}
+
+	p.finished[index] = true
+	for p.finished[p.completed] {
+		delete(p.finished, p.completed)
+		p.completed++
+	}
+}
+
+func (p *seedProgress) report() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	done := p.resumed + p.rendered + p.skipped + p.failed
+	elapsed := time.Since(p.start)
+	rate := float64(done-p.resumed) / elapsed.Seconds()
+
+	eta := "unknown"
+	if rate > 0 {
+		eta = time.Duration(float64(p.total-done) / rate * float64(time.Second)).Round(time.Second).String()
+	}
+
+	slog.Info("Rendered tiles",
+		"done", done,
+		"total", p.total,
+		"percent", math.Round(1000*float64(done)/float64(p.total))/10,
+		"failed", p.failed,
+		"skipped", p.skipped,
+		"tiles_per_second", math.Round(10*rate)/10,
+		"eta", eta,
+	)
+}
+
+func (p *seedProgress) checkpoint() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.completed
+}
+
+func runSeed(args []string) {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	configFlags := config.RegisterFlags(fs, "fetcher", "tilesets")
+	bbox := fs.String("bbox", "", "Area to seed as west,south,east,north")
+	geojsonPath := fs.String("geojson", "", "GeoJSON file with the polygons to seed, instead of bbox")
+	minZoom := fs.Uint("minzoom", 0, "Lowest zoom to seed")
+	maxZoom := fs.Uint("maxzoom", 10, "Highest zoom to seed")
+	version := fs.String("version", "v2", "Version of the tiles to seed")
+	tilesets := fs.String("tilesets", "terrarium", "Comma separated tilesets to seed")
+	sizes := fs.String("sizes", "512", "Comma separated tile sizes to seed")
+	formats := fs.String("formats", "webp", "Comma separated formats to seed")
+	style := fs.String("style", "", "Style parameters for the rendered tilesets as a query string, e.g. ramp=srtm&blend=0.5")
+	concurrency := fs.Int("concurrency", 8, "Number of tiles to render at once")
+	output := fs.String("output", "", "Where to write the tiles: dir:PATH (plain files), cache:PATH (the server's disk render cache), s3://BUCKET/PREFIX or mbtiles:PATH")
+	checkpointPath := fs.String("checkpoint", "", "File to keep track of progress in, to resume an interrupted seed")
+	progressInterval := fs.Duration("progress-interval", 10*time.Second, "How often to report progress")
+	logLevel := fs.String("log-level", "info", "Minimum level of log messages. Use debug, info, warn or error.")
+	_ = fs.Parse(args)
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		log.Fatalf("Invalid config: %s", err.Error())
+	}
+
+	logger, err := logging.New(os.Stderr, "text", *logLevel)
+	if err != nil {
+		log.Fatalf("Unable to set up logging: %s", err.Error())
+	}
+	slog.SetDefault(logger)
+
+	area, err := parseArea(*bbox, *geojsonPath)
+	if err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+
+	if *minZoom > *maxZoom {
+		log.Fatalf("minzoom must not be greater than maxzoom")
+	}
+
+	styleParams, err := url.ParseQuery(*style)
+	if err != nil {
+		log.Fatalf("Invalid style: %s", err.Error())
+	}
+
+	var layers []seedLayer
+	for _, tileset := range strings.Split(*tilesets, ",") {
+		for _, sizeStr := range strings.Split(*sizes, ",") {
+			size, err := strconv.ParseUint(sizeStr, 10, 32)
+			if err != nil {
+				log.Fatalf("Invalid size %s", sizeStr)
+			}
+			for _, format := range strings.Split(*formats, ",") {
+				layers = append(layers, seedLayer{tileset: tileset, tileSize: size, format: format})
+			}
+		}
+	}
+
+	limiters := cfg.NewFetchLimiters(nil, nil)
+	tileFetcher, err := cfg.NewFetcher(logger, nil, limiters)
+	if err != nil {
+		log.Fatalf("Unable to set up fetcher: %s", err.Error())
+	}
+
+	registry, tilesetOptions, err := cfg.TilesetOptions(logger, nil, limiters, tileFetcher)
+	if err != nil {
+		log.Fatalf("Unable to load tilesets: %s", err.Error())
+	}
+	serviceOptions := append([]service.Option{service.WithLogger(logger)}, tilesetOptions...)
+
+	if err := validateLayers(service.NewZaloaService(tileFetcher, serviceOptions...), layers, *version, styleParams); err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+
+	// Tiles go either through the render cache of the service, or into an archive
+	var archiveWriter archive.Writer
+	switch {
+	case strings.HasPrefix(*output, "dir:"):
+		serviceOptions = append(serviceOptions, service.WithRenderCache(cache.NewDirectoryStore(strings.TrimPrefix(*output, "dir:"))))
+	case strings.HasPrefix(*output, "cache:"):
+		serviceOptions = append(serviceOptions, service.WithRenderCache(cache.NewDiskCache(strings.TrimPrefix(*output, "cache:"))))
+	case strings.HasPrefix(*output, "s3://"):
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(*output, "s3://"), "/")
+		awsSession, err := cfg.NewAWSSession(cfg.Fetcher.Region)
+		if err != nil {
+			log.Fatalf("%s", err.Error())
+		}
+		serviceOptions = append(serviceOptions, service.WithRenderCache(cache.NewS3Store(s3.New(awsSession), bucket, prefix)))
+	case strings.HasPrefix(*output, "mbtiles:"):
+		if len(layers) != 1 {
+			log.Fatalf("An MBTiles file holds a single tileset, size and format")
+		}
+
+		archiveWriter, err = archive.NewMBTilesWriter(strings.TrimPrefix(*output, "mbtiles:"), archiveMetadata(registry, layers[0], *version, area, *minZoom, *maxZoom))
+		if err != nil {
+			log.Fatalf("Unable to open MBTiles: %s", err.Error())
+		}
+	default:
+		log.Fatalf("Invalid output %s", *output)
+	}
+
+	zaloaService := service.NewZaloaService(tileFetcher, serviceOptions...)
+
+	fingerprint := fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%d|%d|%s|%s|%s|%s|%s|%s",
+		*bbox, *geojsonPath, *minZoom, *maxZoom, *version, *tilesets, *sizes, *formats, *style, *output))))
+
+	resumeFrom := 0
+	if *checkpointPath != "" {
+		resumeFrom, err = readSeedCheckpoint(*checkpointPath, fingerprint)
+		if err != nil {
+			log.Fatalf("Unable to resume: %s", err.Error())
+		}
+		if resumeFrom > 0 {
+			logger.Info("Resuming", "completed", resumeFrom)
+		}
+	}
+
+	run := &seedRun{
+		service:          zaloaService,
+		archive:          archiveWriter,
+		layers:           layers,
+		area:             area,
+		minZoom:          *minZoom,
+		maxZoom:          *maxZoom,
+		version:          *version,
+		style:            styleParams,
+		concurrency:      *concurrency,
+		progressInterval: *progressInterval,
+	}
+	if *checkpointPath != "" {
+		run.checkpoint = func(completed int) {
+			if err := writeSeedCheckpoint(*checkpointPath, fingerprint, completed); err != nil {
+				logger.Error("Error writing checkpoint", "error", err)
+			}
+		}
+	}
+	progress := run.run(resumeFrom)
+
+	if archiveWriter != nil {
+		if err := archiveWriter.Close(); err != nil {
+			log.Fatalf("Error closing archive: %s", err.Error())
+		}
+	}
+
+	if progress.failed > 0 {
+		log.Fatalf("%d tiles failed", progress.failed)
+	}
+}
+
+// seedRun renders every tile of its layers over an area, writing them to an archive if there is one.
+type seedRun struct {
+	service          service.ZaloaService
+	archive          archive.Writer
+	layers           []seedLayer
+	area             coverage.Area
+	minZoom          uint
+	maxZoom          uint
+	version          string
+	style            url.Values
+	concurrency      int
+	progressInterval time.Duration
+	// checkpoint is called with the number of completed tiles along with every progress report, if it's set
+	checkpoint func(completed int)
+}
+
+// run seeds the tiles, skipping the first resumeFrom of them.
+func (r *seedRun) run(resumeFrom int) *seedProgress {
+	progress := &seedProgress{
+		total:     len(r.layers) * coverage.CountTiles(r.area, r.minZoom, r.maxZoom),
+		resumed:   resumeFrom,
+		completed: resumeFrom,
+		finished:  map[int]bool{},
+		start:     time.Now(),
+	}
+	slog.Info("Rendering tiles", "total", progress.total)
+
+	report := func() {
+		progress.report()
+		if r.checkpoint != nil {
+			r.checkpoint(progress.checkpoint())
+		}
+	}
+
+	jobs := make(chan seedJob, r.concurrency)
+	wg := sync.WaitGroup{}
+	for i := 0; i < r.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				progress.finish(job.index, r.seedTile(job))
+			}
+		}()
+	}
+
+	stopReporting := make(chan struct{})
+	reportingDone := make(chan struct{})
+	go func() {
+		defer close(reportingDone)
+		ticker := time.NewTicker(r.progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				report()
+			case <-stopReporting:
+				return
+			}
+		}
+	}()
+
+	index := 0
+	for _, layer := range r.layers {
+		_ = coverage.ForEachTile(r.area, r.minZoom, r.maxZoom, func(t common.Tile) error {
+			if index >= resumeFrom {
+				jobs <- seedJob{index: index, layer: layer, tile: t}
+			}
+			index++
+			return nil
+		})
+	}
+	close(jobs)
+	wg.Wait()
+	close(stopReporting)
+	<-reportingDone
+
+	report()
+	return progress
+}
+
+// seedTile renders a single tile and returns whether it was rendered, skipped or failed.
+func (r *seedRun) seedTile(job seedJob) string {
+	// Some sizes aren't available at every zoom. The layers have been validated, so the tileset exists
+	tileset, _ := r.service.Tilesets().Get(job.layer.tileset)
+	if job.tile.Z < tileset.MinTileZoom(job.layer.tileSize) || job.tile.Z > tileset.MaxTileZoom(job.layer.tileSize) {
+		slog.Debug("skipping tile outside of the tileset's zooms", "tile", job.tile.String(), "tileset", job.layer.tileset, "size", job.layer.tileSize)
+		return "skipped"
+	}
+
+	ctx := context.Background()
+	entry, err := r.service.RenderTile(ctx, service.TileParams{
+		Version:  r.version,
+		Tileset:  job.layer.tileset,
+		TileSize: job.layer.tileSize,
+		Format:   job.layer.format,
+		Tile:     job.tile,
+		Query:    r.style,
+	})
+	if err != nil {
+		slog.Error("error rendering tile", "tile", job.tile.String(), "tileset", job.layer.tileset, "size", job.layer.tileSize, "error", err)
+		return "failed"
+	}
+
+	if r.archive != nil {
+		if err := r.archive.WriteTile(job.tile, entry.Data); err != nil {
+			slog.Error("error writing tile", "tile", job.tile.String(), "error", err)
+			return "failed"
+		}
+	}
+
+	return "rendered"
+}
+
+// validateLayers checks that every layer can be rendered with the given version and style before any tile is, so that
+// a typo fails the whole run instead of skipping every tile.
+func validateLayers(zaloaService service.ZaloaService, layers []seedLayer, version string, style url.Values) error {
+	for _, layer := range layers {
+		tileset, ok := zaloaService.Tilesets().Get(layer.tileset)
+		if !ok {
+			return fmt.Errorf("unknown tileset %s", layer.tileset)
+		}
+		if !tileset.AllowsSize(layer.tileSize) {
+			return fmt.Errorf("tileset %s isn't available at size %d", layer.tileset, layer.tileSize)
+		}
+		if !tileset.AllowsFormat(common.TileEncoding(layer.format)) {
+			return fmt.Errorf("tileset %s isn't available as %s", layer.tileset, layer.format)
+		}
+
+		// Planning a tile at a zoom the tileset has checks the version and parses the style without fetching anything
+		_, err := zaloaService.PlanTile(service.TileParams{
+			Version:  version,
+			Tileset:  layer.tileset,
+			TileSize: layer.tileSize,
+			Format:   layer.format,
+			Tile:     common.Tile{Z: tileset.MinTileZoom(layer.tileSize)},
+			Query:    style,
+		})
+		if err != nil {
+			return fmt.Errorf("can't render tileset %s at size %d as %s: %w", layer.tileset, layer.tileSize, layer.format, err)
+		}
+	}
+
+	return nil
+}
+
+func readSeedCheckpoint(path string, fingerprint string) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error reading checkpoint: %w", err)
+	}
+
+	checkpoint := seedCheckpoint{}
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return 0, fmt.Errorf("error parsing checkpoint: %w", err)
+	}
+
+	if checkpoint.Fingerprint != fingerprint {
+		return 0, fmt.Errorf("checkpoint %s belongs to a seed with different arguments", path)
+	}
+
+	return checkpoint.Completed, nil
+}
+
+func writeSeedCheckpoint(path string, fingerprint string, completed int) error {
+	data, err := json.Marshal(seedCheckpoint{Fingerprint: fingerprint, Completed: completed})
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// parseArea reads the area given by either the bbox or the geojson flag.
+func parseArea(bbox string, geojsonPath string) (coverage.Area, error) {
+	switch {
+	case bbox != "" && geojsonPath != "":
+		return nil, fmt.Errorf("only one of bbox and geojson can be set")
+	case bbox != "":
+		area, err := coverage.ParseBBox(bbox)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bbox: %w", err)
+		}
+		return area, nil
+	case geojsonPath != "":
+		f, err := os.Open(geojsonPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open geojson: %w", err)
+		}
+		defer f.Close()
+
+		area, err := coverage.ReadGeoJSON(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid geojson: %w", err)
+		}
+		return area, nil
+	default:
+		return nil, fmt.Errorf("one of bbox or geojson must be set")
+	}
+}
+
+func archiveMetadata(registry *tilesets.Registry, layer seedLayer, version string, area coverage.Area, minZoom uint, maxZoom uint) archive.Metadata {
+	var encoding string
+	if tileset, ok := registry.Get(layer.tileset); ok {
+		encoding = tileset.RasterDEMEncoding()
+	}
+
+	return archive.Metadata{
+		Name:     fmt.Sprintf("%s %s %d", layer.tileset, version, layer.tileSize),
+		Format:   layer.format,
+		Encoding: encoding,
+		Bounds:   area.Bounds(),
+		MinZoom:  minZoom,
+		MaxZoom:  maxZoom,
+	}
+}
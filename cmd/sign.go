@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/tilezen/go-zaloa/pkg/config"
+	"github.com/tilezen/go-zaloa/pkg/coverage"
+	"github.com/tilezen/go-zaloa/pkg/signing"
+)
+
+func runSign(args []string) {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(fs.Output(), "Usage: zaloa sign [flags] URL...\n\nPrints signed copies of tile URL templates like https://tiles.example.com/tilezen/terrain/v2/256/terrarium/{z}/{x}/{y}.png\n\n")
+		fs.PrintDefaults()
+	}
+	configFlags := config.RegisterFlags(fs, "signing")
+	secretID := fs.String("kid", "", "ID of the secret to sign with. Defaults to the first secret.")
+	ttl := fs.Duration("ttl", 24*time.Hour, "How long the URLs are valid for")
+	expires := fs.String("expires", "", "When the URLs expire, in RFC 3339 format. Overrides -ttl.")
+	bbox := fs.String("bbox", "", "Limit the URLs to the tiles intersecting west,south,east,north")
+	minZoom := fs.Int("min-zoom", -1, "Limit the URLs to this zoom and above")
+	maxZoom := fs.Int("max-zoom", -1, "Limit the URLs to this zoom and below")
+	_ = fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		log.Fatalf("No URLs to sign")
+	}
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		log.Fatalf("Invalid config: %s", err.Error())
+	}
+
+	signer, err := cfg.NewSigner()
+	if err != nil {
+		log.Fatalf("Unable to load signing secrets: %s", err.Error())
+	}
+	if signer == nil {
+		log.Fatalf("signing-secrets-file is required")
+	}
+
+	claims := signing.Claims{Expires: time.Now().Add(*ttl)}
+	if *expires != "" {
+		claims.Expires, err = time.Parse(time.RFC3339, *expires)
+		if err != nil {
+			log.Fatalf("Invalid expires: %s", err.Error())
+		}
+	}
+	if *bbox != "" {
+		b, err := coverage.ParseBBox(*bbox)
+		if err != nil {
+			log.Fatalf("Invalid bbox: %s", err.Error())
+		}
+		claims.BBox = &b
+	}
+	if *minZoom >= 0 {
+		z := uint(*minZoom)
+		claims.MinZoom = &z
+	}
+	if *maxZoom >= 0 {
+		z := uint(*maxZoom)
+		claims.MaxZoom = &z
+	}
+
+	for _, arg := range fs.Args() {
+		u, err := url.Parse(arg)
+		if err != nil {
+			log.Fatalf("Invalid URL %s: %s", arg, err.Error())
+		}
+
+		claims.Scope, _, err = signing.TileScope(u.Path)
+		if err != nil {
+			log.Fatalf("Invalid URL %s: %s", arg, err.Error())
+		}
+
+		signed, err := signer.Sign(*secretID, claims)
+		if err != nil {
+			log.Fatalf("Unable to sign %s: %s", arg, err.Error())
+		}
+
+		// Style parameters already in the URL are kept
+		query := u.Query()
+		for k, v := range signed {
+			query[k] = v
+		}
+
+		// The path is written out unescaped so that the placeholders stay usable in a template
+		path := u.Path
+		u.Path, u.RawPath, u.RawQuery = "", "", ""
+		fmt.Printf("%s%s?%s\n", u.String(), path, query.Encode())
+	}
+}
@@ -0,0 +1,84 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tilezen/go-zaloa/pkg/metrics"
+)
+
+// ErrQueueFull is returned when an operation can't run yet and there's no room left to wait.
+var ErrQueueFull = errors.New("queue full")
+
+// Limiter bounds the number of operations running at once. Operations that can't run yet wait in a queue, which is
+// unbounded if its size is negative.
+type Limiter struct {
+	pool      string
+	slots     chan struct{}
+	queueSize int64
+	queued    atomic.Int64
+	recorder  metrics.Recorder
+}
+
+// NewLimiter creates a limiter that lets concurrency operations run at once, with up to queueSize more waiting. Its
+// measurements are reported to recorder under the name of the pool.
+func NewLimiter(pool string, concurrency int, queueSize int, recorder metrics.Recorder) *Limiter {
+	if recorder == nil {
+		recorder = metrics.NewNopRecorder()
+	}
+	recorder.SetConcurrencyLimit(pool, concurrency, queueSize)
+
+	return &Limiter{
+		pool:      pool,
+		slots:     make(chan struct{}, concurrency),
+		queueSize: int64(queueSize),
+		recorder:  recorder,
+	}
+}
+
+// Acquire waits for a slot until ctx is done. It returns ErrQueueFull straight away if the queue is full. The returned
+// function frees the slot again.
+func (l *Limiter) Acquire(ctx context.Context) (func(), error) {
+	start := time.Now()
+
+	select {
+	case l.slots <- struct{}{}:
+		return l.admitted(start), nil
+	default:
+	}
+
+	if queued := l.queued.Add(1); l.queueSize >= 0 && queued > l.queueSize {
+		l.queued.Add(-1)
+		l.recorder.ObserveAdmission(l.pool, "rejected", time.Since(start))
+		return nil, ErrQueueFull
+	}
+	l.recorder.AddConcurrency(l.pool, 0, 1)
+	defer func() {
+		l.queued.Add(-1)
+		l.recorder.AddConcurrency(l.pool, 0, -1)
+	}()
+
+	select {
+	case l.slots <- struct{}{}:
+		return l.admitted(start), nil
+	case <-ctx.Done():
+		l.recorder.ObserveAdmission(l.pool, "cancelled", time.Since(start))
+		return nil, ctx.Err()
+	}
+}
+
+func (l *Limiter) admitted(start time.Time) func() {
+	l.recorder.ObserveAdmission(l.pool, "admitted", time.Since(start))
+	l.recorder.AddConcurrency(l.pool, 1, 0)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-l.slots
+			l.recorder.AddConcurrency(l.pool, -1, 0)
+		})
+	}
+}
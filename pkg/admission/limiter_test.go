@@ -0,0 +1,97 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimiterAcquire(t *testing.T) {
+	tests := []struct {
+		name        string
+		concurrency int
+		queueSize   int
+		// held slots are acquired and kept before the checked Acquire
+		held    int
+		queued  int
+		timeout time.Duration
+		wantErr error
+	}{
+		{name: "free slot", concurrency: 2, queueSize: 0, held: 1},
+		{name: "queue full", concurrency: 1, queueSize: 1, held: 1, queued: 1, wantErr: ErrQueueFull},
+		{name: "no queue", concurrency: 1, queueSize: 0, held: 1, wantErr: ErrQueueFull},
+		{name: "cancelled while queued", concurrency: 1, queueSize: 1, held: 1, timeout: 10 * time.Millisecond, wantErr: context.DeadlineExceeded},
+		{name: "unbounded queue", concurrency: 1, queueSize: -1, held: 1, queued: 3, timeout: 10 * time.Millisecond, wantErr: context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLimiter("test", tt.concurrency, tt.queueSize, nil)
+
+			for i := 0; i < tt.held; i++ {
+				release, err := l.Acquire(context.Background())
+				if err != nil {
+					t.Fatalf("error acquiring a slot: %v", err)
+				}
+				defer release()
+			}
+
+			queueCtx, cancelQueue := context.WithCancel(context.Background())
+			defer cancelQueue()
+			for i := 0; i < tt.queued; i++ {
+				go func() {
+					if release, err := l.Acquire(queueCtx); err == nil {
+						release()
+					}
+				}()
+			}
+			for l.queued.Load() != int64(tt.queued) {
+				time.Sleep(time.Millisecond)
+			}
+
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			release, err := l.Acquire(ctx)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if err == nil {
+				release()
+			}
+		})
+	}
+}
+
+func TestLimiterRelease(t *testing.T) {
+	l := NewLimiter("test", 1, 1, nil)
+
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("error acquiring a slot: %v", err)
+	}
+
+	acquired := make(chan error)
+	go func() {
+		release, err := l.Acquire(context.Background())
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+
+	// Releasing twice only frees one slot
+	release()
+	release()
+	if err := <-acquired; err != nil {
+		t.Fatalf("expected the queued Acquire to get the released slot, got %v", err)
+	}
+	if len(l.slots) != 0 {
+		t.Errorf("expected no slots in use, got %d", len(l.slots))
+	}
+}
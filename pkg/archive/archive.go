@@ -0,0 +1,27 @@
+package archive
+
+import (
+	"github.com/tilezen/go-zaloa/pkg/common"
+	"github.com/tilezen/go-zaloa/pkg/coverage"
+)
+
+// Writer stores rendered tiles in a single file archive.
+type Writer interface {
+	// WriteTile stores data as tile t, replacing any existing tile. It's safe to call from several goroutines.
+	WriteTile(t common.Tile, data []byte) error
+	// Close finishes writing the archive.
+	Close() error
+}
+
+// Metadata describes the tiles in an archive.
+type Metadata struct {
+	Name string
+	// Format is the image format of the tiles, png or webp
+	Format string
+	// Encoding is the raster-dem encoding of the tiles, like terrarium. It's empty for tiles that don't carry
+	// elevations.
+	Encoding string
+	Bounds   coverage.BBox
+	MinZoom  uint
+	MaxZoom  uint
+}
@@ -0,0 +1,115 @@
+package archive
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/tilezen/go-zaloa/pkg/common"
+)
+
+type mbtilesWriter struct {
+	mu sync.Mutex
+	db *sql.DB
+}
+
+// NewMBTilesWriter creates, or opens to add tiles to, the MBTiles file at path and sets its metadata. Identical tiles
+// are only stored once, with the images and map tables behind a tiles view.
+// See https://github.com/mapbox/mbtiles-spec/blob/master/1.3/spec.md
+func NewMBTilesWriter(path string, metadata Metadata) (Writer, error) {
+	// Each tile is committed on its own, which is cheap with a write-ahead log and without syncing every commit
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_journal_mode=WAL&_synchronous=NORMAL", path))
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", path, err)
+	}
+	db.SetMaxOpenConns(1)
+
+	statements := []string{
+		"CREATE TABLE IF NOT EXISTS metadata (name TEXT PRIMARY KEY, value TEXT)",
+		"CREATE TABLE IF NOT EXISTS images (tile_id TEXT PRIMARY KEY, tile_data BLOB)",
+		"CREATE TABLE IF NOT EXISTS map (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_id TEXT)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS map_index ON map (zoom_level, tile_column, tile_row)",
+		`CREATE VIEW IF NOT EXISTS tiles AS
+			SELECT map.zoom_level AS zoom_level, map.tile_column AS tile_column, map.tile_row AS tile_row, images.tile_data AS tile_data
+			FROM map JOIN images ON images.tile_id = map.tile_id`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("error creating MBTiles schema: %w", err)
+		}
+	}
+
+	rows := map[string]string{
+		"name":    metadata.Name,
+		"format":  metadata.Format,
+		"type":    "baselayer",
+		"bounds":  metadata.Bounds.String(),
+		"minzoom": strconv.FormatUint(uint64(metadata.MinZoom), 10),
+		"maxzoom": strconv.FormatUint(uint64(metadata.MaxZoom), 10),
+	}
+	if metadata.Encoding != "" {
+		rows["encoding"] = metadata.Encoding
+	}
+	for name, value := range rows {
+		if _, err := db.Exec("INSERT OR REPLACE INTO metadata (name, value) VALUES (?, ?)", name, value); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("error writing metadata %s: %w", name, err)
+		}
+	}
+
+	return &mbtilesWriter{db: db}, nil
+}
+
+func (m *mbtilesWriter) WriteTile(t common.Tile, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sum := sha256.Sum256(data)
+	tileID := hex.EncodeToString(sum[:])
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error writing tile %s: %w", t, err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.Exec("INSERT OR IGNORE INTO images (tile_id, tile_data) VALUES (?, ?)", tileID, data); err != nil {
+		return fmt.Errorf("error writing tile %s: %w", t, err)
+	}
+
+	// MBTiles rows count from the bottom, like TMS
+	row := (uint(1) << t.Z) - 1 - t.Y
+	_, err = tx.Exec(
+		"INSERT OR REPLACE INTO map (zoom_level, tile_column, tile_row, tile_id) VALUES (?, ?, ?, ?)",
+		t.Z, t.X, row, tileID,
+	)
+	if err != nil {
+		return fmt.Errorf("error writing tile %s: %w", t, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error writing tile %s: %w", t, err)
+	}
+
+	return nil
+}
+
+func (m *mbtilesWriter) Close() error {
+	// Replaced tiles can leave images behind
+	if _, err := m.db.Exec("DELETE FROM images WHERE tile_id NOT IN (SELECT tile_id FROM map)"); err != nil {
+		_ = m.db.Close()
+		return fmt.Errorf("error removing unused images: %w", err)
+	}
+
+	if _, err := m.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		_ = m.db.Close()
+		return fmt.Errorf("error checkpointing MBTiles: %w", err)
+	}
+	return m.db.Close()
+}
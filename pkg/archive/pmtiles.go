@@ -0,0 +1,369 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/tilezen/go-zaloa/pkg/common"
+)
+
+// PMTiles v3 constants.
+// See https://github.com/protomaps/PMTiles/blob/main/spec/v3/spec.md
+const (
+	pmtilesHeaderSize = 127
+	// pmtilesRootSize is the most the header and root directory can take, so that clients can fetch both at once
+	pmtilesRootSize = 16384
+
+	pmtilesCompressionNone = 1
+	pmtilesCompressionGzip = 2
+
+	pmtilesTileTypePNG  = 2
+	pmtilesTileTypeWebP = 4
+)
+
+type pmtilesEntry struct {
+	tileID    uint64
+	offset    uint64
+	length    uint64
+	runLength uint32
+}
+
+// pmtilesContent is a distinct tile, stored once in the temporary file however many tiles share it.
+type pmtilesContent struct {
+	offset uint64
+	length uint64
+}
+
+type pmtilesWriter struct {
+	path     string
+	metadata Metadata
+
+	mu sync.Mutex
+	// tmp holds the distinct tiles in the order they were written. They're copied in tile ID order on Close.
+	tmp       *os.File
+	tmpOffset uint64
+	contents  map[[sha256.Size]byte]pmtilesContent
+	tiles     map[uint64][sha256.Size]byte
+}
+
+// NewPMTilesWriter creates a PMTiles v3 archive at path. Tiles can be written in any order; the archive is laid out on
+// Close, clustered by tile ID, with identical tiles stored once and runs of them sharing a directory entry.
+func NewPMTilesWriter(path string, metadata Metadata) (Writer, error) {
+	switch metadata.Format {
+	case "png", "webp":
+	default:
+		return nil, fmt.Errorf("unsupported PMTiles tile format %s", metadata.Format)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".pmtiles-*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary file: %w", err)
+	}
+
+	return &pmtilesWriter{
+		path:     path,
+		metadata: metadata,
+		tmp:      tmp,
+		contents: map[[sha256.Size]byte]pmtilesContent{},
+		tiles:    map[uint64][sha256.Size]byte{},
+	}, nil
+}
+
+func (p *pmtilesWriter) WriteTile(t common.Tile, data []byte) error {
+	sum := sha256.Sum256(data)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.contents[sum]; !ok {
+		if _, err := p.tmp.Write(data); err != nil {
+			return fmt.Errorf("error writing tile %s: %w", t, err)
+		}
+		p.contents[sum] = pmtilesContent{offset: p.tmpOffset, length: uint64(len(data))}
+		p.tmpOffset += uint64(len(data))
+	}
+
+	p.tiles[pmtilesTileID(t)] = sum
+	return nil
+}
+
+func (p *pmtilesWriter) Close() error {
+	defer os.Remove(p.tmp.Name())
+	defer p.tmp.Close()
+
+	tileIDs := make([]uint64, 0, len(p.tiles))
+	for tileID := range p.tiles {
+		tileIDs = append(tileIDs, tileID)
+	}
+	sort.Slice(tileIDs, func(i, j int) bool { return tileIDs[i] < tileIDs[j] })
+
+	// Lay out the tile data in tile ID order, each distinct tile at its first use
+	var entries []pmtilesEntry
+	offsets := map[[sha256.Size]byte]uint64{}
+	var order [][sha256.Size]byte
+	dataLength := uint64(0)
+	for _, tileID := range tileIDs {
+		sum := p.tiles[tileID]
+		offset, ok := offsets[sum]
+		if !ok {
+			offset = dataLength
+			offsets[sum] = offset
+			order = append(order, sum)
+			dataLength += p.contents[sum].length
+		}
+
+		last := len(entries) - 1
+		if last >= 0 && entries[last].offset == offset && entries[last].tileID+uint64(entries[last].runLength) == tileID {
+			entries[last].runLength++
+			continue
+		}
+		entries = append(entries, pmtilesEntry{tileID: tileID, offset: offset, length: p.contents[sum].length, runLength: 1})
+	}
+
+	rootDir, leafDirs, err := buildPMTilesDirectories(entries)
+	if err != nil {
+		return err
+	}
+
+	metadataJSON, err := p.metadataJSON()
+	if err != nil {
+		return err
+	}
+
+	header := p.header(uint64(len(rootDir)), uint64(len(metadataJSON)), uint64(len(leafDirs)), dataLength)
+	header.addressedTiles = uint64(len(tileIDs))
+	header.tileEntries = uint64(len(entries))
+	header.tileContents = uint64(len(order))
+
+	out, err := os.Create(p.path)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", p.path, err)
+	}
+	defer out.Close()
+
+	for _, section := range [][]byte{header.encode(), rootDir, metadataJSON, leafDirs} {
+		if _, err := out.Write(section); err != nil {
+			return fmt.Errorf("error writing %s: %w", p.path, err)
+		}
+	}
+
+	for _, sum := range order {
+		content := p.contents[sum]
+		if _, err := io.Copy(out, io.NewSectionReader(p.tmp, int64(content.offset), int64(content.length))); err != nil {
+			return fmt.Errorf("error writing tile data: %w", err)
+		}
+	}
+
+	return out.Close()
+}
+
+func (p *pmtilesWriter) metadataJSON() ([]byte, error) {
+	metadata := map[string]interface{}{
+		"name":    p.metadata.Name,
+		"format":  p.metadata.Format,
+		"type":    "baselayer",
+		"bounds":  p.metadata.Bounds.String(),
+		"minzoom": p.metadata.MinZoom,
+		"maxzoom": p.metadata.MaxZoom,
+	}
+	if p.metadata.Encoding != "" {
+		metadata["encoding"] = p.metadata.Encoding
+	}
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding metadata: %w", err)
+	}
+
+	return gzipBytes(data)
+}
+
+type pmtilesHeader struct {
+	rootOffset, rootLength         uint64
+	metadataOffset, metadataLength uint64
+	leafOffset, leafLength         uint64
+	dataOffset, dataLength         uint64
+	addressedTiles                 uint64
+	tileEntries                    uint64
+	tileContents                   uint64
+	tileType                       uint8
+	minZoom, maxZoom               uint8
+	bounds                         [4]int32
+	centerZoom                     uint8
+	center                         [2]int32
+}
+
+func (p *pmtilesWriter) header(rootLength, metadataLength, leafLength, dataLength uint64) *pmtilesHeader {
+	h := &pmtilesHeader{
+		rootOffset:     pmtilesHeaderSize,
+		rootLength:     rootLength,
+		metadataOffset: pmtilesHeaderSize + rootLength,
+		metadataLength: metadataLength,
+		leafOffset:     pmtilesHeaderSize + rootLength + metadataLength,
+		leafLength:     leafLength,
+		dataOffset:     pmtilesHeaderSize + rootLength + metadataLength + leafLength,
+		dataLength:     dataLength,
+		tileType:       pmtilesTileTypePNG,
+		minZoom:        uint8(p.metadata.MinZoom),
+		maxZoom:        uint8(p.metadata.MaxZoom),
+		centerZoom:     uint8(p.metadata.MinZoom),
+	}
+	if p.metadata.Format == "webp" {
+		h.tileType = pmtilesTileTypeWebP
+	}
+
+	e7 := func(v float64) int32 { return int32(math.Round(v * 1e7)) }
+	b := p.metadata.Bounds
+	h.bounds = [4]int32{e7(b.West), e7(b.South), e7(b.East), e7(b.North)}
+	h.center = [2]int32{e7((b.West + b.East) / 2), e7((b.South + b.North) / 2)}
+
+	return h
+}
+
+func (h *pmtilesHeader) encode() []byte {
+	b := make([]byte, 0, pmtilesHeaderSize)
+	b = append(b, "PMTiles"...)
+	b = append(b, 3)
+	for _, v := range []uint64{
+		h.rootOffset, h.rootLength,
+		h.metadataOffset, h.metadataLength,
+		h.leafOffset, h.leafLength,
+		h.dataOffset, h.dataLength,
+		h.addressedTiles, h.tileEntries, h.tileContents,
+	} {
+		b = binary.LittleEndian.AppendUint64(b, v)
+	}
+	// Clustered, then the compression of the directories and metadata, then of the tiles
+	b = append(b, 1, pmtilesCompressionGzip, pmtilesCompressionNone, h.tileType, h.minZoom, h.maxZoom)
+	for _, v := range h.bounds {
+		b = binary.LittleEndian.AppendUint32(b, uint32(v))
+	}
+	b = append(b, h.centerZoom)
+	for _, v := range h.center {
+		b = binary.LittleEndian.AppendUint32(b, uint32(v))
+	}
+	return b
+}
+
+// buildPMTilesDirectories serializes the entries into a root directory, splitting them into leaf directories when they
+// don't fit next to the header.
+func buildPMTilesDirectories(entries []pmtilesEntry) ([]byte, []byte, error) {
+	root, err := encodePMTilesDirectory(entries)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(root) <= pmtilesRootSize-pmtilesHeaderSize {
+		return root, nil, nil
+	}
+
+	for leafSize := 4096; ; leafSize = leafSize * 6 / 5 {
+		var rootEntries []pmtilesEntry
+		leaves := &bytes.Buffer{}
+		for start := 0; start < len(entries); start += leafSize {
+			end := start + leafSize
+			if end > len(entries) {
+				end = len(entries)
+			}
+
+			leaf, err := encodePMTilesDirectory(entries[start:end])
+			if err != nil {
+				return nil, nil, err
+			}
+
+			// Entries with a run length of 0 point at leaf directories
+			rootEntries = append(rootEntries, pmtilesEntry{
+				tileID: entries[start].tileID,
+				offset: uint64(leaves.Len()),
+				length: uint64(len(leaf)),
+			})
+			leaves.Write(leaf)
+		}
+
+		root, err := encodePMTilesDirectory(rootEntries)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(root) <= pmtilesRootSize-pmtilesHeaderSize {
+			return root, leaves.Bytes(), nil
+		}
+	}
+}
+
+func encodePMTilesDirectory(entries []pmtilesEntry) ([]byte, error) {
+	b := binary.AppendUvarint(nil, uint64(len(entries)))
+
+	lastID := uint64(0)
+	for _, e := range entries {
+		b = binary.AppendUvarint(b, e.tileID-lastID)
+		lastID = e.tileID
+	}
+	for _, e := range entries {
+		b = binary.AppendUvarint(b, uint64(e.runLength))
+	}
+	for _, e := range entries {
+		b = binary.AppendUvarint(b, e.length)
+	}
+	for i, e := range entries {
+		// Offsets that follow on from the previous entry are stored as 0
+		if i > 0 && e.offset == entries[i-1].offset+entries[i-1].length {
+			b = binary.AppendUvarint(b, 0)
+		} else {
+			b = binary.AppendUvarint(b, e.offset+1)
+		}
+	}
+
+	return gzipBytes(b)
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	b := &bytes.Buffer{}
+	w := gzip.NewWriter(b)
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("error compressing: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("error compressing: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+// pmtilesTileID numbers tiles by zoom, then along a Hilbert curve within each zoom.
+func pmtilesTileID(t common.Tile) uint64 {
+	id := uint64(0)
+	for z := uint(0); z < t.Z; z++ {
+		id += uint64(1) << (2 * z)
+	}
+
+	x, y := uint64(t.X), uint64(t.Y)
+	for s := uint64(1) << t.Z >> 1; s > 0; s >>= 1 {
+		rx, ry := uint64(0), uint64(0)
+		if x&s > 0 {
+			rx = 1
+		}
+		if y&s > 0 {
+			ry = 1
+		}
+		id += s * s * ((3 * rx) ^ ry)
+
+		// Rotate the quadrant
+		if ry == 0 {
+			if rx == 1 {
+				x = s - 1 - x
+				y = s - 1 - y
+			}
+			x, y = y, x
+		}
+	}
+
+	return id
+}
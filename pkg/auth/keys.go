@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"gopkg.in/yaml.v2"
+)
+
+// Key is an API key and the limits it's held to.
+type Key struct {
+	Key string `yaml:"key" json:"key"`
+	// Name identifies the key in logs and metrics, so that the key itself isn't exposed
+	Name string `yaml:"name" json:"name"`
+	// Rate is the number of requests per second the key can make, or unlimited if it's 0
+	Rate float64 `yaml:"rate" json:"rate"`
+	// Burst is the number of requests the key can make at once. It defaults to Rate, rounded up.
+	Burst int `yaml:"burst" json:"burst"`
+	// DailyQuota is the number of requests the key can make per UTC day, or unlimited if it's 0
+	DailyQuota int64 `yaml:"daily-quota" json:"daily-quota"`
+	Disabled   bool  `yaml:"disabled" json:"disabled"`
+}
+
+func (k *Key) setDefaults() {
+	if k.Burst == 0 && k.Rate > 0 {
+		k.Burst = int(math.Ceil(k.Rate))
+	}
+}
+
+func (k *Key) validate() error {
+	if k.Key == "" {
+		return fmt.Errorf("key without a value")
+	}
+	if k.Name == "" {
+		return fmt.Errorf("key without a name")
+	}
+	if k.Rate < 0 || k.Burst < 0 || k.DailyQuota < 0 {
+		return fmt.Errorf("key %s has a negative limit", k.Name)
+	}
+	return nil
+}
+
+// KeyStore looks up API keys.
+type KeyStore interface {
+	Lookup(key string) (*Key, bool)
+}
+
+// ReloadingKeyStore is a KeyStore that can be reloaded from where its keys are kept while it's in use.
+type ReloadingKeyStore struct {
+	keys atomic.Pointer[map[string]*Key]
+	load func() ([]Key, error)
+	// source describes where the keys are loaded from, for logging
+	source string
+}
+
+// NewKeyStore loads the keys in path. SQLite databases, with a .db, .sqlite or .sqlite3 extension, hold the keys in an
+// api_keys table. Other files are JSON if their name ends in .json and YAML otherwise, with the keys in a keys list.
+func NewKeyStore(path string) (*ReloadingKeyStore, error) {
+	s := &ReloadingKeyStore{source: path}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".db", ".sqlite", ".sqlite3":
+		s.load = func() ([]Key, error) { return loadSQLiteKeys(path) }
+	default:
+		s.load = func() ([]Key, error) { return loadKeyFile(path) }
+	}
+
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ReloadingKeyStore) Lookup(key string) (*Key, bool) {
+	k, ok := (*s.keys.Load())[key]
+	return k, ok
+}
+
+// Reload loads the keys again, keeping the current keys if they can't be loaded.
+func (s *ReloadingKeyStore) Reload() error {
+	keys, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	byKey := map[string]*Key{}
+	for i := range keys {
+		k := keys[i]
+		k.setDefaults()
+		if err := k.validate(); err != nil {
+			return fmt.Errorf("invalid API keys in %s: %w", s.source, err)
+		}
+		if _, ok := byKey[k.Key]; ok {
+			return fmt.Errorf("invalid API keys in %s: key %s is defined twice", s.source, k.Name)
+		}
+		byKey[k.Key] = &k
+	}
+
+	s.keys.Store(&byKey)
+	return nil
+}
+
+// Watch reloads the keys every interval until ctx is done.
+func (s *ReloadingKeyStore) Watch(ctx context.Context, interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Reload(); err != nil {
+				logger.Warn("error reloading API keys, keeping the current keys", "source", s.source, "error", err)
+				continue
+			}
+			logger.Debug("reloaded API keys", "source", s.source, "keys", len(*s.keys.Load()))
+		}
+	}
+}
+
+type keyFile struct {
+	Keys []Key `yaml:"keys" json:"keys"`
+}
+
+func loadKeyFile(path string) ([]Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading API key file: %w", err)
+	}
+
+	file := &keyFile{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(file)
+	} else {
+		err = yaml.UnmarshalStrict(data, file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing API key file %s: %w", path, err)
+	}
+
+	return file.Keys, nil
+}
+
+// loadSQLiteKeys reads the keys from the api_keys table, which has the columns key, name, rate, burst, daily_quota
+// and disabled.
+func loadSQLiteKeys(path string) ([]Key, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", path))
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", path, err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT key, name, rate, burst, daily_quota, disabled FROM api_keys")
+	if err != nil {
+		return nil, fmt.Errorf("error reading API keys from %s: %w", path, err)
+	}
+	defer rows.Close()
+
+	var keys []Key
+	for rows.Next() {
+		var k Key
+		if err := rows.Scan(&k.Key, &k.Name, &k.Rate, &k.Burst, &k.DailyQuota, &k.Disabled); err != nil {
+			return nil, fmt.Errorf("error reading API keys from %s: %w", path, err)
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading API keys from %s: %w", path, err)
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/tilezen/go-zaloa/pkg/metrics"
+)
+
+const (
+	// QueryParam is the query parameter API keys can be passed in
+	QueryParam = "key"
+	// Header is the header API keys can be passed in
+	Header = "X-Api-Key"
+)
+
+type contextKey int
+
+const (
+	keyContextKey contextKey = iota
+)
+
+// KeyFromContext returns the API key the request with the given context was authorized with, or nil if it didn't go
+// through the middleware.
+func KeyFromContext(ctx context.Context) *Key {
+	k, _ := ctx.Value(keyContextKey).(*Key)
+	return k
+}
+
+// Usage tracks the requests made with each key. It's kept separately from the middleware so that the rate limits and
+// quotas carry over when the middleware is set up again, like when the configuration is reloaded.
+type Usage struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+	day      string
+	counts   map[string]int64
+}
+
+func NewUsage() *Usage {
+	return &Usage{
+		limiters: map[string]*rate.Limiter{},
+		counts:   map[string]int64{},
+	}
+}
+
+// reserve takes a request from the key's token bucket. It returns how long the request would have to wait, in which
+// case nothing is taken.
+func (u *Usage) reserve(k *Key, now time.Time) time.Duration {
+	if k.Rate == 0 {
+		return 0
+	}
+
+	u.mu.Lock()
+	limiter, ok := u.limiters[k.Key]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(k.Rate), k.Burst)
+		u.limiters[k.Key] = limiter
+	}
+	u.mu.Unlock()
+
+	// The limits may have changed since the limiter was created
+	if limiter.Limit() != rate.Limit(k.Rate) {
+		limiter.SetLimitAt(now, rate.Limit(k.Rate))
+	}
+	if limiter.Burst() != k.Burst {
+		limiter.SetBurstAt(now, k.Burst)
+	}
+
+	reservation := limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return time.Duration(math.MaxInt64)
+	}
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return delay
+	}
+	return 0
+}
+
+// count adds a request to the key's count for the day, unless the quota is used up. It returns the number of requests
+// made today, including this one if it was counted.
+func (u *Usage) count(k *Key, now time.Time) (int64, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	day := now.UTC().Format("2006-01-02")
+	if day != u.day {
+		u.day = day
+		u.counts = map[string]int64{}
+	}
+
+	used := u.counts[k.Key]
+	if k.DailyQuota > 0 && used >= k.DailyQuota {
+		return used, false
+	}
+
+	u.counts[k.Key] = used + 1
+	return used + 1, true
+}
+
+type middleware struct {
+	keys     KeyStore
+	usage    *Usage
+	recorder metrics.Recorder
+	logger   *slog.Logger
+}
+
+// NewMiddleware returns middleware that only lets requests with a valid API key through, within the key's rate limit
+// and daily quota. Requests without a known key get a 401, requests with a disabled key or over the quota a 403, and
+// requests over the rate limit a 429.
+func NewMiddleware(keys KeyStore, usage *Usage, recorder metrics.Recorder, logger *slog.Logger) func(http.Handler) http.Handler {
+	m := &middleware{
+		keys:     keys,
+		usage:    usage,
+		recorder: recorder,
+		logger:   logger,
+	}
+	return m.wrap
+}
+
+func (m *middleware) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		value := request.URL.Query().Get(QueryParam)
+		if value == "" {
+			value = request.Header.Get(Header)
+		}
+
+		if value == "" {
+			m.recorder.ObserveAPIKey("unknown", "missing")
+			writer.Header().Set("WWW-Authenticate", "ApiKey")
+			writer.WriteHeader(http.StatusUnauthorized)
+			_, _ = writer.Write([]byte("Missing API key"))
+			return
+		}
+
+		k, ok := m.keys.Lookup(value)
+		if !ok {
+			m.recorder.ObserveAPIKey("unknown", "invalid")
+			writer.Header().Set("WWW-Authenticate", "ApiKey")
+			writer.WriteHeader(http.StatusUnauthorized)
+			_, _ = writer.Write([]byte("Invalid API key"))
+			return
+		}
+
+		if k.Disabled {
+			m.recorder.ObserveAPIKey(k.Name, "disabled")
+			writer.WriteHeader(http.StatusForbidden)
+			_, _ = writer.Write([]byte("API key disabled"))
+			return
+		}
+
+		now := time.Now()
+		if k.Rate > 0 {
+			writer.Header().Set("X-RateLimit-Limit", strconv.FormatFloat(k.Rate, 'f', -1, 64))
+			writer.Header().Set("X-RateLimit-Burst", strconv.Itoa(k.Burst))
+		}
+
+		if delay := m.usage.reserve(k, now); delay > 0 {
+			m.recorder.ObserveAPIKey(k.Name, "rate_limited")
+			writer.Header().Set("Retry-After", retryAfter(delay))
+			writer.WriteHeader(http.StatusTooManyRequests)
+			_, _ = writer.Write([]byte("Rate limit exceeded"))
+			return
+		}
+
+		used, ok := m.usage.count(k, now)
+		if k.DailyQuota > 0 {
+			reset := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+			writer.Header().Set("X-Quota-Limit", strconv.FormatInt(k.DailyQuota, 10))
+			writer.Header().Set("X-Quota-Remaining", strconv.FormatInt(k.DailyQuota-used, 10))
+			writer.Header().Set("X-Quota-Reset", strconv.FormatInt(reset.Unix(), 10))
+
+			if !ok {
+				m.recorder.ObserveAPIKey(k.Name, "quota_exceeded")
+				writer.Header().Set("Retry-After", retryAfter(reset.Sub(now)))
+				writer.WriteHeader(http.StatusForbidden)
+				_, _ = writer.Write([]byte("Daily quota exceeded"))
+				return
+			}
+		}
+
+		m.recorder.ObserveAPIKey(k.Name, "allowed")
+		m.logger.DebugContext(request.Context(), "authorized request", "key", k.Name)
+		next.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), keyContextKey, k)))
+	})
+}
+
+// retryAfter formats a delay as whole seconds for a Retry-After header, rounding up.
+func retryAfter(delay time.Duration) string {
+	if delay > 24*time.Hour {
+		delay = 24 * time.Hour
+	}
+	return strconv.Itoa(int(math.Ceil(delay.Seconds())))
+}
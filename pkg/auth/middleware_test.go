@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tilezen/go-zaloa/pkg/metrics"
+)
+
+type staticKeys map[string]*Key
+
+func (s staticKeys) Lookup(key string) (*Key, bool) {
+	k, ok := s[key]
+	return k, ok
+}
+
+func TestUsageReserve(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		key  Key
+		// at are the offsets from now the requests are made at
+		at []time.Duration
+		// delayed are the requests that should be turned away
+		delayed []bool
+	}{
+		{
+			name:    "unlimited",
+			key:     Key{Key: "k", Rate: 0},
+			at:      []time.Duration{0, 0, 0, 0},
+			delayed: []bool{false, false, false, false},
+		},
+		{
+			name:    "burst then rate",
+			key:     Key{Key: "k", Rate: 1, Burst: 2},
+			at:      []time.Duration{0, 0, 0, 500 * time.Millisecond, time.Second},
+			delayed: []bool{false, false, true, true, false},
+		},
+		{
+			name:    "turned away requests don't take tokens",
+			key:     Key{Key: "k", Rate: 1, Burst: 1},
+			at:      []time.Duration{0, 0, 0, 0, time.Second, time.Second},
+			delayed: []bool{false, true, true, true, false, true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usage := NewUsage()
+			for i, at := range tt.at {
+				delay := usage.reserve(&tt.key, now.Add(at))
+				if (delay > 0) != tt.delayed[i] {
+					t.Errorf("request %d: expected delayed %t, got a delay of %s", i, tt.delayed[i], delay)
+				}
+			}
+		})
+	}
+}
+
+func TestUsageReserveChangedLimits(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	usage := NewUsage()
+
+	k := &Key{Key: "k", Rate: 1, Burst: 1}
+	if delay := usage.reserve(k, now); delay > 0 {
+		t.Fatalf("expected the first request through, got a delay of %s", delay)
+	}
+	if delay := usage.reserve(k, now); delay <= 0 {
+		t.Fatalf("expected the second request to be delayed")
+	}
+
+	// A reload raising the rate applies to the limiter the key already has: the request would wait 800ms at the old
+	// rate and 80ms at the new one
+	raised := &Key{Key: "k", Rate: 10, Burst: 10}
+	if delay := usage.reserve(raised, now.Add(200*time.Millisecond)); delay <= 0 || delay > 100*time.Millisecond {
+		t.Errorf("expected a delay at the raised rate, got %s", delay)
+	}
+	if delay := usage.reserve(raised, now.Add(300*time.Millisecond)); delay > 0 {
+		t.Errorf("expected the raised rate to let the request through, got a delay of %s", delay)
+	}
+}
+
+func TestUsageCount(t *testing.T) {
+	day := time.Date(2026, 10, 18, 23, 59, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		quota     int64
+		at        []time.Time
+		wantUsed  []int64
+		wantAllow []bool
+	}{
+		{
+			name:      "unlimited",
+			quota:     0,
+			at:        []time.Time{day, day, day},
+			wantUsed:  []int64{1, 2, 3},
+			wantAllow: []bool{true, true, true},
+		},
+		{
+			name:      "quota used up",
+			quota:     2,
+			at:        []time.Time{day, day, day, day},
+			wantUsed:  []int64{1, 2, 2, 2},
+			wantAllow: []bool{true, true, false, false},
+		},
+		{
+			name:      "reset at midnight UTC",
+			quota:     1,
+			at:        []time.Time{day, day, day.Add(time.Minute), day.Add(time.Minute)},
+			wantUsed:  []int64{1, 1, 1, 1},
+			wantAllow: []bool{true, false, true, false},
+		},
+		{
+			name:      "day is in UTC",
+			quota:     1,
+			at:        []time.Time{day, day.In(time.FixedZone("UTC+2", 2*60*60))},
+			wantUsed:  []int64{1, 1},
+			wantAllow: []bool{true, false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usage := NewUsage()
+			k := &Key{Key: "k", DailyQuota: tt.quota}
+			for i, at := range tt.at {
+				used, ok := usage.count(k, at)
+				if used != tt.wantUsed[i] || ok != tt.wantAllow[i] {
+					t.Errorf("request %d: expected %d used and allowed %t, got %d and %t", i, tt.wantUsed[i], tt.wantAllow[i], used, ok)
+				}
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	keys := staticKeys{
+		"open":     {Key: "open", Name: "open"},
+		"limited":  {Key: "limited", Name: "limited", Rate: 1, Burst: 1},
+		"quota":    {Key: "quota", Name: "quota", DailyQuota: 1},
+		"disabled": {Key: "disabled", Name: "disabled", Disabled: true},
+	}
+
+	tests := []struct {
+		name       string
+		key        string
+		header     bool
+		requests   int
+		wantStatus int
+		wantHeader string
+	}{
+		{name: "missing", requests: 1, wantStatus: http.StatusUnauthorized, wantHeader: "WWW-Authenticate"},
+		{name: "invalid", key: "nope", requests: 1, wantStatus: http.StatusUnauthorized, wantHeader: "WWW-Authenticate"},
+		{name: "valid", key: "open", requests: 1, wantStatus: http.StatusOK},
+		{name: "valid in header", key: "open", header: true, requests: 1, wantStatus: http.StatusOK},
+		{name: "disabled", key: "disabled", requests: 1, wantStatus: http.StatusForbidden},
+		{name: "within the rate limit", key: "limited", requests: 1, wantStatus: http.StatusOK, wantHeader: "X-RateLimit-Limit"},
+		{name: "over the rate limit", key: "limited", requests: 2, wantStatus: http.StatusTooManyRequests, wantHeader: "Retry-After"},
+		{name: "within the quota", key: "quota", requests: 1, wantStatus: http.StatusOK, wantHeader: "X-Quota-Remaining"},
+		{name: "over the quota", key: "quota", requests: 2, wantStatus: http.StatusForbidden, wantHeader: "X-Quota-Reset"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var authorized *Key
+			next := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				authorized = KeyFromContext(request.Context())
+			})
+			handler := NewMiddleware(keys, NewUsage(), metrics.NewNopRecorder(), slog.New(slog.NewTextHandler(io.Discard, nil)))(next)
+
+			var recorder *httptest.ResponseRecorder
+			for i := 0; i < tt.requests; i++ {
+				request := httptest.NewRequest(http.MethodGet, "/tile", nil)
+				if tt.header {
+					request.Header.Set(Header, tt.key)
+				} else if tt.key != "" {
+					request.URL.RawQuery = QueryParam + "=" + tt.key
+				}
+				recorder = httptest.NewRecorder()
+				handler.ServeHTTP(recorder, request)
+			}
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, recorder.Code)
+			}
+			if tt.wantHeader != "" && recorder.Header().Get(tt.wantHeader) == "" {
+				t.Errorf("expected a %s header", tt.wantHeader)
+			}
+			if tt.wantStatus == http.StatusOK && (authorized == nil || authorized.Key != tt.key) {
+				t.Errorf("expected the request to carry key %s, got %v", tt.key, authorized)
+			}
+		})
+	}
+}
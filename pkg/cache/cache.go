@@ -0,0 +1,21 @@
+package cache
+
+import (
+	"context"
+)
+
+// Entry is a rendered tile and the ETag it's served with.
+type Entry struct {
+	Data []byte
+	ETag string
+	// Source lists the sources of a tile built from a composite fetcher.
+	Source string
+}
+
+// Cache stores rendered tiles by their render key.
+type Cache interface {
+	// Get returns the entry stored under key, or nil if there isn't one.
+	Get(ctx context.Context, key string) (*Entry, error)
+	// Set stores entry under key, replacing any existing entry.
+	Set(ctx context.Context, key string, entry *Entry) error
+}
@@ -0,0 +1,130 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+type directoryStore struct {
+	dir string
+}
+
+// NewDirectoryStore creates a Cache that keeps each tile as a plain image file under dir, laid out by render key, so
+// that the directory can be served as is by a web server or CDN. The ETag is kept next to it in a .etag file, and the
+// sources of tiles built from a composite fetcher in a .source file.
+func NewDirectoryStore(dir string) Cache {
+	return &directoryStore{dir: dir}
+}
+
+func (d *directoryStore) path(key string) string {
+	return filepath.Join(d.dir, filepath.FromSlash(key))
+}
+
+func (d *directoryStore) Get(_ context.Context, key string) (*Entry, error) {
+	path := d.path(key)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading stored tile %s: %w", key, err)
+	}
+
+	etag, err := os.ReadFile(path + ".etag")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error reading ETag of stored tile %s: %w", key, err)
+	}
+
+	source, err := os.ReadFile(path + ".source")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error reading sources of stored tile %s: %w", key, err)
+	}
+
+	return &Entry{Data: data, ETag: string(etag), Source: string(source)}, nil
+}
+
+func (d *directoryStore) Set(_ context.Context, key string, entry *Entry) error {
+	path := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("error creating store directory: %w", err)
+	}
+
+	// All the files are written before any is renamed into place, so that a failed write never leaves a tile next to
+	// the ETag of another one
+	data, err := writeTemp(path, entry.Data)
+	if err != nil {
+		return fmt.Errorf("error writing stored tile %s: %w", key, err)
+	}
+	defer os.Remove(data)
+
+	etag, err := writeTemp(path, []byte(entry.ETag))
+	if err != nil {
+		return fmt.Errorf("error writing ETag of stored tile %s: %w", key, err)
+	}
+	defer os.Remove(etag)
+
+	// Most tiles come from a single source, so they don't get a .source file
+	var source string
+	if entry.Source != "" {
+		source, err = writeTemp(path, []byte(entry.Source))
+		if err != nil {
+			return fmt.Errorf("error writing sources of stored tile %s: %w", key, err)
+		}
+		defer os.Remove(source)
+	}
+
+	if err := os.Rename(data, path); err != nil {
+		return fmt.Errorf("error writing stored tile %s: %w", key, err)
+	}
+	if err := os.Rename(etag, path+".etag"); err != nil {
+		return fmt.Errorf("error writing ETag of stored tile %s: %w", key, err)
+	}
+	if source == "" {
+		// Drop the sources of the tile this one replaces
+		if err := os.Remove(path + ".source"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("error removing sources of stored tile %s: %w", key, err)
+		}
+	} else if err := os.Rename(source, path+".source"); err != nil {
+		return fmt.Errorf("error writing sources of stored tile %s: %w", key, err)
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to path, so that readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := writeTemp(path, data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	return os.Rename(tmp, path)
+}
+
+// writeTemp writes data to a new temporary file in the directory of path and returns its name.
+func writeTemp(path string, data []byte) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+
+	// CreateTemp makes files only readable by their owner
+	err = tmp.Chmod(0o644)
+	if err == nil {
+		_, err = tmp.Write(data)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
+}
@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirectoryStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store := NewDirectoryStore(dir)
+
+	tests := []struct {
+		name  string
+		key   string
+		entry *Entry
+	}{
+		{name: "tile", key: "v1/terrarium/256/1/0/0.png", entry: &Entry{Data: []byte("tile"), ETag: `"a"`}},
+		{name: "replaced tile", key: "v1/terrarium/256/1/0/0.png", entry: &Entry{Data: []byte("new tile"), ETag: `"b"`}},
+		{name: "no ETag", key: "v1/terrarium/256/1/0/1.png", entry: &Entry{Data: []byte("tile")}},
+		{name: "sources", key: "v1/terrarium/256/1/1/0.png", entry: &Entry{Data: []byte("tile"), ETag: `"c"`, Source: "national,default"}},
+		{name: "sources dropped", key: "v1/terrarium/256/1/1/0.png", entry: &Entry{Data: []byte("tile"), ETag: `"d"`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := store.Set(ctx, tt.key, tt.entry); err != nil {
+				t.Fatalf("error storing tile: %v", err)
+			}
+
+			got, err := store.Get(ctx, tt.key)
+			if err != nil {
+				t.Fatalf("error reading tile: %v", err)
+			}
+			if got == nil || string(got.Data) != string(tt.entry.Data) || got.ETag != tt.entry.ETag || got.Source != tt.entry.Source {
+				t.Errorf("expected %+v, got %+v", tt.entry, got)
+			}
+
+			// The tile is a plain file, so that the directory can be served as is
+			data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(tt.key)))
+			if err != nil || string(data) != string(tt.entry.Data) {
+				t.Errorf("expected the file to hold the tile, got %q: %v", data, err)
+			}
+		})
+	}
+
+	if entry, err := store.Get(ctx, "v1/terrarium/256/9/0/0.png"); entry != nil || err != nil {
+		t.Errorf("expected no entry for a missing tile, got %+v: %v", entry, err)
+	}
+
+	// No temporary files are left behind
+	matches, _ := filepath.Glob(filepath.Join(dir, "v1/terrarium/256/1/*/.tmp-*"))
+	if len(matches) != 0 {
+		t.Errorf("expected no temporary files, got %v", matches)
+	}
+}
@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+type diskCache struct {
+	dir string
+}
+
+// NewDiskCache creates a Cache that stores each tile in a file under dir. Nothing is ever evicted, so the directory
+// should be cleaned up externally if it's not meant to grow forever.
+func NewDiskCache(dir string) Cache {
+	return &diskCache{dir: dir}
+}
+
+func (d *diskCache) path(key string) string {
+	return filepath.Join(d.dir, filepath.FromSlash(key))
+}
+
+// Files hold the ETag and the sources, separated by a tab, on the first line, followed by the tile data. The sources are
+// left out, along with the tab, when there are none.
+func (d *diskCache) Get(_ context.Context, key string) (*Entry, error) {
+	data, err := os.ReadFile(d.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading cached tile %s: %w", key, err)
+	}
+
+	header, tileData, ok := bytes.Cut(data, []byte("\n"))
+	if !ok {
+		return nil, fmt.Errorf("corrupt cached tile %s", key)
+	}
+	etag, source, _ := bytes.Cut(header, []byte("\t"))
+
+	return &Entry{Data: tileData, ETag: string(etag), Source: string(source)}, nil
+}
+
+func (d *diskCache) Set(_ context.Context, key string, entry *Entry) error {
+	path := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("error creating cache directory: %w", err)
+	}
+
+	header := entry.ETag
+	if entry.Source != "" {
+		header += "\t" + entry.Source
+	}
+	if err := writeFileAtomic(path, append([]byte(header+"\n"), entry.Data...)); err != nil {
+		return fmt.Errorf("error writing cached tile %s: %w", key, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskCache(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name  string
+		entry *Entry
+	}{
+		{name: "tile", entry: &Entry{Data: []byte("tile\nwith\tnewlines"), ETag: `"a"`}},
+		{name: "sources", entry: &Entry{Data: []byte("tile"), ETag: `"a"`, Source: "lidar+default"}},
+		{name: "no ETag", entry: &Entry{Data: []byte("tile"), Source: "national"}},
+		{name: "empty tile", entry: &Entry{ETag: `"a"`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewDiskCache(t.TempDir())
+			if err := c.Set(ctx, "v1/terrarium/256/1/0/0.png", tt.entry); err != nil {
+				t.Fatalf("error caching tile: %v", err)
+			}
+
+			got, err := c.Get(ctx, "v1/terrarium/256/1/0/0.png")
+			if err != nil {
+				t.Fatalf("error reading tile: %v", err)
+			}
+			if got == nil || string(got.Data) != string(tt.entry.Data) || got.ETag != tt.entry.ETag || got.Source != tt.entry.Source {
+				t.Errorf("expected %+v, got %+v", tt.entry, got)
+			}
+		})
+	}
+}
+
+func TestDiskCacheFormats(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		file    string
+		want    *Entry
+		wantErr bool
+	}{
+		// Files written before the sources were kept
+		{name: "ETag only", file: "\"a\"\ntile", want: &Entry{Data: []byte("tile"), ETag: `"a"`}},
+		{name: "ETag and sources", file: "\"a\"\tnational\ntile", want: &Entry{Data: []byte("tile"), ETag: `"a"`, Source: "national"}},
+		{name: "no header", file: "tile", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "tile.png"), []byte(tt.file), 0o644); err != nil {
+				t.Fatalf("error writing file: %v", err)
+			}
+
+			got, err := NewDiskCache(dir).Get(ctx, "tile.png")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(got.Data) != string(tt.want.Data) || got.ETag != tt.want.ETag || got.Source != tt.want.Source {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+
+	if entry, err := NewDiskCache(t.TempDir()).Get(ctx, "missing.png"); entry != nil || err != nil {
+		t.Errorf("expected no entry for a missing tile, got %+v: %v", entry, err)
+	}
+}
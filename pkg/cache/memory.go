@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+type memoryItem struct {
+	key   string
+	entry *Entry
+}
+
+type memoryCache struct {
+	maxBytes int64
+
+	mu    sync.Mutex
+	bytes int64
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+// NewMemoryCache creates a Cache that keeps up to maxBytes of tile data in memory, evicting the least recently used
+// tiles first.
+func NewMemoryCache(maxBytes int64) Cache {
+	return &memoryCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+func (m *memoryCache) Get(_ context.Context, key string) (*Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elem, ok := m.items[key]
+	if !ok {
+		return nil, nil
+	}
+
+	m.lru.MoveToFront(elem)
+	return elem.Value.(*memoryItem).entry, nil
+}
+
+func (m *memoryCache) Set(_ context.Context, key string, entry *Entry) error {
+	size := int64(len(entry.Data))
+	if size > m.maxBytes {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if elem, ok := m.items[key]; ok {
+		m.remove(elem)
+	}
+
+	m.items[key] = m.lru.PushFront(&memoryItem{key: key, entry: entry})
+	m.bytes += size
+
+	for m.bytes > m.maxBytes {
+		m.remove(m.lru.Back())
+	}
+
+	return nil
+}
+
+func (m *memoryCache) remove(elem *list.Element) {
+	item := m.lru.Remove(elem).(*memoryItem)
+	delete(m.items, item.key)
+	m.bytes -= int64(len(item.entry.Data))
+}
@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const (
+	// s3ETagMetadata is the object metadata holding the tile's ETag. S3's own ETag is a digest of the object and
+	// doesn't match the ETag zaloa derives from the source tiles.
+	s3ETagMetadata = "Zaloa-Etag"
+	// s3SourceMetadata is the object metadata holding the sources of the tile.
+	s3SourceMetadata = "Zaloa-Source"
+)
+
+type s3Store struct {
+	s3     s3iface.S3API
+	bucket string
+	prefix string
+}
+
+// NewS3Store creates a Cache that keeps each tile as an object in bucket, under prefix followed by the render key, so
+// that a CDN can serve the bucket directly.
+func NewS3Store(s3 s3iface.S3API, bucket string, prefix string) Cache {
+	return &s3Store{s3: s3, bucket: bucket, prefix: prefix}
+}
+
+func (s *s3Store) key(key string) string {
+	return path.Join(s.prefix, key)
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) (*Entry, error) {
+	s3Key := s.key(key)
+	resp, err := s.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s3Key),
+	})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching stored tile s3://%s/%s: %w", s.bucket, s3Key, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading stored tile s3://%s/%s: %w", s.bucket, s3Key, err)
+	}
+
+	return &Entry{
+		Data:   data,
+		ETag:   aws.StringValue(resp.Metadata[s3ETagMetadata]),
+		Source: aws.StringValue(resp.Metadata[s3SourceMetadata]),
+	}, nil
+}
+
+func (s *s3Store) Set(ctx context.Context, key string, entry *Entry) error {
+	s3Key := s.key(key)
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s3Key),
+		Body:   bytes.NewReader(entry.Data),
+	}
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+	input.Metadata = map[string]*string{}
+	if entry.ETag != "" {
+		input.Metadata[s3ETagMetadata] = aws.String(entry.ETag)
+	}
+	if entry.Source != "" {
+		input.Metadata[s3SourceMetadata] = aws.String(entry.Source)
+	}
+
+	_, err := s.s3.PutObjectWithContext(ctx, input)
+	if err != nil {
+		return fmt.Errorf("error storing tile s3://%s/%s: %w", s.bucket, s3Key, err)
+	}
+
+	return nil
+}
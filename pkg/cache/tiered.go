@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"context"
+	"errors"
+)
+
+type tieredCache struct {
+	tiers []Cache
+}
+
+// NewTieredCache creates a Cache that looks tiles up in each of tiers in order, usually from fastest to slowest. A
+// tile found in a later tier is copied into the earlier ones, and new tiles are stored in all of them.
+func NewTieredCache(tiers ...Cache) Cache {
+	return &tieredCache{tiers: tiers}
+}
+
+func (t *tieredCache) Get(ctx context.Context, key string) (*Entry, error) {
+	var errs []error
+	for i, tier := range t.tiers {
+		entry, err := tier.Get(ctx, key)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if entry == nil {
+			continue
+		}
+
+		for _, earlier := range t.tiers[:i] {
+			if err := earlier.Set(ctx, key, entry); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return entry, errors.Join(errs...)
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+func (t *tieredCache) Set(ctx context.Context, key string, entry *Entry) error {
+	var errs []error
+	for _, tier := range t.tiers {
+		if err := tier.Set(ctx, key, entry); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// WriteBackCache is a Cache whose writes happen in the background.
+type WriteBackCache interface {
+	Cache
+	// Close stops accepting writes and waits for the queued ones to finish, or for ctx to be done.
+	Close(ctx context.Context) error
+}
+
+type writeBackItem struct {
+	key   string
+	entry *Entry
+}
+
+// deadLetter is written for every tile that couldn't be stored, so that it can be rendered again later.
+type deadLetter struct {
+	Time  time.Time `json:"time"`
+	Key   string    `json:"key"`
+	Error string    `json:"error"`
+}
+
+type writeBackCache struct {
+	store  Cache
+	logger *slog.Logger
+
+	queue chan writeBackItem
+	wg    sync.WaitGroup
+
+	mu         sync.Mutex
+	closed     bool
+	deadLetter *json.Encoder
+}
+
+// ErrWriteBackQueueFull is returned by the Set method of a write-back cache when the tile doesn't fit in the queue.
+var ErrWriteBackQueueFull = errors.New("write-back queue is full")
+
+// NewWriteBackCache wraps store so that Set returns immediately and the tile is written by one of workers goroutines.
+// Up to queueSize writes can wait. Writes that fail, or that don't fit in the queue, are recorded as JSON lines in
+// deadLetters, which may be nil. Writes that don't fit in the queue also make Set return ErrWriteBackQueueFull, failed
+// writes are logged.
+func NewWriteBackCache(store Cache, queueSize int, workers int, deadLetters io.Writer, logger *slog.Logger) WriteBackCache {
+	w := &writeBackCache{
+		store:  store,
+		logger: logger,
+		queue:  make(chan writeBackItem, queueSize),
+	}
+	if deadLetters != nil {
+		w.deadLetter = json.NewEncoder(deadLetters)
+	}
+
+	for i := 0; i < workers; i++ {
+		w.wg.Add(1)
+		go w.work()
+	}
+
+	return w
+}
+
+func (w *writeBackCache) Get(ctx context.Context, key string) (*Entry, error) {
+	return w.store.Get(ctx, key)
+}
+
+func (w *writeBackCache) Set(ctx context.Context, key string, entry *Entry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return errors.New("write-back cache is closed")
+	}
+
+	select {
+	case w.queue <- writeBackItem{key: key, entry: entry}:
+		return nil
+	default:
+		w.fail(ctx, key, ErrWriteBackQueueFull)
+		return ErrWriteBackQueueFull
+	}
+}
+
+func (w *writeBackCache) work() {
+	defer w.wg.Done()
+
+	for item := range w.queue {
+		// The request that rendered the tile is long gone by now
+		ctx := context.Background()
+		if err := w.store.Set(ctx, item.key, item.entry); err != nil {
+			w.logger.WarnContext(ctx, "couldn't write back tile", "key", item.key, "error", err)
+			w.mu.Lock()
+			w.fail(ctx, item.key, err)
+			w.mu.Unlock()
+		}
+	}
+}
+
+// fail records a tile that couldn't be written in the dead letters. It must be called with mu held.
+func (w *writeBackCache) fail(ctx context.Context, key string, err error) {
+	if w.deadLetter == nil {
+		return
+	}
+	if encodeErr := w.deadLetter.Encode(deadLetter{Time: time.Now().UTC(), Key: key, Error: err.Error()}); encodeErr != nil {
+		w.logger.ErrorContext(ctx, "error writing dead letter", "key", key, "error", encodeErr)
+	}
+}
+
+func (w *writeBackCache) Close(ctx context.Context) error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
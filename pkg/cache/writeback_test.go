@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// blockingStore holds every write until release is closed. taken receives a value for each write it starts.
+type blockingStore struct {
+	Cache
+	taken   chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingStore) Set(ctx context.Context, key string, entry *Entry) error {
+	b.taken <- struct{}{}
+	<-b.release
+	return b.Cache.Set(ctx, key, entry)
+}
+
+// failingStore fails every write.
+type failingStore struct {
+	Cache
+}
+
+func (failingStore) Set(context.Context, string, *Entry) error {
+	return errors.New("store is down")
+}
+
+func TestWriteBackCache(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name        string
+		store       func() (Cache, func())
+		queueSize   int
+		writes      int
+		wantErrors  int
+		deadLetters int
+		stored      int
+	}{
+		{
+			name:      "all queued",
+			store:     func() (Cache, func()) { return NewMemoryCache(1 << 20), func() {} },
+			queueSize: 2,
+			writes:    2,
+			stored:    2,
+		},
+		{
+			name: "queue full",
+			store: func() (Cache, func()) {
+				// One write is taken by the worker and held, one waits in the queue and the last doesn't fit
+				b := &blockingStore{Cache: NewMemoryCache(1 << 20), taken: make(chan struct{}, 3), release: make(chan struct{})}
+				return b, func() { close(b.release) }
+			},
+			queueSize:   1,
+			writes:      3,
+			wantErrors:  1,
+			deadLetters: 1,
+			stored:      2,
+		},
+		{
+			name:        "store failing",
+			store:       func() (Cache, func()) { return failingStore{Cache: NewMemoryCache(1 << 20)}, func() {} },
+			queueSize:   2,
+			writes:      2,
+			deadLetters: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store, release := tt.store()
+			deadLetters := &bytes.Buffer{}
+			w := NewWriteBackCache(store, tt.queueSize, 1, deadLetters, logger)
+
+			errs := 0
+			for i := 0; i < tt.writes; i++ {
+				err := w.Set(ctx, string(rune('a'+i)), &Entry{Data: []byte{byte(i)}})
+				if errors.Is(err, ErrWriteBackQueueFull) {
+					errs++
+				} else if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if b, ok := store.(*blockingStore); ok && i == 0 {
+					// Let the worker take the first write off the queue
+					<-b.taken
+				}
+			}
+			release()
+			if err := w.Close(ctx); err != nil {
+				t.Fatalf("error closing: %v", err)
+			}
+
+			if errs != tt.wantErrors {
+				t.Errorf("expected %d full queue errors, got %d", tt.wantErrors, errs)
+			}
+
+			lines := 0
+			for _, line := range strings.Split(strings.TrimSpace(deadLetters.String()), "\n") {
+				if line == "" {
+					continue
+				}
+				var letter deadLetter
+				if err := json.Unmarshal([]byte(line), &letter); err != nil || letter.Key == "" {
+					t.Errorf("invalid dead letter %s: %v", line, err)
+				}
+				lines++
+			}
+			if lines != tt.deadLetters {
+				t.Errorf("expected %d dead letters, got %d", tt.deadLetters, lines)
+			}
+
+			stored := 0
+			for i := 0; i < tt.writes; i++ {
+				if entry, _ := w.Get(ctx, string(rune('a'+i))); entry != nil {
+					stored++
+				}
+			}
+			if stored != tt.stored {
+				t.Errorf("expected %d stored tiles, got %d", tt.stored, stored)
+			}
+
+			if err := w.Set(ctx, "closed", &Entry{}); err == nil {
+				t.Errorf("expected an error writing to a closed cache")
+			}
+		})
+	}
+}
@@ -0,0 +1,473 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gorilla/mux"
+
+	"github.com/tilezen/go-zaloa/pkg/admission"
+	"github.com/tilezen/go-zaloa/pkg/auth"
+	"github.com/tilezen/go-zaloa/pkg/cache"
+	"github.com/tilezen/go-zaloa/pkg/cors"
+	"github.com/tilezen/go-zaloa/pkg/fetcher"
+	"github.com/tilezen/go-zaloa/pkg/logging"
+	"github.com/tilezen/go-zaloa/pkg/metrics"
+	"github.com/tilezen/go-zaloa/pkg/render"
+	"github.com/tilezen/go-zaloa/pkg/service"
+	"github.com/tilezen/go-zaloa/pkg/signing"
+	"github.com/tilezen/go-zaloa/pkg/tilesets"
+	"github.com/tilezen/go-zaloa/pkg/tracing"
+)
+
+// NewLogger sets up the logger described by the log options.
+func (c *Config) NewLogger(w io.Writer) (*slog.Logger, error) {
+	return logging.New(w, c.Log.Format, c.Log.Level)
+}
+
+// SetupTracing sets up tracing if an OTLP endpoint is configured. The returned function flushes the traces.
+func (c *Config) SetupTracing(ctx context.Context) (func(context.Context) error, error) {
+	return tracing.Setup(ctx, tracing.Config{
+		Endpoint:    c.Tracing.OTLPEndpoint,
+		Insecure:    c.Tracing.OTLPInsecure,
+		SampleRatio: c.Tracing.SampleRatio,
+	})
+}
+
+// NewAWSSession sets up an AWS session in region, assuming the configured IAM role if there is one.
+func (c *Config) NewAWSSession(region string) (*session.Session, error) {
+	if region == "" {
+		return nil, fmt.Errorf("region must be set when using S3")
+	}
+
+	var awsSession *session.Session
+	var err error
+	if c.Fetcher.IAMRole == "" {
+		awsSession, err = session.NewSessionWithOptions(session.Options{
+			Config: aws.Config{Region: aws.String(region)},
+		})
+	} else {
+		slog.Info("Configured to use AWS role", "role", c.Fetcher.IAMRole)
+		awsSession, err = session.NewSessionWithOptions(session.Options{
+			Config: aws.Config{
+				Credentials: stscreds.NewCredentials(session.Must(session.NewSession()), c.Fetcher.IAMRole),
+				Region:      aws.String(region),
+			},
+			SharedConfigState: session.SharedConfigEnable,
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up AWS session: %w", err)
+	}
+
+	return awsSession, nil
+}
+
+func (c *Config) newFetcher(method string, httpPrefix string, s3Bucket string, requesterPays bool, region string, logger *slog.Logger, recorder metrics.Recorder) (fetcher.TileFetcher, error) {
+	var tileFetcher fetcher.TileFetcher
+	switch method {
+	case "http":
+		tileFetcher = fetcher.NewHTTPTileFetcher(httpPrefix, logger)
+	case "s3":
+		awsSession, err := c.NewAWSSession(region)
+		if err != nil {
+			return nil, err
+		}
+
+		tileFetcher = fetcher.NewS3TileFetcher(s3.New(awsSession), s3Bucket, requesterPays, logger)
+	default:
+		return nil, fmt.Errorf("no fetch-method specified")
+	}
+
+	if recorder != nil {
+		tileFetcher = fetcher.NewInstrumentedTileFetcher(tileFetcher, method, recorder)
+	}
+	return tileFetcher, nil
+}
+
+// FetchLimiters are the concurrency limiters of the fetchers. A fetch waits for a slot of the limiter of its fetcher, if
+// it has one, and then for a slot of the limiter shared by all the fetchers, if there is one.
+type FetchLimiters struct {
+	recorder  metrics.Recorder
+	resources *Resources
+	queueSize int
+	total     *admission.Limiter
+}
+
+// NewFetchLimiters sets up the limiter shared by all the fetchers, or takes it from resources. The limiters report to
+// recorder, if it's set.
+func (c *Config) NewFetchLimiters(recorder metrics.Recorder, resources *Resources) *FetchLimiters {
+	l := &FetchLimiters{recorder: recorder, resources: resources, queueSize: c.Fetcher.QueueSize}
+	if c.Fetcher.MaxConcurrentTotal > 0 {
+		l.total = resources.limiter("fetch", c.Fetcher.MaxConcurrentTotal, c.Fetcher.QueueSize, recorder)
+	}
+	return l
+}
+
+// limit bounds the number of fetches f makes at once to maxConcurrent, if it's positive, within the limit shared by all
+// the fetchers.
+func (l *FetchLimiters) limit(f fetcher.TileFetcher, name string, maxConcurrent int) fetcher.TileFetcher {
+	if l.total != nil {
+		f = fetcher.NewLimitedTileFetcher(f, l.total)
+	}
+	if maxConcurrent > 0 {
+		f = fetcher.NewLimitedTileFetcher(f, l.resources.limiter("fetch:"+name, maxConcurrent, l.queueSize, l.recorder))
+	}
+	return f
+}
+
+// hedgeFetcher sends a second request for the tiles f is slow to fetch, if percentile is positive.
+func hedgeFetcher(f fetcher.TileFetcher, name string, percentile float64, budget float64, minDelayMS int, recorder metrics.Recorder) fetcher.TileFetcher {
+	if percentile <= 0 {
+		return f
+	}
+	if recorder == nil {
+		recorder = metrics.NewNopRecorder()
+	}
+	return fetcher.NewHedgedTileFetcher(f, name, fetcher.HedgeOptions{
+		Percentile: percentile,
+		MinDelay:   time.Duration(minDelayMS) * time.Millisecond,
+		Budget:     budget,
+	}, recorder)
+}
+
+// NewFetcher sets up the default fetcher, bounded by limiters. Its fetches are reported to recorder, if it's set.
+func (c *Config) NewFetcher(logger *slog.Logger, recorder metrics.Recorder, limiters *FetchLimiters) (fetcher.TileFetcher, error) {
+	f := c.Fetcher
+	tileFetcher, err := c.newFetcher(f.Method, f.HTTPPrefix, f.S3Bucket, f.RequesterPays, f.Region, logger, recorder)
+	if err != nil {
+		return nil, err
+	}
+	// Hedges wait for a slot like any other fetch
+	tileFetcher = limiters.limit(tileFetcher, tilesets.DefaultFetcher, f.MaxConcurrent)
+	return hedgeFetcher(tileFetcher, tilesets.DefaultFetcher, f.HedgePercentile, f.HedgeBudget, f.HedgeMinDelayMS, recorder), nil
+}
+
+// TilesetOptions loads the color ramps and the tileset file, if they're set, and sets up the fetchers the tileset file
+// defines, bounded by limiters. Composite fetchers that include the default fetcher use defaultFetcher, or set one up
+// if it's nil. The registry of the tilesets that are served is returned with the options.
+func (c *Config) TilesetOptions(logger *slog.Logger, recorder metrics.Recorder, limiters *FetchLimiters, defaultFetcher fetcher.TileFetcher) (*tilesets.Registry, []service.Option, error) {
+	var opts []service.Option
+
+	if c.Tilesets.ColorRampDir != "" {
+		colorRamps, err := render.LoadColorRamps(c.Tilesets.ColorRampDir)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to load color ramps: %w", err)
+		}
+
+		logger.Info("Loaded color ramps", "count", len(colorRamps), "dir", c.Tilesets.ColorRampDir)
+		opts = append(opts, service.WithColorRamps(colorRamps))
+	}
+
+	if c.Tilesets.File == "" {
+		return tilesets.NewDefaultRegistry(), opts, nil
+	}
+
+	registry, fetcherConfigs, err := tilesets.Load(c.Tilesets.File)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fetchers := map[string]fetcher.TileFetcher{}
+	for name, f := range fetcherConfigs {
+		if f.IsComposite() {
+			continue
+		}
+
+		region := f.Region
+		if region == "" {
+			region = c.Fetcher.Region
+		}
+
+		tileFetcher, err := c.newFetcher(f.Method, f.HTTPPrefix, f.S3Bucket, f.RequesterPays, region, logger, recorder)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to set up fetcher %s: %w", name, err)
+		}
+		tileFetcher = limiters.limit(tileFetcher, name, f.MaxConcurrent)
+
+		budget, minDelayMS := c.Fetcher.HedgeBudget, c.Fetcher.HedgeMinDelayMS
+		if f.HedgeBudget != nil {
+			budget = *f.HedgeBudget
+		}
+		if f.HedgeMinDelayMS != nil {
+			minDelayMS = *f.HedgeMinDelayMS
+		}
+		fetchers[name] = hedgeFetcher(tileFetcher, name, f.HedgePercentile, budget, minDelayMS, recorder)
+	}
+	if defaultFetcher != nil {
+		fetchers[tilesets.DefaultFetcher] = defaultFetcher
+	}
+
+	// Composite and mosaic fetchers are set up once the fetchers they're made of are
+	for name, f := range fetcherConfigs {
+		if !f.IsComposite() {
+			continue
+		}
+
+		var sources []fetcher.CompositeSource
+		for _, s := range f.Sources {
+			sourceFetcher, ok := fetchers[s.Fetcher]
+			if !ok {
+				// Only the default fetcher isn't set up yet
+				sourceFetcher, err = c.NewFetcher(logger, recorder, limiters)
+				if err != nil {
+					return nil, nil, fmt.Errorf("unable to set up fetcher %s: %w", name, err)
+				}
+				fetchers[s.Fetcher] = sourceFetcher
+			}
+
+			maxZoom := uint(math.MaxUint32)
+			if s.MaxZoom != nil {
+				maxZoom = *s.MaxZoom
+			}
+			sources = append(sources, fetcher.CompositeSource{
+				Name:    s.Fetcher,
+				Fetcher: sourceFetcher,
+				Area:    s.Area(),
+				MinZoom: s.MinZoom,
+				MaxZoom: maxZoom,
+				Nodata:  s.Nodata,
+			})
+		}
+
+		if f.Method == "mosaic" {
+			fetchers[name] = fetcher.NewMosaicTileFetcher(sources, f.Feather)
+		} else {
+			fetchers[name] = fetcher.NewCompositeTileFetcher(sources)
+		}
+	}
+	// The default fetcher is passed to the service separately
+	delete(fetchers, tilesets.DefaultFetcher)
+
+	logger.Info("Loaded tilesets", "count", len(registry.Tilesets()), "file", c.Tilesets.File)
+	return registry, append(opts, service.WithTilesets(registry, fetchers)), nil
+}
+
+// renderCacheOptions sets up the render cache, or takes it from resources, and the store. The returned function waits
+// for the tiles that are still being written to the store.
+func (c *Config) renderCacheOptions(logger *slog.Logger, resources *Resources) ([]service.Option, func(context.Context) error, error) {
+	closer := func(context.Context) error { return nil }
+
+	// Tiles are looked up in the render cache first, then in the store
+	var renderCaches []cache.Cache
+	switch c.RenderCache.Type {
+	case "memory":
+		renderCaches = append(renderCaches, resources.newMemoryCache(c.RenderCache.SizeMB))
+	case "disk":
+		renderCaches = append(renderCaches, cache.NewDiskCache(c.RenderCache.Dir))
+	}
+
+	var tileStore cache.Cache
+	switch c.Store.Type {
+	case "s3":
+		awsSession, err := c.NewAWSSession(c.Fetcher.Region)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		tileStore = cache.NewS3Store(s3.New(awsSession), c.Store.S3Bucket, c.Store.S3Prefix)
+	case "dir":
+		tileStore = cache.NewDirectoryStore(c.Store.Dir)
+	}
+
+	if tileStore != nil {
+		var deadLetters io.Writer
+		var deadLetterFile *os.File
+		if c.Store.DeadLetters != "" {
+			var err error
+			deadLetterFile, err = os.OpenFile(c.Store.DeadLetters, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unable to open store-dead-letters: %w", err)
+			}
+			deadLetters = deadLetterFile
+		}
+
+		writeBack := cache.NewWriteBackCache(tileStore, c.Store.QueueSize, c.Store.Workers, deadLetters, logger)
+		renderCaches = append(renderCaches, writeBack)
+
+		closer = func(ctx context.Context) error {
+			err := writeBack.Close(ctx)
+			if deadLetterFile != nil {
+				_ = deadLetterFile.Close()
+			}
+			return err
+		}
+	}
+
+	switch len(renderCaches) {
+	case 0:
+		return nil, closer, nil
+	case 1:
+		return []service.Option{service.WithRenderCache(renderCaches[0])}, closer, nil
+	default:
+		return []service.Option{service.WithRenderCache(cache.NewTieredCache(renderCaches...))}, closer, nil
+	}
+}
+
+// NewService sets up the fetchers, caches and tilesets and the service that serves them, reporting to recorder. The
+// render cache and the limiters are taken from resources when they haven't changed. The returned function waits for the tiles that are still being written to the store, and should be called on shutdown.
+func (c *Config) NewService(logger *slog.Logger, recorder metrics.Recorder, resources *Resources) (service.ZaloaService, func(context.Context) error, error) {
+	if recorder == nil {
+		recorder = metrics.NewNopRecorder()
+	}
+
+	limiters := c.NewFetchLimiters(recorder, resources)
+	tileFetcher, err := c.NewFetcher(logger, recorder, limiters)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to set up fetcher: %w", err)
+	}
+
+	cacheMaxAges, err := service.ParseCacheMaxAge(c.CacheMaxAge)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid cache-max-age: %w", err)
+	}
+
+	serviceOptions := []service.Option{
+		service.WithMetrics(recorder),
+		service.WithLogger(logger),
+		service.WithCacheMaxAge(cacheMaxAges),
+	}
+
+	_, tilesetOptions, err := c.TilesetOptions(logger, recorder, limiters, tileFetcher)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to load tilesets: %w", err)
+	}
+	serviceOptions = append(serviceOptions, tilesetOptions...)
+
+	cacheOptions, closer, err := c.renderCacheOptions(logger, resources)
+	if err != nil {
+		return nil, nil, err
+	}
+	serviceOptions = append(serviceOptions, cacheOptions...)
+
+	if c.Render.MaxConcurrent > 0 {
+		serviceOptions = append(serviceOptions, service.WithRenderLimiter(resources.limiter("render", c.Render.MaxConcurrent, c.Render.QueueSize, recorder)))
+	}
+
+	return service.NewZaloaService(tileFetcher, serviceOptions...), closer, nil
+}
+
+// NewAuth sets up the API key middleware and starts reloading the keys in the background. It returns nil middleware if
+// no key file is configured. The returned function stops reloading the keys.
+func (c *Config) NewAuth(logger *slog.Logger, recorder metrics.Recorder, usage *auth.Usage) (mux.MiddlewareFunc, func(), error) {
+	if c.Auth.KeyFile == "" {
+		return nil, func() {}, nil
+	}
+	if recorder == nil {
+		recorder = metrics.NewNopRecorder()
+	}
+
+	keys, err := auth.NewKeyStore(c.Auth.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to load API keys: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go keys.Watch(ctx, time.Duration(c.Auth.ReloadSeconds)*time.Second, logger)
+
+	return auth.NewMiddleware(keys, usage, recorder, logger), cancel, nil
+}
+
+// NewSigner loads the signing secrets. It returns nil if no secrets file is configured.
+func (c *Config) NewSigner() (*signing.Signer, error) {
+	if c.Signing.SecretsFile == "" {
+		return nil, nil
+	}
+
+	secrets, err := signing.LoadSecrets(c.Signing.SecretsFile)
+	if err != nil {
+		return nil, err
+	}
+	return signing.NewSigner(secrets)
+}
+
+// NewTileAuth sets up the middleware for tile requests, which accepts signed URLs if signing secrets are configured
+// and sends other requests through keys. It returns keys if no signing secrets are configured.
+func (c *Config) NewTileAuth(logger *slog.Logger, recorder metrics.Recorder, keys mux.MiddlewareFunc) (mux.MiddlewareFunc, error) {
+	signer, err := c.NewSigner()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load signing secrets: %w", err)
+	}
+	if signer == nil {
+		return keys, nil
+	}
+	if recorder == nil {
+		recorder = metrics.NewNopRecorder()
+	}
+
+	return signing.NewMiddleware(signer, keys, recorder, logger), nil
+}
+
+// NewRouter routes the health check, tile, TileJSON and WMTS requests, and the debug routes if they're enabled, to
+// zaloaService. Tile requests, WMTS ones included, go through tileAuthMiddleware, and every other route but the health
+// check through authMiddleware. Either can be nil. The CORS headers and the referer allowlist apply to every route but the health
+// check, before either.
+func (c *Config) NewRouter(zaloaService service.ZaloaService, authMiddleware mux.MiddlewareFunc, tileAuthMiddleware mux.MiddlewareFunc) *mux.Router {
+	r := mux.NewRouter()
+
+	r.HandleFunc("/live", zaloaService.GetHealthCheckHandler())
+
+	// Preflight requests are answered before authentication, and errors carry CORS headers so that scripts can read
+	// them
+	var outer []mux.MiddlewareFunc
+	if allowlist := splitList(c.Referer.Allowlist); len(allowlist) > 0 {
+		outer = append(outer, cors.NewAllowlist(allowlist, c.Referer.Required))
+	}
+	if origins := splitList(c.CORS.AllowedOrigins); len(origins) > 0 {
+		outer = append(outer, cors.NewMiddleware(cors.Options{
+			AllowedOrigins: origins,
+			AllowedMethods: splitList(c.CORS.AllowedMethods),
+			AllowedHeaders: splitList(c.CORS.AllowedHeaders),
+			ExposedHeaders: splitList(c.CORS.ExposedHeaders),
+			MaxAge:         time.Duration(c.CORS.MaxAge) * time.Second,
+		}))
+	}
+
+	wrap := func(middleware mux.MiddlewareFunc) func(string, func(http.ResponseWriter, *http.Request)) *mux.Route {
+		return func(path string, handler func(http.ResponseWriter, *http.Request)) *mux.Route {
+			var h http.Handler = http.HandlerFunc(handler)
+			if middleware != nil {
+				h = middleware(h)
+			}
+			for _, m := range outer {
+				h = m(h)
+			}
+			return r.Handle(path, h)
+		}
+	}
+	handle, handleTile, handleOpen := wrap(authMiddleware), wrap(tileAuthMiddleware), wrap(nil)
+
+	handleTile("/tilezen/terrain/{version:v[0-9]+}/{tilesize:[0-9]+}/{tileset}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", zaloaService.GetTileHandler())
+	handleTile("/tilezen/terrain/{version:v[0-9]+}/{tileset}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", zaloaService.GetTileHandler())
+	handle("/tilezen/terrain/{version:v[0-9]+}/{tilesize:[0-9]+}/{tileset}.json", zaloaService.GetTileJSONHandler())
+
+	if c.DebugRoutes {
+		handle("/debug/plan/tilezen/terrain/{version:v[0-9]+}/{tilesize:[0-9]+}/{tileset}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", zaloaService.GetDebugPlanHandler())
+		handle("/debug/plan/tilezen/terrain/{version:v[0-9]+}/{tileset}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", zaloaService.GetDebugPlanHandler())
+	}
+
+	// WMTS tile requests are authenticated once they're translated into tile requests, so that signatures are checked
+	// against the path of the tile endpoint and its bbox and zooms apply
+	var wmtsTiles http.Handler = http.HandlerFunc(zaloaService.GetTileHandler())
+	if tileAuthMiddleware != nil {
+		wmtsTiles = tileAuthMiddleware(wmtsTiles)
+	}
+	handleOpen("/wmts", zaloaService.GetWMTSHandler(wmtsTiles)).MatcherFunc(func(request *http.Request, _ *mux.RouteMatch) bool {
+		return service.IsWMTSGetTile(request)
+	})
+	handle("/wmts", zaloaService.GetWMTSHandler(wmtsTiles))
+	handle("/wmts/1.0.0/WMTSCapabilities.xml", zaloaService.GetWMTSCapabilitiesHandler())
+	handleOpen("/wmts/1.0.0/{layer}/{style}/{tilematrixset}/{tilematrix:[0-9]+}/{tilerow:[0-9]+}/{tilecol:[0-9]+}.{fmt}", zaloaService.GetWMTSTileHandler(wmtsTiles))
+
+	return r
+}
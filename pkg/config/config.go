@@ -0,0 +1,325 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/tilezen/go-zaloa/pkg/cors"
+	"github.com/tilezen/go-zaloa/pkg/service"
+)
+
+// Config holds the options of the server and the Lambda. Each option can be set in the config file, overridden with
+// its ZALOA_* environment variable and, where the binary has flags, overridden again with its flag.
+type Config struct {
+	Port        int  `yaml:"port" json:"port" flag:"port" env:"ZALOA_PORT" help:"The port to listen on"`
+	DebugRoutes bool `yaml:"debug-routes" json:"debug-routes" flag:"debug-routes" env:"ZALOA_DEBUG_ROUTES" help:"Serve /debug/plan, which explains how tiles are built and fetches their source tiles"`
+	// CacheMaxAge is parsed with service.ParseCacheMaxAge
+	CacheMaxAge string `yaml:"cache-max-age" json:"cache-max-age" flag:"cache-max-age" env:"ZALOA_CACHE_MAX_AGE" help:"Cache-Control max-age to send per version, e.g. v1=24h,v2=720h"`
+
+	Log         LogConfig         `yaml:"log" json:"log"`
+	Tracing     TracingConfig     `yaml:"tracing" json:"tracing"`
+	Fetcher     FetcherConfig     `yaml:"fetcher" json:"fetcher"`
+	Tilesets    TilesetsConfig    `yaml:"tilesets" json:"tilesets"`
+	Render      RenderConfig      `yaml:"render" json:"render"`
+	RenderCache RenderCacheConfig `yaml:"render-cache" json:"render-cache"`
+	Store       StoreConfig       `yaml:"store" json:"store"`
+	Auth        AuthConfig        `yaml:"auth" json:"auth"`
+	Signing     SigningConfig     `yaml:"signing" json:"signing"`
+	CORS        CORSConfig        `yaml:"cors" json:"cors"`
+	Referer     RefererConfig     `yaml:"referer" json:"referer"`
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level" json:"level" flag:"log-level" env:"ZALOA_LOG_LEVEL" help:"Minimum level of log messages. Use debug, info, warn or error."`
+	Format string `yaml:"format" json:"format" flag:"log-format" env:"ZALOA_LOG_FORMAT" help:"Format of log messages. Use json or text."`
+}
+
+type TracingConfig struct {
+	OTLPEndpoint string  `yaml:"otlp-endpoint" json:"otlp-endpoint" flag:"otlp-endpoint" env:"ZALOA_OTLP_ENDPOINT" help:"host:port of the OTLP/HTTP collector to send traces to. Tracing is disabled when empty."`
+	OTLPInsecure bool    `yaml:"otlp-insecure" json:"otlp-insecure" flag:"otlp-insecure" env:"ZALOA_OTLP_INSECURE" help:"Send traces to the OTLP collector over plain HTTP"`
+	SampleRatio  float64 `yaml:"sample-ratio" json:"sample-ratio" flag:"trace-sample-ratio" env:"ZALOA_TRACE_SAMPLE_RATIO" help:"Fraction of requests without a sampled parent trace to trace"`
+}
+
+// FetcherConfig describes the default fetcher.
+type FetcherConfig struct {
+	Method        string `yaml:"method" json:"method" flag:"fetch-method" env:"ZALOA_FETCH_METHOD" help:"Method to use when fetching tiles. Use http or s3."`
+	HTTPPrefix    string `yaml:"http-prefix" json:"http-prefix" flag:"http-prefix" env:"ZALOA_HTTP_PREFIX" help:"HTTP prefix when fetching tiles using HTTP fetch method"`
+	S3Bucket      string `yaml:"s3-bucket" json:"s3-bucket" flag:"s3-bucket" env:"ZALOA_S3_BUCKET" help:"S3 bucket to fetch tiles from when using S3 fetch method"`
+	RequesterPays bool   `yaml:"requester-pays" json:"requester-pays" flag:"requester-pays" env:"ZALOA_S3_REQUESTER_PAYS" help:"Set the requester pays flag when using the S3 fetch method"`
+	// Region and IAMRole are also used for the S3 store and the S3 fetchers of the tileset file
+	Region  string `yaml:"region" json:"region" flag:"region" env:"ZALOA_AWS_REGION" help:"Region to use when setting up connection to S3"`
+	IAMRole string `yaml:"iam-role" json:"iam-role" flag:"iam-role" env:"ZALOA_AWS_ROLE" help:"IAM role to assume when setting up connection to S3"`
+	// MaxConcurrent only applies to the default fetcher; the fetchers of the tileset file set their own
+	MaxConcurrent int `yaml:"max-concurrent" json:"max-concurrent" flag:"max-concurrent-fetches" env:"ZALOA_MAX_CONCURRENT_FETCHES" help:"Upstream fetches the default fetcher can make at once, across all requests. Unlimited when 0."`
+	// MaxConcurrentTotal and QueueSize apply to all the fetchers together
+	MaxConcurrentTotal int `yaml:"max-concurrent-total" json:"max-concurrent-total" flag:"max-concurrent-fetches-total" env:"ZALOA_MAX_CONCURRENT_FETCHES_TOTAL" help:"Upstream fetches all the fetchers together can make at once, across all requests. Unlimited when 0."`
+	QueueSize          int `yaml:"queue-size" json:"queue-size" flag:"fetch-queue-size" env:"ZALOA_FETCH_QUEUE_SIZE" help:"Fetches that can wait for a slot of each fetch limit. Fetches beyond that fail, and their tile requests get a 503."`
+	// The hedging options also only apply to the default fetcher
+	HedgePercentile float64 `yaml:"hedge-percentile" json:"hedge-percentile" flag:"hedge-percentile" env:"ZALOA_HEDGE_PERCENTILE" help:"Send a second request for source tiles that take longer than this percentile of the recent fetch latencies, e.g. 0.95. Fetches aren't hedged when 0."`
+	HedgeBudget     float64 `yaml:"hedge-budget" json:"hedge-budget" flag:"hedge-budget" env:"ZALOA_HEDGE_BUDGET" help:"Fraction of fetches that can be hedged"`
+	HedgeMinDelayMS int     `yaml:"hedge-min-delay-ms" json:"hedge-min-delay-ms" flag:"hedge-min-delay-ms" env:"ZALOA_HEDGE_MIN_DELAY_MS" help:"Shortest time in milliseconds to wait before hedging a fetch"`
+}
+
+type TilesetsConfig struct {
+	File         string `yaml:"file" json:"file" flag:"tileset-file" env:"ZALOA_TILESET_FILE" help:"YAML or JSON file of the tilesets to serve and the fetchers they use, instead of the Tilezen tilesets"`
+	ColorRampDir string `yaml:"color-ramp-dir" json:"color-ramp-dir" flag:"color-ramp-dir" env:"ZALOA_COLOR_RAMP_DIR" help:"Directory of color ramps (gdaldem color-relief text files or JSON) to serve with the color-relief tileset"`
+}
+
+type RenderConfig struct {
+	MaxConcurrent int `yaml:"max-concurrent" json:"max-concurrent" flag:"max-concurrent-renders" env:"ZALOA_MAX_CONCURRENT_RENDERS" help:"Tile requests that can be rendered at once, rather than served from the render cache. Unlimited when 0."`
+	QueueSize     int `yaml:"queue-size" json:"queue-size" flag:"render-queue-size" env:"ZALOA_RENDER_QUEUE_SIZE" help:"Tile requests that can wait to be rendered when max-concurrent-renders are already rendering. Requests beyond that get a 503."`
+}
+
+type RenderCacheConfig struct {
+	Type   string `yaml:"type" json:"type" flag:"render-cache" env:"ZALOA_RENDER_CACHE" help:"Where to cache rendered tiles. Use memory or disk, or leave empty to disable."`
+	SizeMB int    `yaml:"size-mb" json:"size-mb" flag:"render-cache-mb" env:"ZALOA_RENDER_CACHE_MB" help:"Size of the memory render cache in megabytes"`
+	Dir    string `yaml:"dir" json:"dir" flag:"render-cache-dir" env:"ZALOA_RENDER_CACHE_DIR" help:"Directory of the disk render cache"`
+}
+
+type StoreConfig struct {
+	Type        string `yaml:"type" json:"type" flag:"store" env:"ZALOA_STORE" help:"Where to write rendered tiles back to and look for them before rendering. Use s3 or dir, or leave empty to disable."`
+	S3Bucket    string `yaml:"s3-bucket" json:"s3-bucket" flag:"store-s3-bucket" env:"ZALOA_STORE_S3_BUCKET" help:"S3 bucket to write rendered tiles to when using the s3 store"`
+	S3Prefix    string `yaml:"s3-prefix" json:"s3-prefix" flag:"store-s3-prefix" env:"ZALOA_STORE_S3_PREFIX" help:"Key prefix for rendered tiles when using the s3 store"`
+	Dir         string `yaml:"dir" json:"dir" flag:"store-dir" env:"ZALOA_STORE_DIR" help:"Directory to write rendered tiles to when using the dir store"`
+	QueueSize   int    `yaml:"queue-size" json:"queue-size" flag:"store-queue-size" env:"ZALOA_STORE_QUEUE_SIZE" help:"Number of rendered tiles that can wait to be written to the store"`
+	Workers     int    `yaml:"workers" json:"workers" flag:"store-workers" env:"ZALOA_STORE_WORKERS" help:"Number of concurrent writes to the store"`
+	DeadLetters string `yaml:"dead-letters" json:"dead-letters" flag:"store-dead-letters" env:"ZALOA_STORE_DEAD_LETTERS" help:"File to append the keys of tiles that couldn't be written to the store to"`
+}
+
+type AuthConfig struct {
+	KeyFile       string `yaml:"key-file" json:"key-file" flag:"api-key-file" env:"ZALOA_API_KEY_FILE" help:"YAML, JSON or SQLite (.db, .sqlite) file of the API keys that tile, TileJSON and WMTS requests need. Keys aren't checked when empty."`
+	ReloadSeconds int    `yaml:"reload-seconds" json:"reload-seconds" flag:"api-key-reload-seconds" env:"ZALOA_API_KEY_RELOAD_SECONDS" help:"How often to reload the API key file, in seconds"`
+}
+
+type SigningConfig struct {
+	SecretsFile string `yaml:"secrets-file" json:"secrets-file" flag:"signing-secrets-file" env:"ZALOA_SIGNING_SECRETS_FILE" help:"YAML or JSON file of the secrets that tile URLs can be signed with. Tile requests with a signature are checked against them, and tile requests without one need an API key, or are refused if no API keys are configured."`
+}
+
+type CORSConfig struct {
+	AllowedOrigins string `yaml:"allowed-origins" json:"allowed-origins" flag:"cors-allowed-origins" env:"ZALOA_CORS_ALLOWED_ORIGINS" help:"Comma separated origins that browsers may request tiles from, like https://*.example.com, or * for any origin. CORS headers aren't sent when empty."`
+	AllowedMethods string `yaml:"allowed-methods" json:"allowed-methods" flag:"cors-allowed-methods" env:"ZALOA_CORS_ALLOWED_METHODS" help:"Comma separated methods allowed by preflight requests"`
+	AllowedHeaders string `yaml:"allowed-headers" json:"allowed-headers" flag:"cors-allowed-headers" env:"ZALOA_CORS_ALLOWED_HEADERS" help:"Comma separated request headers allowed by preflight requests"`
+	ExposedHeaders string `yaml:"exposed-headers" json:"exposed-headers" flag:"cors-exposed-headers" env:"ZALOA_CORS_EXPOSED_HEADERS" help:"Comma separated response headers that scripts may read"`
+	MaxAge         int    `yaml:"max-age" json:"max-age" flag:"cors-max-age" env:"ZALOA_CORS_MAX_AGE" help:"How long browsers may cache preflight responses, in seconds"`
+}
+
+type RefererConfig struct {
+	Allowlist string `yaml:"allowlist" json:"allowlist" flag:"referer-allowlist" env:"ZALOA_REFERER_ALLOWLIST" help:"Comma separated origins, like https://*.example.com, that pages using the tiles must be on. Requests with an Origin or Referer from anywhere else get a 403. Not checked when empty."`
+	Required  bool   `yaml:"required" json:"required" flag:"referer-required" env:"ZALOA_REFERER_REQUIRED" help:"Refuse requests without an Origin or Referer header when referer-allowlist is set"`
+}
+
+// Default returns the options used when they're not set anywhere.
+func Default() *Config {
+	return &Config{
+		Port: 8080,
+		Log: LogConfig{
+			Level:  "info",
+			Format: "json",
+		},
+		Tracing: TracingConfig{
+			SampleRatio: 0.1,
+		},
+		RenderCache: RenderCacheConfig{
+			SizeMB: 256,
+		},
+		Fetcher: FetcherConfig{
+			QueueSize:       1024,
+			HedgeBudget:     0.05,
+			HedgeMinDelayMS: 10,
+		},
+		Render: RenderConfig{
+			QueueSize: 64,
+		},
+		Store: StoreConfig{
+			QueueSize: 1000,
+			Workers:   4,
+		},
+		Auth: AuthConfig{
+			ReloadSeconds: 30,
+		},
+		CORS: CORSConfig{
+			AllowedMethods: "GET,HEAD",
+			AllowedHeaders: "X-Api-Key,If-None-Match",
+			ExposedHeaders: "ETag,Retry-After,X-Zaloa-Cache,X-Zaloa-Source,X-Quota-Limit,X-Quota-Remaining,X-Quota-Reset,X-RateLimit-Limit,X-RateLimit-Burst",
+			MaxAge:         3600,
+		},
+	}
+}
+
+// readFile reads the config file at path over c. The file is JSON if its name ends in .json and YAML otherwise.
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(c)
+	} else {
+		err = yaml.UnmarshalStrict(data, c)
+	}
+	if err != nil {
+		return fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Load reads the config file at path, if there is one, and applies the ZALOA_* environment variables over it.
+func Load(path string) (*Config, error) {
+	return load(path, nil)
+}
+
+// load reads the config file and the environment, then calls override, if it's set, before validating the result.
+func load(path string, override func(c *Config) error) (*Config, error) {
+	c := Default()
+	if path != "" {
+		if err := c.readFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	if override != nil {
+		if err := override(c); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Validate checks that the options make sense together. Options that are only needed by some commands, like the
+// fetch method, are checked when they're used.
+func (c *Config) Validate() error {
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("unknown log level %q", c.Log.Level)
+	}
+
+	switch c.Log.Format {
+	case "json", "text":
+	default:
+		return fmt.Errorf("unknown log format %q", c.Log.Format)
+	}
+
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return fmt.Errorf("trace sample ratio must be between 0 and 1")
+	}
+
+	switch c.Fetcher.Method {
+	case "":
+	case "http":
+		if c.Fetcher.HTTPPrefix == "" {
+			return fmt.Errorf("http-prefix must be set when using the http fetch method")
+		}
+	case "s3":
+		if c.Fetcher.S3Bucket == "" {
+			return fmt.Errorf("s3-bucket must be set when using the s3 fetch method")
+		}
+		if c.Fetcher.Region == "" {
+			return fmt.Errorf("region must be set when using the s3 fetch method")
+		}
+	default:
+		return fmt.Errorf("unknown fetch method %q", c.Fetcher.Method)
+	}
+
+	if _, err := service.ParseCacheMaxAge(c.CacheMaxAge); err != nil {
+		return fmt.Errorf("invalid cache-max-age: %w", err)
+	}
+
+	switch c.RenderCache.Type {
+	case "":
+	case "memory":
+		if c.RenderCache.SizeMB <= 0 {
+			return fmt.Errorf("render-cache-mb must be positive")
+		}
+	case "disk":
+		if c.RenderCache.Dir == "" {
+			return fmt.Errorf("render-cache-dir is required with the disk render cache")
+		}
+	default:
+		return fmt.Errorf("unknown render cache %q", c.RenderCache.Type)
+	}
+
+	switch c.Store.Type {
+	case "":
+	case "s3":
+		if c.Store.S3Bucket == "" {
+			return fmt.Errorf("store-s3-bucket must be set when using the s3 store")
+		}
+		if c.Fetcher.Region == "" {
+			return fmt.Errorf("region must be set when using the s3 store")
+		}
+	case "dir":
+		if c.Store.Dir == "" {
+			return fmt.Errorf("store-dir must be set when using the dir store")
+		}
+	default:
+		return fmt.Errorf("unknown store %q", c.Store.Type)
+	}
+
+	if c.Store.Type != "" && (c.Store.QueueSize <= 0 || c.Store.Workers <= 0) {
+		return fmt.Errorf("store-queue-size and store-workers must be positive")
+	}
+
+	if c.Fetcher.HedgePercentile < 0 || c.Fetcher.HedgePercentile >= 1 {
+		return fmt.Errorf("hedge-percentile must be at least 0 and less than 1")
+	}
+	if c.Fetcher.HedgeBudget < 0 || c.Fetcher.HedgeBudget > 1 {
+		return fmt.Errorf("hedge-budget must be between 0 and 1")
+	}
+	if c.Fetcher.HedgeMinDelayMS < 0 {
+		return fmt.Errorf("hedge-min-delay-ms must not be negative")
+	}
+
+	if c.Fetcher.MaxConcurrent < 0 || c.Fetcher.MaxConcurrentTotal < 0 || c.Fetcher.QueueSize < 0 {
+		return fmt.Errorf("max-concurrent-fetches, max-concurrent-fetches-total and fetch-queue-size must not be negative")
+	}
+	if c.Render.MaxConcurrent < 0 || c.Render.QueueSize < 0 {
+		return fmt.Errorf("max-concurrent-renders and render-queue-size must not be negative")
+	}
+
+	if c.Auth.KeyFile != "" && c.Auth.ReloadSeconds <= 0 {
+		return fmt.Errorf("api-key-reload-seconds must be positive")
+	}
+
+	if err := cors.ValidatePatterns(splitList(c.CORS.AllowedOrigins)); err != nil {
+		return fmt.Errorf("invalid cors-allowed-origins: %w", err)
+	}
+	if c.CORS.MaxAge < 0 {
+		return fmt.Errorf("cors-max-age must not be negative")
+	}
+	if err := cors.ValidatePatterns(splitList(c.Referer.Allowlist)); err != nil {
+		return fmt.Errorf("invalid referer-allowlist: %w", err)
+	}
+
+	return nil
+}
+
+// splitList splits a comma separated option, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
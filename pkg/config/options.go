@@ -0,0 +1,178 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+)
+
+// option is a single option of the Config, with the field it's stored in.
+type option struct {
+	// section is the yaml name of the top level field the option is in
+	section string
+	flag    string
+	env     string
+	help    string
+	field   reflect.Value
+}
+
+// options lists the options of c in the order they're declared.
+func (c *Config) options() []option {
+	var opts []option
+	var walk func(v reflect.Value, section string)
+	walk = func(v reflect.Value, section string) {
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			name := field.Tag.Get("yaml")
+			if section != "" {
+				name = section
+			}
+
+			if field.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), name)
+				continue
+			}
+
+			opts = append(opts, option{
+				section: name,
+				flag:    field.Tag.Get("flag"),
+				env:     field.Tag.Get("env"),
+				help:    field.Tag.Get("help"),
+				field:   v.Field(i),
+			})
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), "")
+	return opts
+}
+
+func (o option) set(s string) error {
+	switch o.field.Kind() {
+	case reflect.String:
+		o.field.SetString(s)
+	case reflect.Bool:
+		// A variable that's set without a value, like ZALOA_S3_REQUESTER_PAYS=, turns the option on
+		if s == "" {
+			o.field.SetBool(true)
+			return nil
+		}
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		o.field.SetBool(b)
+	case reflect.Int:
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		o.field.SetInt(int64(i))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		o.field.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported option type %s", o.field.Kind())
+	}
+	return nil
+}
+
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	for _, opt := range c.options() {
+		value, ok := lookup(opt.env)
+		if !ok {
+			continue
+		}
+		if err := opt.set(value); err != nil {
+			return fmt.Errorf("invalid %s: %w", opt.env, err)
+		}
+	}
+	return nil
+}
+
+// flagValue collects the value of a flag so that it can be applied after the config file and the environment.
+type flagValue struct {
+	defaultValue string
+	isBool       bool
+	value        *string
+}
+
+func (f *flagValue) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.defaultValue
+}
+
+func (f *flagValue) Set(s string) error {
+	f.value = &s
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// Flags are the command line flags of the Config.
+type Flags struct {
+	configPath *string
+	values     map[string]*flagValue
+}
+
+// RegisterFlags adds a -config flag to fs, and a flag for each option in the given sections of the Config, or for
+// every option if no sections are given. Sections are named like the top level fields in the config file.
+func RegisterFlags(fs *flag.FlagSet, sections ...string) *Flags {
+	f := &Flags{
+		configPath: fs.String("config", os.Getenv("ZALOA_CONFIG"), "YAML or JSON config file. Environment variables and flags override the options it sets."),
+		values:     map[string]*flagValue{},
+	}
+
+	for _, opt := range Default().options() {
+		if opt.flag == "" || !inSections(opt.section, sections) {
+			continue
+		}
+
+		value := &flagValue{isBool: opt.field.Kind() == reflect.Bool}
+		// Zero defaults are left empty so that the usage message doesn't show them
+		if !opt.field.IsZero() {
+			value.defaultValue = fmt.Sprint(opt.field.Interface())
+		}
+		f.values[opt.flag] = value
+		fs.Var(value, opt.flag, opt.help)
+	}
+
+	return f
+}
+
+func inSections(section string, sections []string) bool {
+	if len(sections) == 0 {
+		return true
+	}
+	for _, s := range sections {
+		if s == section {
+			return true
+		}
+	}
+	return false
+}
+
+// Load loads the config file given with -config, or ZALOA_CONFIG, and applies the environment and then the flags that
+// were set over it. It must be called after the flags are parsed.
+func (f *Flags) Load() (*Config, error) {
+	return load(*f.configPath, func(c *Config) error {
+		for _, opt := range c.options() {
+			value, ok := f.values[opt.flag]
+			if !ok || value.value == nil {
+				continue
+			}
+			if err := opt.set(*value.value); err != nil {
+				return fmt.Errorf("invalid -%s: %w", opt.flag, err)
+			}
+		}
+		return nil
+	})
+}
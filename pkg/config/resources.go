@@ -0,0 +1,66 @@
+package config
+
+import (
+	"sync"
+
+	"github.com/tilezen/go-zaloa/pkg/admission"
+	"github.com/tilezen/go-zaloa/pkg/cache"
+	"github.com/tilezen/go-zaloa/pkg/metrics"
+)
+
+type sizedCache struct {
+	sizeMB int
+	cache  cache.Cache
+}
+
+type sizedLimiter struct {
+	concurrency int
+	queueSize   int
+	limiter     *admission.Limiter
+}
+
+// Resources are the parts of a service that carry over configuration reloads as long as the options they're built from
+// don't change. Keeping the memory render cache means a reload doesn't empty it, and keeping the limiters means the
+// generation that's being retired and the new one share their limits rather than each letting through as many fetches
+// and renders. A nil Resources builds them anew every time.
+type Resources struct {
+	mu          sync.Mutex
+	memoryCache *sizedCache
+	limiters    map[string]*sizedLimiter
+}
+
+func NewResources() *Resources {
+	return &Resources{limiters: map[string]*sizedLimiter{}}
+}
+
+// limiter returns the limiter of pool, which is only set up again if its limits changed.
+func (r *Resources) limiter(pool string, concurrency int, queueSize int, recorder metrics.Recorder) *admission.Limiter {
+	if r == nil {
+		return admission.NewLimiter(pool, concurrency, queueSize, recorder)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if l, ok := r.limiters[pool]; ok && l.concurrency == concurrency && l.queueSize == queueSize {
+		return l.limiter
+	}
+	limiter := admission.NewLimiter(pool, concurrency, queueSize, recorder)
+	r.limiters[pool] = &sizedLimiter{concurrency: concurrency, queueSize: queueSize, limiter: limiter}
+	return limiter
+}
+
+// newMemoryCache returns the memory render cache, which is only set up again if its size changed.
+func (r *Resources) newMemoryCache(sizeMB int) cache.Cache {
+	if r == nil {
+		return cache.NewMemoryCache(int64(sizeMB) << 20)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.memoryCache == nil || r.memoryCache.sizeMB != sizeMB {
+		r.memoryCache = &sizedCache{sizeMB: sizeMB, cache: cache.NewMemoryCache(int64(sizeMB) << 20)}
+	}
+	return r.memoryCache.cache
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestResourcesCarryOver(t *testing.T) {
+	tests := []struct {
+		name   string
+		before [2]int
+		after  [2]int
+		same   bool
+	}{
+		{name: "unchanged", before: [2]int{4, 64}, after: [2]int{4, 64}, same: true},
+		{name: "concurrency changed", before: [2]int{4, 64}, after: [2]int{8, 64}},
+		{name: "queue size changed", before: [2]int{4, 64}, after: [2]int{4, 16}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resources := NewResources()
+			before := resources.limiter("render", tt.before[0], tt.before[1], nil)
+			after := resources.limiter("render", tt.after[0], tt.after[1], nil)
+			if (before == after) != tt.same {
+				t.Errorf("expected the limiter to be kept: %v", tt.same)
+			}
+		})
+	}
+
+	resources := NewResources()
+	if resources.newMemoryCache(256) != resources.newMemoryCache(256) {
+		t.Errorf("expected the memory cache to be kept")
+	}
+	if resources.newMemoryCache(256) == resources.newMemoryCache(512) {
+		t.Errorf("expected a new memory cache for a new size")
+	}
+
+	var none *Resources
+	if none.limiter("render", 1, 1, nil) == none.limiter("render", 1, 1, nil) {
+		t.Errorf("expected a nil Resources to set up a new limiter every time")
+	}
+}
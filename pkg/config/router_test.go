@@ -0,0 +1,93 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tilezen/go-zaloa/pkg/common"
+	"github.com/tilezen/go-zaloa/pkg/fetcher"
+	"github.com/tilezen/go-zaloa/pkg/service"
+	"github.com/tilezen/go-zaloa/pkg/signing"
+)
+
+type stubFetcher struct {
+	data []byte
+}
+
+func (s stubFetcher) GetTile(_ context.Context, t common.Tile, _ common.TileKind, _ common.TileVersion) (*fetcher.FetchResponse, error) {
+	return &fetcher.FetchResponse{Data: s.data, Tile: t}, nil
+}
+
+func TestRouterSignedWMTSTiles(t *testing.T) {
+	dir := t.TempDir()
+	secretsFile := filepath.Join(dir, "secrets.yaml")
+	if err := os.WriteFile(secretsFile, []byte("secrets:\n  - id: a\n    secret: s3cr3t\n"), 0o644); err != nil {
+		t.Fatalf("error writing secrets: %v", err)
+	}
+
+	cfg := Default()
+	cfg.Signing.SecretsFile = secretsFile
+	tileAuth, err := cfg.NewTileAuth(slog.New(slog.NewTextHandler(io.Discard, nil)), nil, nil)
+	if err != nil {
+		t.Fatalf("error setting up tile auth: %v", err)
+	}
+
+	b := &bytes.Buffer{}
+	if err := png.Encode(b, image.NewRGBA(image.Rect(0, 0, 256, 256))); err != nil {
+		t.Fatalf("error encoding tile: %v", err)
+	}
+	router := cfg.NewRouter(service.NewZaloaService(stubFetcher{data: b.Bytes()}), nil, tileAuth)
+
+	signer, err := cfg.NewSigner()
+	if err != nil {
+		t.Fatalf("error setting up signer: %v", err)
+	}
+	maxZoom := uint(3)
+	signed := func(scope string) string {
+		query, err := signer.Sign("", signing.Claims{Scope: scope, Expires: time.Now().Add(time.Hour), MaxZoom: &maxZoom})
+		if err != nil {
+			t.Fatalf("error signing: %v", err)
+		}
+		return query.Encode()
+	}
+	tileQuery := signed("/tilezen/terrain/v1/256/terrarium/")
+	otherQuery := signed("/tilezen/terrain/v1/256/normal/")
+
+	kvp := "/wmts?SERVICE=WMTS&REQUEST=GetTile&LAYER=terrarium-v1&STYLE=default&TILEMATRIXSET=GoogleMapsCompatible&FORMAT=image/png"
+	tests := []struct {
+		name   string
+		url    string
+		status int
+	}{
+		{name: "unsigned kvp", url: kvp + "&TILEMATRIX=1&TILEROW=0&TILECOL=0", status: http.StatusUnauthorized},
+		{name: "signed kvp", url: kvp + "&TILEMATRIX=1&TILEROW=0&TILECOL=0&" + tileQuery, status: http.StatusOK},
+		{name: "kvp above the signed zooms", url: kvp + "&TILEMATRIX=4&TILEROW=0&TILECOL=0&" + tileQuery, status: http.StatusForbidden},
+		{name: "kvp signed for another tileset", url: kvp + "&TILEMATRIX=1&TILEROW=0&TILECOL=0&" + otherQuery, status: http.StatusForbidden},
+		{name: "unsigned rest", url: "/wmts/1.0.0/terrarium-v1/default/GoogleMapsCompatible/1/0/0.png", status: http.StatusUnauthorized},
+		{name: "signed rest", url: "/wmts/1.0.0/terrarium-v1/default/GoogleMapsCompatible/1/0/0.png?" + tileQuery, status: http.StatusOK},
+		{name: "rest above the signed zooms", url: "/wmts/1.0.0/terrarium-v1/default/GoogleMapsCompatible/4/0/0.png?" + tileQuery, status: http.StatusForbidden},
+		{name: "capabilities", url: "/wmts?SERVICE=WMTS&REQUEST=GetCapabilities", status: http.StatusOK},
+		{name: "unsigned tile", url: "/tilezen/terrain/v1/256/terrarium/1/0/0.png", status: http.StatusUnauthorized},
+		{name: "signed tile", url: "/tilezen/terrain/v1/256/terrarium/1/0/0.png?" + tileQuery, status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if recorder.Code != tt.status {
+				t.Errorf("expected status %d, got %d: %s", tt.status, recorder.Code, recorder.Body.String())
+			}
+		})
+	}
+}
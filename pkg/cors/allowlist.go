@@ -0,0 +1,42 @@
+package cors
+
+import (
+	"net/http"
+)
+
+type allowlist struct {
+	origins       []string
+	requireOrigin bool
+}
+
+// NewAllowlist returns middleware that refuses requests from pages on other sites, to stop them hotlinking the tiles.
+// The site is taken from the Origin header, or the Referer header if there's no Origin, and must match one of the
+// origin patterns. Requests without either header, like the ones from non-browser clients, are only let through if
+// requireOrigin is false.
+func NewAllowlist(origins []string, requireOrigin bool) func(http.Handler) http.Handler {
+	a := &allowlist{
+		origins:       origins,
+		requireOrigin: requireOrigin,
+	}
+	return a.wrap
+}
+
+func (a *allowlist) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		origin := request.Header.Get("Origin")
+		if origin == "" {
+			origin = originOf(request.Header.Get("Referer"))
+		}
+
+		switch {
+		case origin == "" && a.requireOrigin:
+			writer.WriteHeader(http.StatusForbidden)
+			_, _ = writer.Write([]byte("Missing Origin or Referer"))
+		case origin != "" && !matchesAny(a.origins, origin):
+			writer.WriteHeader(http.StatusForbidden)
+			_, _ = writer.Write([]byte("Origin not allowed"))
+		default:
+			next.ServeHTTP(writer, request)
+		}
+	})
+}
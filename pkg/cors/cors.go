@@ -0,0 +1,142 @@
+package cors
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ValidatePatterns checks that the origin patterns can be matched against.
+func ValidatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, host, ok := strings.Cut(pattern, "://"); ok {
+			pattern = host
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid origin pattern %s: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matches reports whether origin, like https://maps.example.com, matches pattern. Patterns without a scheme match any
+// scheme, and * matches any part of the host and port, so https://*.example.com matches the subdomains of example.com
+// over https and localhost:* matches localhost on any port.
+func matches(pattern string, origin string) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	scheme, host, ok := strings.Cut(origin, "://")
+	if !ok {
+		return false
+	}
+	if patternScheme, patternHost, ok := strings.Cut(pattern, "://"); ok {
+		if !strings.EqualFold(patternScheme, scheme) {
+			return false
+		}
+		pattern = patternHost
+	}
+
+	matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(host))
+	return matched
+}
+
+func matchesAny(patterns []string, origin string) bool {
+	for _, pattern := range patterns {
+		if matches(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// originOf returns the origin of a Referer URL.
+func originOf(referer string) string {
+	u, err := url.Parse(referer)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// Options configures the CORS headers.
+type Options struct {
+	// AllowedOrigins are patterns of the origins that browsers may make requests from
+	AllowedOrigins []string
+	// AllowedMethods and AllowedHeaders are what preflight requests are allowed
+	AllowedMethods []string
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers scripts may read, on top of the safelisted ones
+	ExposedHeaders []string
+	// MaxAge is how long browsers may cache the response to a preflight request
+	MaxAge time.Duration
+}
+
+type middleware struct {
+	origins        []string
+	anyOrigin      bool
+	methods        string
+	headers        string
+	exposedHeaders string
+	maxAge         string
+}
+
+// NewMiddleware returns middleware that adds CORS headers to the responses to requests from allowed origins, and
+// answers preflight requests itself.
+func NewMiddleware(opts Options) func(http.Handler) http.Handler {
+	m := &middleware{
+		origins:        opts.AllowedOrigins,
+		methods:        strings.Join(opts.AllowedMethods, ", "),
+		headers:        strings.Join(opts.AllowedHeaders, ", "),
+		exposedHeaders: strings.Join(opts.ExposedHeaders, ", "),
+		maxAge:         strconv.Itoa(int(opts.MaxAge.Seconds())),
+	}
+	for _, origin := range opts.AllowedOrigins {
+		m.anyOrigin = m.anyOrigin || origin == "*"
+	}
+	return m.wrap
+}
+
+func (m *middleware) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		origin := request.Header.Get("Origin")
+		preflight := request.Method == http.MethodOptions && request.Header.Get("Access-Control-Request-Method") != ""
+
+		// Responses depend on the origin unless every origin gets the same headers
+		if !m.anyOrigin {
+			writer.Header().Add("Vary", "Origin")
+		}
+
+		allowed := origin != "" && matchesAny(m.origins, origin)
+		if allowed {
+			if m.anyOrigin {
+				writer.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				writer.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+		}
+
+		if !preflight {
+			if allowed && m.exposedHeaders != "" {
+				writer.Header().Set("Access-Control-Expose-Headers", m.exposedHeaders)
+			}
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		// Preflight requests from other origins get no CORS headers, which the browser takes as a refusal
+		if allowed {
+			writer.Header().Set("Access-Control-Allow-Methods", m.methods)
+			if m.headers != "" {
+				writer.Header().Set("Access-Control-Allow-Headers", m.headers)
+			}
+			writer.Header().Set("Access-Control-Max-Age", m.maxAge)
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,142 @@
+package coverage
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/tilezen/go-zaloa/pkg/common"
+)
+
+const (
+	// maxLatitude is the latitude at which web mercator tiles end
+	maxLatitude = 85.0511287798066
+)
+
+// Area is a region of the world to enumerate tiles over.
+type Area interface {
+	// Bounds returns the bounding box of the area.
+	Bounds() BBox
+	// IntersectsTile reports whether any part of the area falls in t.
+	IntersectsTile(t common.Tile) bool
+}
+
+// BBox is a longitude/latitude bounding box.
+type BBox struct {
+	West, South, East, North float64
+}
+
+// ParseBBox parses a "west,south,east,north" bounding box.
+func ParseBBox(s string) (BBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return BBox{}, fmt.Errorf("expected west,south,east,north, got %s", s)
+	}
+
+	values := make([]float64, 4)
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return BBox{}, fmt.Errorf("error parsing bbox: %w", err)
+		}
+		values[i] = v
+	}
+
+	b := BBox{West: values[0], South: values[1], East: values[2], North: values[3]}
+	if b.West >= b.East || b.South >= b.North {
+		return BBox{}, fmt.Errorf("bbox %s is empty", s)
+	}
+	if b.West < -180 || b.East > 180 || b.South < -90 || b.North > 90 {
+		return BBox{}, fmt.Errorf("bbox %s is out of range", s)
+	}
+
+	return b, nil
+}
+
+func (b BBox) String() string {
+	return fmt.Sprintf("%g,%g,%g,%g", b.West, b.South, b.East, b.North)
+}
+
+func (b BBox) Bounds() BBox {
+	return b
+}
+
+func (b BBox) IntersectsTile(t common.Tile) bool {
+	tb := TileBounds(t)
+	return b.West < tb.East && b.East > tb.West && b.South < tb.North && b.North > tb.South
+}
+
+// TileBounds returns the bounding box of t.
+func TileBounds(t common.Tile) BBox {
+	n := math.Exp2(float64(t.Z))
+	lon := func(x float64) float64 { return x/n*360 - 180 }
+	lat := func(y float64) float64 { return math.Atan(math.Sinh(math.Pi*(1-2*y/n))) * 180 / math.Pi }
+
+	return BBox{
+		West:  lon(float64(t.X)),
+		South: lat(float64(t.Y + 1)),
+		East:  lon(float64(t.X + 1)),
+		North: lat(float64(t.Y)),
+	}
+}
+
+// tileAt returns the x and y of the tile at zoom z that contains the point.
+func tileAt(lon float64, lat float64, z uint) (uint, uint) {
+	n := math.Exp2(float64(z))
+	lat = math.Max(-maxLatitude, math.Min(maxLatitude, lat)) * math.Pi / 180
+
+	x := math.Floor((lon + 180) / 360 * n)
+	y := math.Floor((1 - math.Log(math.Tan(lat)+1/math.Cos(lat))/math.Pi) / 2 * n)
+
+	clamp := func(v float64) uint { return uint(math.Max(0, math.Min(n-1, v))) }
+	return clamp(x), clamp(y)
+}
+
+// tileRange returns the range of tiles at zoom z covering the bounds of area.
+func tileRange(area Area, z uint) (minX, minY, maxX, maxY uint) {
+	b := area.Bounds()
+	minX, minY = tileAt(b.West, b.North, z)
+	maxX, maxY = tileAt(b.East, b.South, z)
+
+	// A bbox ending exactly on a tile edge doesn't reach into the next tile
+	if edge := TileBounds(common.Tile{Z: z, X: maxX, Y: maxY}); maxX > minX && edge.West == b.East {
+		maxX--
+	}
+	if edge := TileBounds(common.Tile{Z: z, X: maxX, Y: maxY}); maxY > minY && edge.North == b.South {
+		maxY--
+	}
+
+	return minX, minY, maxX, maxY
+}
+
+// ForEachTile calls fn for every tile between minZoom and maxZoom that intersects area, by zoom, then row, then
+// column. It stops at the first error returned by fn.
+func ForEachTile(area Area, minZoom uint, maxZoom uint, fn func(common.Tile) error) error {
+	for z := minZoom; z <= maxZoom; z++ {
+		minX, minY, maxX, maxY := tileRange(area, z)
+		for y := minY; y <= maxY; y++ {
+			for x := minX; x <= maxX; x++ {
+				t := common.Tile{Z: z, X: x, Y: y}
+				if !area.IntersectsTile(t) {
+					continue
+				}
+				if err := fn(t); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// CountTiles returns the number of tiles ForEachTile visits.
+func CountTiles(area Area, minZoom uint, maxZoom uint) int {
+	count := 0
+	_ = ForEachTile(area, minZoom, maxZoom, func(common.Tile) error {
+		count++
+		return nil
+	})
+	return count
+}
@@ -0,0 +1,164 @@
+package coverage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/tilezen/go-zaloa/pkg/common"
+)
+
+// point is a longitude/latitude pair.
+type point [2]float64
+
+// Polygon is a multipolygon, as a list of polygons made of an outer ring followed by any holes.
+type Polygon struct {
+	polygons [][][]point
+	bounds   BBox
+}
+
+type geoJSON struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Geometry    *geoJSON        `json:"geometry"`
+	Features    []geoJSON       `json:"features"`
+}
+
+// ReadGeoJSON reads the Polygon and MultiPolygon geometries of a GeoJSON geometry, Feature or FeatureCollection into a
+// single Polygon.
+func ReadGeoJSON(r io.Reader) (*Polygon, error) {
+	var doc geoJSON
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("error decoding GeoJSON: %w", err)
+	}
+
+	p := &Polygon{}
+	if err := p.add(doc); err != nil {
+		return nil, err
+	}
+
+	if len(p.polygons) == 0 {
+		return nil, fmt.Errorf("no polygons in GeoJSON")
+	}
+
+	p.bounds = BBox{West: math.Inf(1), South: math.Inf(1), East: math.Inf(-1), North: math.Inf(-1)}
+	for _, polygon := range p.polygons {
+		for _, pt := range polygon[0] {
+			p.bounds.West = math.Min(p.bounds.West, pt[0])
+			p.bounds.South = math.Min(p.bounds.South, pt[1])
+			p.bounds.East = math.Max(p.bounds.East, pt[0])
+			p.bounds.North = math.Max(p.bounds.North, pt[1])
+		}
+	}
+
+	return p, nil
+}
+
+func (p *Polygon) add(doc geoJSON) error {
+	switch doc.Type {
+	case "FeatureCollection":
+		for _, feature := range doc.Features {
+			if err := p.add(feature); err != nil {
+				return err
+			}
+		}
+	case "Feature":
+		if doc.Geometry != nil {
+			return p.add(*doc.Geometry)
+		}
+	case "Polygon":
+		var polygon [][]point
+		if err := json.Unmarshal(doc.Coordinates, &polygon); err != nil {
+			return fmt.Errorf("error decoding Polygon: %w", err)
+		}
+		return p.addPolygon(polygon)
+	case "MultiPolygon":
+		var polygons [][][]point
+		if err := json.Unmarshal(doc.Coordinates, &polygons); err != nil {
+			return fmt.Errorf("error decoding MultiPolygon: %w", err)
+		}
+		for _, polygon := range polygons {
+			if err := p.addPolygon(polygon); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported GeoJSON type %s", doc.Type)
+	}
+
+	return nil
+}
+
+func (p *Polygon) addPolygon(polygon [][]point) error {
+	if len(polygon) == 0 || len(polygon[0]) < 4 {
+		return fmt.Errorf("polygon has no outer ring")
+	}
+	p.polygons = append(p.polygons, polygon)
+	return nil
+}
+
+func (p *Polygon) Bounds() BBox {
+	return p.bounds
+}
+
+func (p *Polygon) IntersectsTile(t common.Tile) bool {
+	tb := TileBounds(t)
+	if !p.bounds.IntersectsTile(t) {
+		return false
+	}
+
+	corners := []point{{tb.West, tb.North}, {tb.East, tb.North}, {tb.East, tb.South}, {tb.West, tb.South}}
+
+	for _, polygon := range p.polygons {
+		// The tile is inside the polygon
+		if p.containsPoint(polygon, point{(tb.West + tb.East) / 2, (tb.South + tb.North) / 2}) {
+			return true
+		}
+
+		for _, ring := range polygon {
+			for i := 0; i < len(ring)-1; i++ {
+				a, b := ring[i], ring[i+1]
+				// The polygon is inside the tile
+				if a[0] >= tb.West && a[0] <= tb.East && a[1] >= tb.South && a[1] <= tb.North {
+					return true
+				}
+				// The polygon's edge crosses the tile
+				for j := range corners {
+					if segmentsIntersect(a, b, corners[j], corners[(j+1)%len(corners)]) {
+						return true
+					}
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// containsPoint tests pt against the rings of polygon with the even-odd rule, so holes are excluded.
+func (p *Polygon) containsPoint(polygon [][]point, pt point) bool {
+	inside := false
+	for _, ring := range polygon {
+		for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+			a, b := ring[i], ring[j]
+			if (a[1] > pt[1]) != (b[1] > pt[1]) && pt[0] < (b[0]-a[0])*(pt[1]-a[1])/(b[1]-a[1])+a[0] {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+func segmentsIntersect(p1, p2, p3, p4 point) bool {
+	cross := func(a, b, c point) float64 {
+		return (b[0]-a[0])*(c[1]-a[1]) - (b[1]-a[1])*(c[0]-a[0])
+	}
+
+	d1 := cross(p3, p4, p1)
+	d2 := cross(p3, p4, p2)
+	d3 := cross(p1, p2, p3)
+	d4 := cross(p1, p2, p4)
+
+	return ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0))
+}
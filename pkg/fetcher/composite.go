@@ -0,0 +1,69 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/tilezen/go-zaloa/pkg/common"
+	"github.com/tilezen/go-zaloa/pkg/coverage"
+)
+
+// CompositeSource is one of the sources of a composite fetcher.
+type CompositeSource struct {
+	Name    string
+	Fetcher TileFetcher
+	// Area limits the source to the tiles that intersect it. The source covers the whole world if it's nil.
+	Area    coverage.Area
+	MinZoom uint
+	MaxZoom uint
+	// Nodata is the elevation the source uses for missing data, which a mosaic fetcher treats as transparent
+	Nodata *float64
+}
+
+func (s CompositeSource) covers(t common.Tile) bool {
+	if t.Z < s.MinZoom || t.Z > s.MaxZoom {
+		return false
+	}
+	return s.Area == nil || s.Area.IntersectsTile(t)
+}
+
+type compositeFetcher struct {
+	sources []CompositeSource
+}
+
+func (c compositeFetcher) GetTile(ctx context.Context, t common.Tile, kind common.TileKind, version common.TileVersion) (*FetchResponse, error) {
+	for _, source := range c.sources {
+		if !source.covers(t) {
+			continue
+		}
+
+		resp, err := source.Fetcher.GetTile(ctx, t, kind, version)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error fetching from source %s: %w", source.Name, err)
+		}
+
+		resp.Source = source.Name
+		return resp, nil
+	}
+
+	return nil, fmt.Errorf("no source has Tile %s: %w", t, ErrNotFound)
+}
+
+// Locate returns the location of the tile in the first source that covers it, which is where it's looked for first.
+func (c compositeFetcher) Locate(t common.Tile, kind common.TileKind, version common.TileVersion) string {
+	for _, source := range c.sources {
+		if !source.covers(t) {
+			continue
+		}
+
+		if locator, ok := source.Fetcher.(Locator); ok {
+			return source.Name + ": " + locator.Locate(t, kind, version)
+		}
+		return source.Name
+	}
+	return ""
+}
@@ -2,23 +2,39 @@ package fetcher
 
 import (
 	"context"
+	"errors"
 	"image"
+	"log/slog"
 	"net/http"
 
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 
 	"github.com/tilezen/go-zaloa/pkg/common"
+	"github.com/tilezen/go-zaloa/pkg/logging"
+	"github.com/tilezen/go-zaloa/pkg/metrics"
 )
 
+// ErrNotFound is returned, wrapped, by fetchers when the source tile doesn't exist upstream.
+var ErrNotFound = errors.New("tile not found")
+
 type ImageInput struct {
 	Image image.Image
+	Tile  common.Tile
 	Spec  ImageSpec
 }
 
 type FetchResponse struct {
 	Data []byte
-	Tile common.Tile
-	Spec ImageSpec
+	// ETag is the entity tag the upstream returned for the tile, if any.
+	ETag string
+	// Source names the source a composite fetcher fetched the tile from.
+	Source string
+	// Layers are the tiles of every source of a mosaic fetcher, in priority order. Data holds the first one found.
+	Layers []MosaicLayer
+	// Feather is the width in pixels over which the layers are blended into each other
+	Feather int
+	Tile    common.Tile
+	Spec    ImageSpec
 }
 
 type ImageSpec struct {
@@ -30,17 +46,46 @@ type TileFetcher interface {
 	GetTile(ctx context.Context, t common.Tile, kind common.TileKind, version common.TileVersion) (*FetchResponse, error)
 }
 
-func NewHTTPTileFetcher(baseURL string) TileFetcher {
+// Locator is implemented by fetchers that can tell where a source tile is fetched from, like its URL or S3 key.
+type Locator interface {
+	Locate(t common.Tile, kind common.TileKind, version common.TileVersion) string
+}
+
+func NewHTTPTileFetcher(baseURL string, logger *slog.Logger) TileFetcher {
 	return &httpFetcher{
 		baseURL: baseURL,
 		client:  http.DefaultClient,
+		logger:  logging.WithContext(logger),
 	}
 }
 
-func NewS3TileFetcher(s3 s3iface.S3API, bucket string, requesterPays bool) TileFetcher {
+func NewS3TileFetcher(s3 s3iface.S3API, bucket string, requesterPays bool, logger *slog.Logger) TileFetcher {
 	return &s3tileFetcher{
 		s3Bucket:      bucket,
 		requesterPays: requesterPays,
 		s3:            s3,
+		logger:        logging.WithContext(logger),
+	}
+}
+
+// NewCompositeTileFetcher creates a fetcher that tries sources in order, skipping those that don't cover the tile and
+// moving on to the next when a source doesn't have it.
+func NewCompositeTileFetcher(sources []CompositeSource) TileFetcher {
+	return &compositeFetcher{sources: sources}
+}
+
+// NewMosaicTileFetcher creates a fetcher that fetches the tile from every source that covers it, so that they can be
+// merged pixel by pixel. Layers are blended over feather pixels, or not at all if it's 0.
+func NewMosaicTileFetcher(sources []CompositeSource, feather int) TileFetcher {
+	return &mosaicFetcher{sources: sources, feather: feather}
+}
+
+// NewInstrumentedTileFetcher wraps fetcher so that the latency and errors of every fetch are reported to recorder
+// under the given fetcher type.
+func NewInstrumentedTileFetcher(fetcher TileFetcher, fetcherType string, recorder metrics.Recorder) TileFetcher {
+	return &instrumentedFetcher{
+		fetcher:     fetcher,
+		fetcherType: fetcherType,
+		recorder:    recorder,
 	}
 }
@@ -0,0 +1,188 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tilezen/go-zaloa/pkg/common"
+	"github.com/tilezen/go-zaloa/pkg/metrics"
+)
+
+const (
+	// hedgeWindow is the number of recent fetch latencies the hedge delay is worked out from
+	hedgeWindow = 1000
+	// hedgeMinSamples is the number of latencies needed before fetches are hedged
+	hedgeMinSamples = 20
+	// hedgeRecompute is the number of new latencies after which the hedge delay is worked out again
+	hedgeRecompute = 50
+	// hedgeMaxTokens is the number of hedges that can be saved up from the budget, and so be made in a burst
+	hedgeMaxTokens = 10
+)
+
+// HedgeOptions configures a hedged fetcher.
+type HedgeOptions struct {
+	// Percentile of the recent fetch latencies, between 0 and 1, after which a fetch is hedged
+	Percentile float64
+	// MinDelay is the shortest time a fetch waits before it's hedged
+	MinDelay time.Duration
+	// Budget is the fraction of fetches that can be hedged
+	Budget float64
+}
+
+type hedgedFetcher struct {
+	fetcher  TileFetcher
+	name     string
+	opts     HedgeOptions
+	recorder metrics.Recorder
+
+	mu sync.Mutex
+	// latencies is a ring buffer of the recent fetch latencies
+	latencies   []time.Duration
+	next        int
+	sinceUpdate int
+	// delay is how long fetches wait before they're hedged, or 0 if there aren't enough latencies yet
+	delay time.Duration
+	// tokens are the hedges the budget allows
+	tokens float64
+}
+
+// NewHedgedTileFetcher sends a second request for a tile if f hasn't returned it after the given percentile of its
+// recent latencies, and takes whichever returns first, cancelling the other. The hedges are reported to recorder
+// under name.
+func NewHedgedTileFetcher(f TileFetcher, name string, opts HedgeOptions, recorder metrics.Recorder) TileFetcher {
+	return &hedgedFetcher{
+		fetcher:  f,
+		name:     name,
+		opts:     opts,
+		recorder: recorder,
+	}
+}
+
+// hedgeDelay returns how long a fetch should wait before it's hedged, or 0 if it shouldn't be, and adds the fetch's
+// share of the budget.
+func (h *hedgedFetcher) hedgeDelay() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.tokens = math.Min(h.tokens+h.opts.Budget, hedgeMaxTokens)
+	return h.delay
+}
+
+// spend takes a hedge from the budget, if there's one left.
+func (h *hedgedFetcher) spend() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.tokens < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+func (h *hedgedFetcher) observe(latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.latencies) < hedgeWindow {
+		h.latencies = append(h.latencies, latency)
+	} else {
+		h.latencies[h.next] = latency
+		h.next = (h.next + 1) % hedgeWindow
+	}
+
+	h.sinceUpdate++
+	if len(h.latencies) < hedgeMinSamples || (h.delay != 0 && h.sinceUpdate < hedgeRecompute) {
+		return
+	}
+	h.sinceUpdate = 0
+
+	sorted := append([]time.Duration(nil), h.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	h.delay = sorted[int(h.opts.Percentile*float64(len(sorted)-1))]
+	if h.delay < h.opts.MinDelay {
+		h.delay = h.opts.MinDelay
+	}
+	// A delay of 0 means there aren't enough latencies yet
+	if h.delay <= 0 {
+		h.delay = time.Nanosecond
+	}
+}
+
+type hedgeResult struct {
+	resp  *FetchResponse
+	err   error
+	hedge bool
+}
+
+func (h *hedgedFetcher) GetTile(ctx context.Context, t common.Tile, kind common.TileKind, version common.TileVersion) (*FetchResponse, error) {
+	delay := h.hedgeDelay()
+
+	// Returning cancels the request that lost
+	attemptCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan hedgeResult, 2)
+	go func() {
+		start := time.Now()
+		resp, err := h.fetcher.GetTile(attemptCtx, t, kind, version)
+		// The first request is timed even if it loses, when it's cancelled, so that slow fetches aren't left out of
+		// the latencies
+		if ctx.Err() == nil {
+			h.observe(time.Since(start))
+		}
+		results <- hedgeResult{resp: resp, err: err}
+	}()
+
+	if delay == 0 {
+		r := <-results
+		return r.resp, r.err
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case r := <-results:
+		return r.resp, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+	}
+
+	if !h.spend() {
+		h.recorder.ObserveHedge(h.name, "budget_exhausted")
+		r := <-results
+		return r.resp, r.err
+	}
+
+	h.recorder.ObserveHedge(h.name, "hedged")
+	go func() {
+		resp, err := h.fetcher.GetTile(attemptCtx, t, kind, version)
+		results <- hedgeResult{resp: resp, err: err, hedge: true}
+	}()
+
+	r := <-results
+	// A tile that's missing is missing from both, but the other request may get past a failure
+	if r.err != nil && !errors.Is(r.err, ErrNotFound) {
+		if other := <-results; other.err == nil {
+			r = other
+		}
+	}
+
+	if r.hedge && r.err == nil {
+		h.recorder.ObserveHedge(h.name, "won")
+	}
+	return r.resp, r.err
+}
+
+func (h *hedgedFetcher) Locate(t common.Tile, kind common.TileKind, version common.TileVersion) string {
+	if locator, ok := h.fetcher.(Locator); ok {
+		return locator.Locate(t, kind, version)
+	}
+	return ""
+}
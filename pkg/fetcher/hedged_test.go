@@ -0,0 +1,264 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tilezen/go-zaloa/pkg/common"
+	"github.com/tilezen/go-zaloa/pkg/metrics"
+)
+
+type hedgeRecorder struct {
+	metrics.Recorder
+	mu       sync.Mutex
+	outcomes []string
+}
+
+func (r *hedgeRecorder) ObserveHedge(_ string, outcome string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outcomes = append(r.outcomes, outcome)
+}
+
+// attemptFetcher answers each attempt at a tile in turn with the given responses. Attempts that hang, or that there's
+// no response for, block until they're cancelled.
+type attemptFetcher struct {
+	attempts  atomic.Int32
+	cancelled atomic.Int32
+	responses []attemptResponse
+}
+
+type attemptResponse struct {
+	after time.Duration
+	err   error
+	hang  bool
+}
+
+func (f *attemptFetcher) GetTile(ctx context.Context, t common.Tile, _ common.TileKind, _ common.TileVersion) (*FetchResponse, error) {
+	i := int(f.attempts.Add(1)) - 1
+	if i >= len(f.responses) || f.responses[i].hang {
+		<-ctx.Done()
+		f.cancelled.Add(1)
+		return nil, ctx.Err()
+	}
+
+	r := f.responses[i]
+	select {
+	case <-time.After(r.after):
+	case <-ctx.Done():
+		f.cancelled.Add(1)
+		return nil, ctx.Err()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &FetchResponse{Tile: t, Data: []byte{byte(i)}}, nil
+}
+
+func TestHedgeDelay(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name      string
+		opts      HedgeOptions
+		latencies []time.Duration
+		wantDelay time.Duration
+	}{
+		{
+			name:      "too few latencies",
+			opts:      HedgeOptions{Percentile: 0.9},
+			latencies: repeat(10*ms, hedgeMinSamples-1),
+			wantDelay: 0,
+		},
+		{
+			name:      "percentile",
+			opts:      HedgeOptions{Percentile: 0.9},
+			latencies: spread(1, 21, ms),
+			wantDelay: 18 * ms,
+		},
+		{
+			name:      "min delay",
+			opts:      HedgeOptions{Percentile: 0.9, MinDelay: 50 * ms},
+			latencies: spread(1, 21, ms),
+			wantDelay: 50 * ms,
+		},
+		{
+			name:      "never 0 once there are enough latencies",
+			opts:      HedgeOptions{Percentile: 0.5},
+			latencies: repeat(0, hedgeMinSamples),
+			wantDelay: time.Nanosecond,
+		},
+		{
+			// The delay is worked out from the first 20 latencies and kept until 50 more have come in
+			name:      "not recomputed on every fetch",
+			opts:      HedgeOptions{Percentile: 0.5},
+			latencies: append(repeat(10*ms, hedgeMinSamples), repeat(100*ms, hedgeRecompute-1)...),
+			wantDelay: 10 * ms,
+		},
+		{
+			name:      "recomputed",
+			opts:      HedgeOptions{Percentile: 0.5},
+			latencies: append(repeat(10*ms, hedgeMinSamples), repeat(100*ms, hedgeRecompute)...),
+			wantDelay: 100 * ms,
+		},
+		{
+			// Only the latest latencies count once the window is full
+			name:      "window",
+			opts:      HedgeOptions{Percentile: 1},
+			latencies: append(repeat(100*ms, hedgeWindow), repeat(5*ms, hedgeWindow+hedgeRecompute)...),
+			wantDelay: 5 * ms,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHedgedTileFetcher(nil, "test", tt.opts, metrics.NewNopRecorder()).(*hedgedFetcher)
+			for _, latency := range tt.latencies {
+				h.observe(latency)
+			}
+			if delay := h.hedgeDelay(); delay != tt.wantDelay {
+				t.Errorf("expected a delay of %s, got %s", tt.wantDelay, delay)
+			}
+		})
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	tests := []struct {
+		name       string
+		budget     float64
+		fetches    int
+		wantHedges int
+	}{
+		{name: "no budget", budget: 0, fetches: 100, wantHedges: 0},
+		{name: "one in four", budget: 0.25, fetches: 20, wantHedges: 5},
+		{name: "not enough fetches for a hedge", budget: 0.25, fetches: 3, wantHedges: 0},
+		{name: "saved up hedges are capped", budget: 1, fetches: 100, wantHedges: hedgeMaxTokens},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHedgedTileFetcher(nil, "test", HedgeOptions{Budget: tt.budget}, metrics.NewNopRecorder()).(*hedgedFetcher)
+			for i := 0; i < tt.fetches; i++ {
+				h.hedgeDelay()
+			}
+			hedges := 0
+			for h.spend() {
+				hedges++
+			}
+			if hedges != tt.wantHedges {
+				t.Errorf("expected %d hedges, got %d", tt.wantHedges, hedges)
+			}
+		})
+	}
+}
+
+func TestHedgedGetTile(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name      string
+		budget    float64
+		responses []attemptResponse
+		// wantAttempt is the attempt whose tile is returned, or -1 if an error is
+		wantAttempt  int
+		wantErr      error
+		wantOutcomes []string
+		// wantCancelled is the number of attempts that lose and are cancelled
+		wantCancelled int32
+	}{
+		{
+			name:         "first is fast enough",
+			budget:       1,
+			responses:    []attemptResponse{{after: 0}},
+			wantAttempt:  0,
+			wantOutcomes: nil,
+		},
+		{
+			name:          "hedge wins",
+			budget:        1,
+			responses:     []attemptResponse{{hang: true}, {after: 0}},
+			wantAttempt:   1,
+			wantOutcomes:  []string{"hedged", "won"},
+			wantCancelled: 1,
+		},
+		{
+			name:         "budget exhausted",
+			budget:       0,
+			responses:    []attemptResponse{{after: 50 * ms}},
+			wantAttempt:  0,
+			wantOutcomes: []string{"budget_exhausted"},
+		},
+		{
+			name:         "hedge gets past a failure",
+			budget:       1,
+			responses:    []attemptResponse{{after: 20 * ms, err: errors.New("boom")}, {after: 40 * ms}},
+			wantAttempt:  1,
+			wantOutcomes: []string{"hedged", "won"},
+		},
+		{
+			name:          "missing tiles aren't retried",
+			budget:        1,
+			responses:     []attemptResponse{{after: 20 * ms, err: ErrNotFound}, {after: 200 * ms}},
+			wantAttempt:   -1,
+			wantErr:       ErrNotFound,
+			wantOutcomes:  []string{"hedged"},
+			wantCancelled: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &attemptFetcher{responses: tt.responses}
+			recorder := &hedgeRecorder{Recorder: metrics.NewNopRecorder()}
+			h := NewHedgedTileFetcher(f, "test", HedgeOptions{Budget: tt.budget}, recorder).(*hedgedFetcher)
+			h.delay = 10 * ms
+
+			resp, err := h.GetTile(context.Background(), common.Tile{Z: 1}, common.TileKind("terrarium"), common.TileVersion("v2"))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if tt.wantAttempt >= 0 && (resp == nil || int(resp.Data[0]) != tt.wantAttempt) {
+				t.Errorf("expected the tile of attempt %d, got %v", tt.wantAttempt, resp)
+			}
+
+			deadline := time.Now().Add(time.Second)
+			for f.cancelled.Load() < tt.wantCancelled && time.Now().Before(deadline) {
+				time.Sleep(ms)
+			}
+			if cancelled := f.cancelled.Load(); cancelled != tt.wantCancelled {
+				t.Errorf("expected %d cancelled attempts, got %d", tt.wantCancelled, cancelled)
+			}
+
+			recorder.mu.Lock()
+			defer recorder.mu.Unlock()
+			if len(recorder.outcomes) != len(tt.wantOutcomes) {
+				t.Fatalf("expected outcomes %v, got %v", tt.wantOutcomes, recorder.outcomes)
+			}
+			for i := range tt.wantOutcomes {
+				if recorder.outcomes[i] != tt.wantOutcomes[i] {
+					t.Errorf("expected outcomes %v, got %v", tt.wantOutcomes, recorder.outcomes)
+				}
+			}
+		})
+	}
+}
+
+func repeat(d time.Duration, n int) []time.Duration {
+	latencies := make([]time.Duration, n)
+	for i := range latencies {
+		latencies[i] = d
+	}
+	return latencies
+}
+
+// spread returns the latencies from to to, exclusive, in units of unit.
+func spread(from int, to int, unit time.Duration) []time.Duration {
+	var latencies []time.Duration
+	for i := from; i < to; i++ {
+		latencies = append(latencies, time.Duration(i)*unit)
+	}
+	return latencies
+}
@@ -4,29 +4,49 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/tilezen/go-zaloa/pkg/common"
 )
 
 type httpFetcher struct {
 	baseURL string
 	client  *http.Client
+	logger  *slog.Logger
+}
+
+func (h httpFetcher) tileURL(t common.Tile, kind common.TileKind, version common.TileVersion) (string, error) {
+	return url.JoinPath(h.baseURL, string(version), string(kind), t.String()+".png")
+}
+
+func (h httpFetcher) Locate(t common.Tile, kind common.TileKind, version common.TileVersion) string {
+	u, _ := h.tileURL(t, kind, version)
+	return u
 }
 
 func (h httpFetcher) GetTile(ctx context.Context, t common.Tile, kind common.TileKind, version common.TileVersion) (*FetchResponse, error) {
-	u, err := url.JoinPath(h.baseURL, string(version), string(kind), t.String()+".png")
+	u, err := h.tileURL(t, kind, version)
 	if err != nil {
 		return nil, fmt.Errorf("error joining url: %w", err)
 	}
 
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("zaloa.key", u))
+
 	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
 		return nil, fmt.Errorf("error building url %s: %w", u, err)
 	}
 
+	// Continue the trace in the upstream server
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
 	resp, err := h.client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching %s: %w", u, err)
@@ -42,12 +62,20 @@ func (h httpFetcher) GetTile(ctx context.Context, t common.Tile, kind common.Til
 		return nil, fmt.Errorf("error closing response body for %s: %w", u, err)
 	}
 
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("error fetching %s: %w", u, ErrNotFound)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("error fetching %s: unexpected status %d", u, resp.StatusCode)
+	}
+
 	responseData := &FetchResponse{
 		Data: data,
+		ETag: resp.Header.Get("ETag"),
 		Tile: t,
 	}
 
-	log.Printf("Retrieved %s", u)
+	h.logger.DebugContext(ctx, "retrieved tile", "url", u)
 
 	return responseData, nil
 }
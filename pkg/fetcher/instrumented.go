@@ -0,0 +1,29 @@
+package fetcher
+
+import (
+	"context"
+	"time"
+
+	"github.com/tilezen/go-zaloa/pkg/common"
+	"github.com/tilezen/go-zaloa/pkg/metrics"
+)
+
+type instrumentedFetcher struct {
+	fetcher     TileFetcher
+	fetcherType string
+	recorder    metrics.Recorder
+}
+
+func (i instrumentedFetcher) GetTile(ctx context.Context, t common.Tile, kind common.TileKind, version common.TileVersion) (*FetchResponse, error) {
+	start := time.Now()
+	resp, err := i.fetcher.GetTile(ctx, t, kind, version)
+	i.recorder.ObserveFetch(i.fetcherType, time.Since(start), err)
+	return resp, err
+}
+
+func (i instrumentedFetcher) Locate(t common.Tile, kind common.TileKind, version common.TileVersion) string {
+	if locator, ok := i.fetcher.(Locator); ok {
+		return locator.Locate(t, kind, version)
+	}
+	return ""
+}
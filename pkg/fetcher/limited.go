@@ -0,0 +1,37 @@
+package fetcher
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tilezen/go-zaloa/pkg/admission"
+	"github.com/tilezen/go-zaloa/pkg/common"
+)
+
+type limitedFetcher struct {
+	fetcher TileFetcher
+	limiter *admission.Limiter
+}
+
+// NewLimitedTileFetcher bounds the number of fetches f makes at once with limiter. Fetches wait for a slot until their
+// context is done.
+func NewLimitedTileFetcher(f TileFetcher, limiter *admission.Limiter) TileFetcher {
+	return limitedFetcher{fetcher: f, limiter: limiter}
+}
+
+func (l limitedFetcher) GetTile(ctx context.Context, t common.Tile, kind common.TileKind, version common.TileVersion) (*FetchResponse, error) {
+	release, err := l.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error waiting to fetch Tile %s: %w", t, err)
+	}
+	defer release()
+
+	return l.fetcher.GetTile(ctx, t, kind, version)
+}
+
+func (l limitedFetcher) Locate(t common.Tile, kind common.TileKind, version common.TileVersion) string {
+	if locator, ok := l.fetcher.(Locator); ok {
+		return locator.Locate(t, kind, version)
+	}
+	return ""
+}
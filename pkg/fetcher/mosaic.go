@@ -0,0 +1,109 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/tilezen/go-zaloa/pkg/common"
+)
+
+// MosaicLayer is the tile one source of a mosaic fetcher has for the requested tile.
+type MosaicLayer struct {
+	Source string
+	// Data is nil if the source doesn't cover or have the tile
+	Data []byte
+	// Nodata is the elevation the source uses for missing data, if it has one
+	Nodata *float64
+}
+
+type mosaicFetcher struct {
+	sources []CompositeSource
+	feather int
+}
+
+func (m mosaicFetcher) GetTile(ctx context.Context, t common.Tile, kind common.TileKind, version common.TileVersion) (*FetchResponse, error) {
+	layers := make([]MosaicLayer, len(m.sources))
+	etags := make([]string, len(m.sources))
+
+	errs, ctx := errgroup.WithContext(ctx)
+	for i, source := range m.sources {
+		i, source := i, source
+
+		layers[i] = MosaicLayer{Source: source.Name, Nodata: source.Nodata}
+		if !source.covers(t) {
+			continue
+		}
+
+		errs.Go(func() error {
+			resp, err := source.Fetcher.GetTile(ctx, t, kind, version)
+			if errors.Is(err, ErrNotFound) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("error fetching from source %s: %w", source.Name, err)
+			}
+
+			layers[i].Data = resp.Data
+			etags[i] = resp.ETag
+			return nil
+		})
+	}
+
+	if err := errs.Wait(); err != nil {
+		return nil, err
+	}
+
+	resp := &FetchResponse{
+		Tile:    t,
+		Layers:  layers,
+		Feather: m.feather,
+	}
+
+	var names []string
+	var etagParts []string
+	hasETags := true
+	for i, layer := range layers {
+		if layer.Data == nil {
+			continue
+		}
+
+		if resp.Data == nil {
+			resp.Data = layer.Data
+		}
+		names = append(names, layer.Source)
+		etagParts = append(etagParts, layer.Source+"="+etags[i])
+		hasETags = hasETags && etags[i] != ""
+	}
+
+	if names == nil {
+		return nil, fmt.Errorf("no source has Tile %s: %w", t, ErrNotFound)
+	}
+
+	resp.Source = strings.Join(names, "+")
+	if hasETags {
+		resp.ETag = strings.Join(etagParts, ",")
+	}
+
+	return resp, nil
+}
+
+// Locate returns the locations of the tile in every source that covers it.
+func (m mosaicFetcher) Locate(t common.Tile, kind common.TileKind, version common.TileVersion) string {
+	var locations []string
+	for _, source := range m.sources {
+		if !source.covers(t) {
+			continue
+		}
+
+		location := source.Name
+		if locator, ok := source.Fetcher.(Locator); ok {
+			location += ": " + locator.Locate(t, kind, version)
+		}
+		locations = append(locations, location)
+	}
+	return strings.Join(locations, ", ")
+}
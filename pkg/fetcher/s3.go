@@ -2,14 +2,18 @@ package fetcher
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"path"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/tilezen/go-zaloa/pkg/common"
 )
@@ -18,10 +22,21 @@ type s3tileFetcher struct {
 	s3Bucket      string
 	requesterPays bool
 	s3            s3iface.S3API
+	logger        *slog.Logger
+}
+
+func (s s3tileFetcher) s3Key(t common.Tile, kind common.TileKind, version common.TileVersion) string {
+	return path.Clean(fmt.Sprintf("%s/%s/%s.png", version, kind, t))
+}
+
+func (s s3tileFetcher) Locate(t common.Tile, kind common.TileKind, version common.TileVersion) string {
+	return fmt.Sprintf("s3://%s/%s", s.s3Bucket, s.s3Key(t, kind, version))
 }
 
 func (s s3tileFetcher) GetTile(ctx context.Context, t common.Tile, kind common.TileKind, version common.TileVersion) (*FetchResponse, error) {
-	s3Key := path.Clean(fmt.Sprintf("%s/%s/%s.png", version, kind, t))
+	s3Key := s.s3Key(t, kind, version)
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("zaloa.key", s.Locate(t, kind, version)))
 
 	input := &s3.GetObjectInput{
 		Bucket: aws.String(s.s3Bucket),
@@ -33,6 +48,10 @@ func (s s3tileFetcher) GetTile(ctx context.Context, t common.Tile, kind common.T
 	}
 
 	resp, err := s.s3.GetObjectWithContext(ctx, input)
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, fmt.Errorf("error fetching Tile s3://%s/%s: %w", s.s3Bucket, s3Key, ErrNotFound)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("error fetching Tile s3://%s/%s: %w", s.s3Bucket, s3Key, err)
 	}
@@ -49,10 +68,11 @@ func (s s3tileFetcher) GetTile(ctx context.Context, t common.Tile, kind common.T
 
 	responseData := &FetchResponse{
 		Data: data,
+		ETag: aws.StringValue(resp.ETag),
 		Tile: t,
 	}
 
-	log.Printf("Retrieved s3://%s/%s", s.s3Bucket, s3Key)
+	s.logger.DebugContext(ctx, "retrieved tile", "bucket", s.s3Bucket, "key", s3Key)
 
 	return responseData, nil
 }
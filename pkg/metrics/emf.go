@@ -0,0 +1,299 @@
+package metrics
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type emfRecorder struct {
+	namespace string
+
+	mu      sync.Mutex
+	encoder *json.Encoder
+	groups  []*emfGroup
+}
+
+// NewEMFRecorder creates a BufferedRecorder that writes the measurements to w as CloudWatch embedded metric format log
+// lines when it's flushed. Flushing once per request keeps it to one line per request, with the repeated measurements
+// like fetches as arrays of values. In Lambda, writing these to stdout is enough for CloudWatch to extract the metrics.
+// See https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+func NewEMFRecorder(w io.Writer, namespace string) BufferedRecorder {
+	return &emfRecorder{
+		namespace: namespace,
+		encoder:   json.NewEncoder(w),
+	}
+}
+
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+// emfGroup holds the values of metrics measured with the same dimensions since the last flush.
+type emfGroup struct {
+	dimensions map[string]string
+	metrics    []emfMetric
+	values     map[string][]float64
+}
+
+func (g *emfGroup) sameDimensions(dimensions map[string]string) bool {
+	if len(g.dimensions) != len(dimensions) {
+		return false
+	}
+	for name, value := range dimensions {
+		if v, ok := g.dimensions[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// fits returns true if the group can go in a document with the given top level members, which it mustn't overwrite.
+func (g *emfGroup) fits(record map[string]interface{}) bool {
+	for name, value := range g.dimensions {
+		if v, ok := record[name]; ok && v != value {
+			return false
+		}
+	}
+	for _, m := range g.metrics {
+		if _, ok := record[m.Name]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *emfRecorder) write(dimensions map[string]string, metrics []emfMetric, values map[string]float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var group *emfGroup
+	for _, g := range e.groups {
+		if g.sameDimensions(dimensions) {
+			group = g
+			break
+		}
+	}
+	if group == nil {
+		group = &emfGroup{dimensions: dimensions, values: map[string][]float64{}}
+		e.groups = append(e.groups, group)
+	}
+
+	for _, m := range metrics {
+		if _, ok := group.values[m.Name]; !ok {
+			group.metrics = append(group.metrics, m)
+		}
+		group.values[m.Name] = append(group.values[m.Name], values[m.Name])
+	}
+}
+
+// emfMaxValues is the most values a metric can have in one document
+const emfMaxValues = 100
+
+// split splits the group into groups with at most emfMaxValues values per metric, which go in separate documents.
+func (g *emfGroup) split() []*emfGroup {
+	var groups []*emfGroup
+	for start := 0; ; start += emfMaxValues {
+		part := &emfGroup{dimensions: g.dimensions, values: map[string][]float64{}}
+		for _, m := range g.metrics {
+			values := g.values[m.Name]
+			if start >= len(values) {
+				continue
+			}
+			part.metrics = append(part.metrics, m)
+			part.values[m.Name] = values[start:min(start+emfMaxValues, len(values))]
+		}
+		if len(part.metrics) == 0 {
+			return groups
+		}
+		groups = append(groups, part)
+	}
+}
+
+// Flush writes the measurements made since the last flush. They usually fit in a single document, but measurements
+// whose dimensions take different values, like fetches by two fetchers, need one document each.
+func (e *emfRecorder) Flush() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var groups []*emfGroup
+	for _, g := range e.groups {
+		groups = append(groups, g.split()...)
+	}
+	e.groups = nil
+
+	timestamp := time.Now().UnixMilli()
+	var records []map[string]interface{}
+	var directives [][]emfDirective
+	for _, g := range groups {
+		i := 0
+		for i < len(records) && !g.fits(records[i]) {
+			i++
+		}
+		if i == len(records) {
+			records = append(records, map[string]interface{}{})
+			directives = append(directives, nil)
+		}
+
+		dimensionNames := make([]string, 0, len(g.dimensions))
+		for name, value := range g.dimensions {
+			dimensionNames = append(dimensionNames, name)
+			records[i][name] = value
+		}
+		sort.Strings(dimensionNames)
+
+		for _, m := range g.metrics {
+			values := g.values[m.Name]
+			if len(values) == 1 {
+				records[i][m.Name] = values[0]
+			} else {
+				records[i][m.Name] = values
+			}
+		}
+
+		directives[i] = append(directives[i], emfDirective{
+			Namespace:  e.namespace,
+			Dimensions: [][]string{dimensionNames},
+			Metrics:    g.metrics,
+		})
+	}
+
+	for i, record := range records {
+		record["_aws"] = emfMetadata{Timestamp: timestamp, CloudWatchMetrics: directives[i]}
+		if err := e.encoder.Encode(record); err != nil {
+			slog.Error("Error writing EMF metrics", "error", err)
+		}
+	}
+}
+
+func (e *emfRecorder) ObserveRequest(labels RequestLabels, status int, duration time.Duration, bytes int) {
+	e.write(
+		map[string]string{
+			"Tileset":  labels.Tileset,
+			"TileSize": labels.TileSize,
+			"Format":   labels.Format,
+			"Status":   strconv.Itoa(status),
+		},
+		[]emfMetric{
+			{Name: "Requests", Unit: "Count"},
+			{Name: "RequestLatency", Unit: "Milliseconds"},
+			{Name: "BytesServed", Unit: "Bytes"},
+		},
+		map[string]float64{
+			"Requests":       1,
+			"RequestLatency": float64(duration.Microseconds()) / 1000,
+			"BytesServed":    float64(bytes),
+		},
+	)
+}
+
+func (e *emfRecorder) ObserveFetch(fetcherType string, duration time.Duration, err error) {
+	fetchErrors := 0.0
+	if err != nil {
+		fetchErrors = 1
+	}
+
+	e.write(
+		map[string]string{"Fetcher": fetcherType},
+		[]emfMetric{
+			{Name: "FetchLatency", Unit: "Milliseconds"},
+			{Name: "FetchErrors", Unit: "Count"},
+		},
+		map[string]float64{
+			"FetchLatency": float64(duration.Microseconds()) / 1000,
+			"FetchErrors":  fetchErrors,
+		},
+	)
+}
+
+// emfStageMetrics names the latency metric of each stage. Each stage has a metric of its own rather than a Stage
+// dimension, so that all the stages of a request fit in one document.
+var emfStageMetrics = map[Stage]string{
+	Stage_DECODE: "DecodeLatency",
+	Stage_DRAW:   "DrawLatency",
+	Stage_STYLE:  "StyleLatency",
+	Stage_ENCODE: "EncodeLatency",
+}
+
+func (e *emfRecorder) ObserveStage(stage Stage, duration time.Duration) {
+	name := emfStageMetrics[stage]
+	e.write(
+		map[string]string{},
+		[]emfMetric{{Name: name, Unit: "Milliseconds"}},
+		map[string]float64{name: float64(duration.Microseconds()) / 1000},
+	)
+}
+
+// AddInFlight is a no-op because a Lambda instance only serves one request at a time.
+func (e *emfRecorder) AddInFlight(int) {}
+
+func (e *emfRecorder) ObserveReload(err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	e.write(
+		map[string]string{"Result": result},
+		[]emfMetric{{Name: "ConfigReloads", Unit: "Count"}},
+		map[string]float64{"ConfigReloads": 1},
+	)
+}
+
+func (e *emfRecorder) ObserveAPIKey(name string, result string) {
+	e.write(
+		map[string]string{"Key": name, "Result": result},
+		[]emfMetric{{Name: "APIKeyRequests", Unit: "Count"}},
+		map[string]float64{"APIKeyRequests": 1},
+	)
+}
+
+func (e *emfRecorder) ObserveSignedURL(secretID string, result string) {
+	e.write(
+		map[string]string{"Kid": secretID, "Result": result},
+		[]emfMetric{{Name: "SignedURLRequests", Unit: "Count"}},
+		map[string]float64{"SignedURLRequests": 1},
+	)
+}
+
+// SetConcurrencyLimit and AddConcurrency are no-ops because gauges can't be kept across Lambda invocations.
+func (e *emfRecorder) SetConcurrencyLimit(string, int, int) {}
+func (e *emfRecorder) AddConcurrency(string, int, int)      {}
+
+func (e *emfRecorder) ObserveAdmission(pool string, result string, wait time.Duration) {
+	e.write(
+		map[string]string{"Pool": pool, "Result": result},
+		[]emfMetric{
+			{Name: "Admissions", Unit: "Count"},
+			{Name: "AdmissionWait", Unit: "Milliseconds"},
+		},
+		map[string]float64{
+			"Admissions":    1,
+			"AdmissionWait": float64(wait.Microseconds()) / 1000,
+		},
+	)
+}
+
+func (e *emfRecorder) ObserveHedge(fetcher string, result string) {
+	e.write(
+		map[string]string{"Fetcher": fetcher, "Result": result},
+		[]emfMetric{{Name: "HedgedFetches", Unit: "Count"}},
+		map[string]float64{"HedgedFetches": 1},
+	)
+}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEMFRecorderFlush(t *testing.T) {
+	tests := []struct {
+		name      string
+		observe   func(r Recorder)
+		documents int
+		check     func(t *testing.T, documents []map[string]interface{})
+	}{
+		{
+			name: "516 tile",
+			observe: func(r Recorder) {
+				for i := 0; i < 16; i++ {
+					r.ObserveFetch("s3", time.Millisecond, nil)
+				}
+				r.ObserveStage(Stage_DECODE, time.Millisecond)
+				r.ObserveStage(Stage_DRAW, time.Millisecond)
+				r.ObserveStage(Stage_ENCODE, time.Millisecond)
+				r.ObserveRequest(RequestLabels{Tileset: "terrarium", TileSize: "516", Format: "webp"}, 200, time.Second, 1000)
+			},
+			documents: 1,
+			check: func(t *testing.T, documents []map[string]interface{}) {
+				if latencies, ok := documents[0]["FetchLatency"].([]interface{}); !ok || len(latencies) != 16 {
+					t.Errorf("expected 16 fetch latencies, got %v", documents[0]["FetchLatency"])
+				}
+				if documents[0]["Fetcher"] != "s3" || documents[0]["Tileset"] != "terrarium" {
+					t.Errorf("expected the fetch and request dimensions, got %v", documents[0])
+				}
+				if documents[0]["EncodeLatency"] != 1.0 {
+					t.Errorf("expected a single encode latency, got %v", documents[0]["EncodeLatency"])
+				}
+				directives := documents[0]["_aws"].(map[string]interface{})["CloudWatchMetrics"].([]interface{})
+				if len(directives) != 3 {
+					t.Errorf("expected 3 directives, got %d", len(directives))
+				}
+			},
+		},
+		{
+			name: "two fetchers",
+			observe: func(r Recorder) {
+				r.ObserveFetch("s3", time.Millisecond, nil)
+				r.ObserveFetch("http", time.Millisecond, errors.New("not found"))
+			},
+			documents: 2,
+			check: func(t *testing.T, documents []map[string]interface{}) {
+				if documents[1]["Fetcher"] != "http" || documents[1]["FetchErrors"] != 1.0 {
+					t.Errorf("expected the failed http fetch in the second document, got %v", documents[1])
+				}
+			},
+		},
+		{
+			name: "more values than a document holds",
+			observe: func(r Recorder) {
+				for i := 0; i < 150; i++ {
+					r.ObserveFetch("s3", time.Millisecond, nil)
+				}
+			},
+			documents: 2,
+			check: func(t *testing.T, documents []map[string]interface{}) {
+				if latencies := documents[1]["FetchLatency"].([]interface{}); len(latencies) != 50 {
+					t.Errorf("expected 50 latencies in the second document, got %d", len(latencies))
+				}
+			},
+		},
+		{
+			name:      "nothing observed",
+			observe:   func(Recorder) {},
+			documents: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &bytes.Buffer{}
+			r := NewEMFRecorder(b, "Test")
+			tt.observe(r)
+			if b.Len() != 0 {
+				t.Fatalf("expected nothing to be written before the flush, got %s", b.String())
+			}
+
+			r.Flush()
+			var documents []map[string]interface{}
+			for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+				if line == "" {
+					continue
+				}
+				var document map[string]interface{}
+				if err := json.Unmarshal([]byte(line), &document); err != nil {
+					t.Fatalf("invalid document %s: %v", line, err)
+				}
+				documents = append(documents, document)
+			}
+			if len(documents) != tt.documents {
+				t.Fatalf("expected %d documents, got %d: %s", tt.documents, len(documents), b.String())
+			}
+			if tt.check != nil {
+				tt.check(t, documents)
+			}
+
+			b.Reset()
+			r.Flush()
+			if b.Len() != 0 {
+				t.Errorf("expected a second flush to write nothing, got %s", b.String())
+			}
+		})
+	}
+}
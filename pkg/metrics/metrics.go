@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"time"
+)
+
+type Stage string
+
+const (
+	Stage_DECODE = Stage("decode")
+	Stage_DRAW   = Stage("draw")
+	Stage_STYLE  = Stage("style")
+	Stage_ENCODE = Stage("encode")
+)
+
+// RequestLabels identifies the kind of tile a request was for. Requests that fail validation are labelled "invalid" to
+// keep the cardinality of the metrics bounded.
+type RequestLabels struct {
+	Tileset  string
+	TileSize string
+	Format   string
+}
+
+var InvalidRequestLabels = RequestLabels{Tileset: "invalid", TileSize: "invalid", Format: "invalid"}
+
+// Recorder receives measurements from the tile request pipeline.
+type Recorder interface {
+	// ObserveRequest records a completed tile request and the number of bytes written in response.
+	ObserveRequest(labels RequestLabels, status int, duration time.Duration, bytes int)
+	// ObserveFetch records a single upstream fetch by the given type of fetcher.
+	ObserveFetch(fetcherType string, duration time.Duration, err error)
+	// ObserveStage records the time spent in one stage of processing a tile.
+	ObserveStage(stage Stage, duration time.Duration)
+	// AddInFlight adjusts the number of requests currently being served.
+	AddInFlight(delta int)
+	// ObserveReload records an attempt to reload the configuration, which failed if err is set.
+	ObserveReload(err error)
+	// ObserveAPIKey records a request made with the API key of the given name, and whether it was allowed or why not.
+	ObserveAPIKey(name string, result string)
+	// ObserveSignedURL records a request made with a URL signed with the given secret, and whether it was allowed or
+	// why not.
+	ObserveSignedURL(secretID string, result string)
+	// SetConcurrencyLimit records the limits of the named pool of upstream fetches or renders. A negative queue is
+	// unbounded.
+	SetConcurrencyLimit(pool string, concurrency int, queue int)
+	// AddConcurrency adjusts the number of operations running and waiting in the named pool.
+	AddConcurrency(pool string, activeDelta int, queuedDelta int)
+	// ObserveAdmission records whether an operation was admitted to the named pool, and how long it waited.
+	ObserveAdmission(pool string, result string, wait time.Duration)
+	// ObserveHedge records a fetch by the named fetcher that was slow enough to hedge: whether the hedge was sent, or
+	// the budget didn't allow it, and whether it won.
+	ObserveHedge(fetcher string, result string)
+}
+
+// BufferedRecorder is a Recorder that holds on to the measurements until it's flushed.
+type BufferedRecorder interface {
+	Recorder
+	// Flush writes out the measurements made since the last flush.
+	Flush()
+}
+
+type nopRecorder struct{}
+
+func (nopRecorder) ObserveRequest(RequestLabels, int, time.Duration, int) {}
+func (nopRecorder) ObserveFetch(string, time.Duration, error)             {}
+func (nopRecorder) ObserveStage(Stage, time.Duration)                     {}
+func (nopRecorder) AddInFlight(int)                                       {}
+func (nopRecorder) ObserveReload(error)                                   {}
+func (nopRecorder) ObserveAPIKey(string, string)                          {}
+func (nopRecorder) ObserveSignedURL(string, string)                       {}
+func (nopRecorder) SetConcurrencyLimit(string, int, int)                  {}
+func (nopRecorder) AddConcurrency(string, int, int)                       {}
+func (nopRecorder) ObserveAdmission(string, string, time.Duration)        {}
+func (nopRecorder) ObserveHedge(string, string)                           {}
+
+// NewNopRecorder returns a Recorder that discards everything.
+func NewNopRecorder() Recorder {
+	return nopRecorder{}
+}
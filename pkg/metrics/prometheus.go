@@ -0,0 +1,221 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type prometheusRecorder struct {
+	requests       *prometheus.CounterVec
+	requestLatency *prometheus.HistogramVec
+	bytesServed    *prometheus.CounterVec
+	inFlight       prometheus.Gauge
+	fetchLatency   *prometheus.HistogramVec
+	fetchErrors    *prometheus.CounterVec
+	stageLatency   *prometheus.HistogramVec
+	reloads        *prometheus.CounterVec
+	lastReload     prometheus.Gauge
+	apiKeys        *prometheus.CounterVec
+	signedURLs     *prometheus.CounterVec
+	concurrency    *prometheus.GaugeVec
+	queueLimit     *prometheus.GaugeVec
+	active         *prometheus.GaugeVec
+	queued         *prometheus.GaugeVec
+	admissions     *prometheus.CounterVec
+	admissionWait  *prometheus.HistogramVec
+	hedges         *prometheus.CounterVec
+}
+
+// NewPrometheusRecorder creates a Recorder that exposes its measurements as Prometheus metrics registered with
+// registerer.
+func NewPrometheusRecorder(registerer prometheus.Registerer) Recorder {
+	requestLabels := []string{"tileset", "tilesize", "format"}
+
+	p := &prometheusRecorder{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "zaloa",
+			Name:      "requests_total",
+			Help:      "Tile requests served.",
+		}, append(requestLabels, "status")),
+		requestLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "zaloa",
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to serve tile requests.",
+			Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		}, append(requestLabels, "status")),
+		bytesServed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "zaloa",
+			Name:      "response_bytes_total",
+			Help:      "Bytes of tile data served.",
+		}, requestLabels),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "zaloa",
+			Name:      "requests_in_flight",
+			Help:      "Tile requests currently being served.",
+		}),
+		fetchLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "zaloa",
+			Name:      "upstream_fetch_duration_seconds",
+			Help:      "Time taken to fetch source tiles.",
+			Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"fetcher"}),
+		fetchErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "zaloa",
+			Name:      "upstream_fetch_errors_total",
+			Help:      "Source tile fetches that failed.",
+		}, []string{"fetcher"}),
+		stageLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "zaloa",
+			Name:      "stage_duration_seconds",
+			Help:      "Time spent decoding, drawing, styling and encoding tiles.",
+			Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"stage"}),
+		reloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "zaloa",
+			Name:      "config_reloads_total",
+			Help:      "Attempts to reload the configuration.",
+		}, []string{"result"}),
+		lastReload: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "zaloa",
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Time of the last successful configuration reload.",
+		}),
+		apiKeys: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "zaloa",
+			Name:      "api_key_requests_total",
+			Help:      "Requests made with each API key, by whether they were allowed.",
+		}, []string{"key", "result"}),
+		signedURLs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "zaloa",
+			Name:      "signed_url_requests_total",
+			Help:      "Requests made with signed URLs, by signing secret and whether they were allowed.",
+		}, []string{"kid", "result"}),
+		concurrency: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "zaloa",
+			Name:      "concurrency_limit",
+			Help:      "Upstream fetches or renders that can run at once in each pool.",
+		}, []string{"pool"}),
+		queueLimit: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "zaloa",
+			Name:      "queue_limit",
+			Help:      "Upstream fetches or renders that can wait for a slot in each pool with a bounded queue.",
+		}, []string{"pool"}),
+		active: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "zaloa",
+			Name:      "concurrency_active",
+			Help:      "Upstream fetches or renders running in each pool.",
+		}, []string{"pool"}),
+		queued: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "zaloa",
+			Name:      "concurrency_queued",
+			Help:      "Upstream fetches or renders waiting for a slot in each pool.",
+		}, []string{"pool"}),
+		admissions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "zaloa",
+			Name:      "admissions_total",
+			Help:      "Upstream fetches or renders that asked for a slot in each pool, by whether they got one.",
+		}, []string{"pool", "result"}),
+		admissionWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "zaloa",
+			Name:      "admission_wait_seconds",
+			Help:      "Time upstream fetches or renders waited for a slot in each pool.",
+			Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"pool"}),
+		hedges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "zaloa",
+			Name:      "hedged_fetches_total",
+			Help:      "Upstream fetches slow enough to hedge, by whether the hedge was sent or over budget, and whether it won.",
+		}, []string{"fetcher", "result"}),
+	}
+
+	registerer.MustRegister(
+		p.requests,
+		p.requestLatency,
+		p.bytesServed,
+		p.inFlight,
+		p.fetchLatency,
+		p.fetchErrors,
+		p.stageLatency,
+		p.reloads,
+		p.lastReload,
+		p.apiKeys,
+		p.signedURLs,
+		p.concurrency,
+		p.queueLimit,
+		p.active,
+		p.queued,
+		p.admissions,
+		p.admissionWait,
+		p.hedges,
+	)
+
+	return p
+}
+
+func (p *prometheusRecorder) ObserveRequest(labels RequestLabels, status int, duration time.Duration, bytes int) {
+	statusLabel := strconv.Itoa(status)
+	p.requests.WithLabelValues(labels.Tileset, labels.TileSize, labels.Format, statusLabel).Inc()
+	p.requestLatency.WithLabelValues(labels.Tileset, labels.TileSize, labels.Format, statusLabel).Observe(duration.Seconds())
+	p.bytesServed.WithLabelValues(labels.Tileset, labels.TileSize, labels.Format).Add(float64(bytes))
+}
+
+func (p *prometheusRecorder) ObserveFetch(fetcherType string, duration time.Duration, err error) {
+	p.fetchLatency.WithLabelValues(fetcherType).Observe(duration.Seconds())
+	if err != nil {
+		p.fetchErrors.WithLabelValues(fetcherType).Inc()
+	}
+}
+
+func (p *prometheusRecorder) ObserveStage(stage Stage, duration time.Duration) {
+	p.stageLatency.WithLabelValues(string(stage)).Observe(duration.Seconds())
+}
+
+func (p *prometheusRecorder) AddInFlight(delta int) {
+	p.inFlight.Add(float64(delta))
+}
+
+func (p *prometheusRecorder) ObserveReload(err error) {
+	if err != nil {
+		p.reloads.WithLabelValues("failure").Inc()
+		return
+	}
+	p.reloads.WithLabelValues("success").Inc()
+	p.lastReload.SetToCurrentTime()
+}
+
+func (p *prometheusRecorder) ObserveAPIKey(name string, result string) {
+	p.apiKeys.WithLabelValues(name, result).Inc()
+}
+
+func (p *prometheusRecorder) ObserveSignedURL(secretID string, result string) {
+	p.signedURLs.WithLabelValues(secretID, result).Inc()
+}
+
+func (p *prometheusRecorder) SetConcurrencyLimit(pool string, concurrency int, queue int) {
+	p.concurrency.WithLabelValues(pool).Set(float64(concurrency))
+	if queue >= 0 {
+		p.queueLimit.WithLabelValues(pool).Set(float64(queue))
+	}
+}
+
+func (p *prometheusRecorder) AddConcurrency(pool string, activeDelta int, queuedDelta int) {
+	if activeDelta != 0 {
+		p.active.WithLabelValues(pool).Add(float64(activeDelta))
+	}
+	if queuedDelta != 0 {
+		p.queued.WithLabelValues(pool).Add(float64(queuedDelta))
+	}
+}
+
+func (p *prometheusRecorder) ObserveAdmission(pool string, result string, wait time.Duration) {
+	p.admissions.WithLabelValues(pool, result).Inc()
+	if result == "admitted" {
+		p.admissionWait.WithLabelValues(pool).Observe(wait.Seconds())
+	}
+}
+
+func (p *prometheusRecorder) ObserveHedge(fetcher string, result string) {
+	p.hedges.WithLabelValues(fetcher, result).Inc()
+}
@@ -0,0 +1,367 @@
+package render
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type RampMode string
+
+const (
+	// RampMode_INTERPOLATE linearly interpolates between the two stops surrounding a height.
+	RampMode_INTERPOLATE = RampMode("interpolate")
+	// RampMode_DISCRETE uses the color of the highest stop at or below a height.
+	RampMode_DISCRETE = RampMode("discrete")
+)
+
+type ColorStop struct {
+	Value float64
+	Color color.NRGBA
+}
+
+// ColorRamp maps elevations to colors.
+type ColorRamp struct {
+	Name  string
+	Mode  RampMode
+	Stops []ColorStop
+	// NoData is the color used for pixels without elevation data.
+	NoData color.NRGBA
+	// Ocean, if set, is used for every elevation below sea level instead of the stops.
+	Ocean *color.NRGBA
+}
+
+// Color returns the color for the given elevation.
+func (r *ColorRamp) Color(height float64) color.NRGBA {
+	if r.Ocean != nil && height < 0 {
+		return *r.Ocean
+	}
+
+	stops := r.Stops
+	if len(stops) == 0 {
+		return r.NoData
+	}
+
+	// Index of the first stop above the height
+	i := sort.Search(len(stops), func(i int) bool { return stops[i].Value > height })
+
+	switch {
+	case i == 0:
+		return stops[0].Color
+	case i == len(stops):
+		return stops[len(stops)-1].Color
+	case r.Mode == RampMode_DISCRETE:
+		return stops[i-1].Color
+	}
+
+	lo, hi := stops[i-1], stops[i]
+	t := (height - lo.Value) / (hi.Value - lo.Value)
+	return color.NRGBA{
+		R: lerp(lo.Color.R, hi.Color.R, t),
+		G: lerp(lo.Color.G, hi.Color.G, t),
+		B: lerp(lo.Color.B, hi.Color.B, t),
+		A: lerp(lo.Color.A, hi.Color.A, t),
+	}
+}
+
+// Digest is a short hash of the ramp's definition that changes whenever the colors it produces could change.
+func (r *ColorRamp) Digest() string {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%s %v %v", r.Mode, r.Stops, r.NoData)
+	if r.Ocean != nil {
+		_, _ = fmt.Fprintf(h, " %v", *r.Ocean)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+func lerp(a, b uint8, t float64) uint8 {
+	return uint8(math.Round(float64(a) + (float64(b)-float64(a))*t))
+}
+
+func (r *ColorRamp) validate() error {
+	if len(r.Stops) == 0 {
+		return fmt.Errorf("color ramp %s has no stops", r.Name)
+	}
+
+	switch r.Mode {
+	case "":
+		r.Mode = RampMode_INTERPOLATE
+	case RampMode_INTERPOLATE, RampMode_DISCRETE:
+	default:
+		return fmt.Errorf("color ramp %s has unknown mode %s", r.Name, r.Mode)
+	}
+
+	sort.SliceStable(r.Stops, func(i, j int) bool { return r.Stops[i].Value < r.Stops[j].Value })
+	return nil
+}
+
+// ParseGDALColorRamp parses a color configuration file in the format accepted by `gdaldem color-relief`.
+// Each line holds an elevation followed by either R G B [A] components or a color name. The elevation `nv` sets
+// the nodata color. Two extensions are supported: an `ocean` line sets the color used below sea level and a
+// `mode discrete` line switches off interpolation. Percentage elevations are not supported because they depend
+// on the range of the whole dataset.
+func ParseGDALColorRamp(name string, r io.Reader) (*ColorRamp, error) {
+	ramp := &ColorRamp{Name: name}
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == '\t' || r == ',' || r == ':'
+		})
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("line %d: expected an elevation and a color", lineNo)
+		}
+
+		if strings.EqualFold(fields[0], "mode") {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: expected a single mode", lineNo)
+			}
+			ramp.Mode = RampMode(strings.ToLower(fields[1]))
+			continue
+		}
+
+		c, err := parseGDALColor(fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+
+		switch strings.ToLower(fields[0]) {
+		case "nv":
+			ramp.NoData = c
+		case "ocean":
+			ramp.Ocean = &c
+		default:
+			if strings.HasSuffix(fields[0], "%") {
+				return nil, fmt.Errorf("line %d: percentage elevations are not supported", lineNo)
+			}
+
+			value, err := strconv.ParseFloat(fields[0], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: error parsing elevation: %w", lineNo, err)
+			}
+
+			ramp.Stops = append(ramp.Stops, ColorStop{Value: value, Color: c})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading color ramp %s: %w", name, err)
+	}
+
+	if err := ramp.validate(); err != nil {
+		return nil, err
+	}
+
+	return ramp, nil
+}
+
+var namedColors = map[string]color.NRGBA{
+	"white":   {255, 255, 255, 255},
+	"black":   {0, 0, 0, 255},
+	"red":     {255, 0, 0, 255},
+	"green":   {0, 255, 0, 255},
+	"blue":    {0, 0, 255, 255},
+	"yellow":  {255, 255, 0, 255},
+	"magenta": {255, 0, 255, 255},
+	"fuchsia": {255, 0, 255, 255},
+	"cyan":    {0, 255, 255, 255},
+	"aqua":    {0, 255, 255, 255},
+	"grey":    {190, 190, 190, 255},
+	"gray":    {190, 190, 190, 255},
+	"orange":  {255, 165, 0, 255},
+	"brown":   {165, 42, 42, 255},
+	"purple":  {160, 32, 240, 255},
+	"violet":  {238, 130, 238, 255},
+	"indigo":  {75, 0, 130, 255},
+}
+
+func parseGDALColor(fields []string) (color.NRGBA, error) {
+	switch len(fields) {
+	case 1:
+		c, ok := namedColors[strings.ToLower(fields[0])]
+		if !ok {
+			return color.NRGBA{}, fmt.Errorf("unknown color name %s", fields[0])
+		}
+		return c, nil
+	case 3, 4:
+		components := []uint8{0, 0, 0, 255}
+		for i, f := range fields {
+			v, err := strconv.ParseUint(f, 10, 8)
+			if err != nil {
+				return color.NRGBA{}, fmt.Errorf("error parsing color component %s: %w", f, err)
+			}
+			components[i] = uint8(v)
+		}
+		return color.NRGBA{R: components[0], G: components[1], B: components[2], A: components[3]}, nil
+	default:
+		return color.NRGBA{}, fmt.Errorf("expected R G B [A] or a color name")
+	}
+}
+
+type jsonColorRamp struct {
+	Mode   RampMode   `json:"mode"`
+	NoData *jsonColor `json:"nodata"`
+	Ocean  *jsonColor `json:"ocean"`
+	Stops  []jsonStop `json:"stops"`
+}
+
+type jsonStop struct {
+	Value float64   `json:"value"`
+	Color jsonColor `json:"color"`
+}
+
+// jsonColor accepts either an [R, G, B, (A)] array or a "#RRGGBB(AA)" string.
+type jsonColor color.NRGBA
+
+func (c *jsonColor) UnmarshalJSON(data []byte) error {
+	// A string can't be unmarshalled into []uint8 first, as it would be taken for base64
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var components []uint8
+		if err := json.Unmarshal(trimmed, &components); err != nil {
+			return fmt.Errorf("invalid color array: %w", err)
+		}
+		if len(components) != 3 && len(components) != 4 {
+			return fmt.Errorf("expected 3 or 4 color components, got %d", len(components))
+		}
+		*c = jsonColor{R: components[0], G: components[1], B: components[2], A: 255}
+		if len(components) == 4 {
+			c.A = components[3]
+		}
+		return nil
+	}
+
+	var hex string
+	if err := json.Unmarshal(data, &hex); err != nil {
+		return fmt.Errorf("expected a color array or hex string")
+	}
+
+	hex = strings.TrimPrefix(hex, "#")
+	if len(hex) != 6 && len(hex) != 8 {
+		return fmt.Errorf("invalid hex color #%s", hex)
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return fmt.Errorf("invalid hex color #%s: %w", hex, err)
+	}
+
+	*c = jsonColor{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}
+	return nil
+}
+
+// ParseJSONColorRamp parses a color ramp in JSON form:
+//
+//	{"mode": "interpolate", "nodata": [0, 0, 0, 0], "ocean": "#1f4e79", "stops": [{"value": 0, "color": [0, 97, 71]}]}
+func ParseJSONColorRamp(name string, r io.Reader) (*ColorRamp, error) {
+	var parsed jsonColorRamp
+	if err := json.NewDecoder(r).Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("error decoding color ramp %s: %w", name, err)
+	}
+
+	ramp := &ColorRamp{Name: name, Mode: parsed.Mode}
+	if parsed.NoData != nil {
+		ramp.NoData = color.NRGBA(*parsed.NoData)
+	}
+	if parsed.Ocean != nil {
+		ocean := color.NRGBA(*parsed.Ocean)
+		ramp.Ocean = &ocean
+	}
+	for _, s := range parsed.Stops {
+		ramp.Stops = append(ramp.Stops, ColorStop{Value: s.Value, Color: color.NRGBA(s.Color)})
+	}
+
+	if err := ramp.validate(); err != nil {
+		return nil, err
+	}
+
+	return ramp, nil
+}
+
+// LoadColorRamps loads every .txt, .cpt and .json file in dir as a color ramp named after the file.
+func LoadColorRamps(dir string) (map[string]*ColorRamp, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error listing color ramps in %s: %w", dir, err)
+	}
+
+	ramps := map[string]*ColorRamp{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		ext := filepath.Ext(entry.Name())
+		var parse func(string, io.Reader) (*ColorRamp, error)
+		switch strings.ToLower(ext) {
+		case ".txt", ".cpt":
+			parse = ParseGDALColorRamp
+		case ".json":
+			parse = ParseJSONColorRamp
+		default:
+			continue
+		}
+
+		name := strings.TrimSuffix(entry.Name(), ext)
+		ramp, err := loadColorRamp(filepath.Join(dir, entry.Name()), name, parse)
+		if err != nil {
+			return nil, err
+		}
+
+		ramps[name] = ramp
+	}
+
+	return ramps, nil
+}
+
+func loadColorRamp(path string, name string, parse func(string, io.Reader) (*ColorRamp, error)) (*ColorRamp, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening color ramp %s: %w", path, err)
+	}
+	defer f.Close()
+
+	ramp, err := parse(name, f)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing color ramp %s: %w", path, err)
+	}
+
+	return ramp, nil
+}
+
+// DefaultColorRamp is a general purpose hypsometric tint used when no ramp is requested.
+var DefaultColorRamp = &ColorRamp{
+	Name: "default",
+	Mode: RampMode_INTERPOLATE,
+	Stops: []ColorStop{
+		{Value: -11000, Color: color.NRGBA{R: 8, G: 24, B: 58, A: 255}},
+		{Value: -4000, Color: color.NRGBA{R: 28, G: 72, B: 132, A: 255}},
+		{Value: -200, Color: color.NRGBA{R: 92, G: 156, B: 204, A: 255}},
+		{Value: 0, Color: color.NRGBA{R: 172, G: 216, B: 233, A: 255}},
+		{Value: 1, Color: color.NRGBA{R: 94, G: 148, B: 90, A: 255}},
+		{Value: 300, Color: color.NRGBA{R: 150, G: 185, B: 110, A: 255}},
+		{Value: 1000, Color: color.NRGBA{R: 222, G: 214, B: 150, A: 255}},
+		{Value: 2000, Color: color.NRGBA{R: 190, G: 150, B: 100, A: 255}},
+		{Value: 3500, Color: color.NRGBA{R: 150, G: 120, B: 105, A: 255}},
+		{Value: 5000, Color: color.NRGBA{R: 245, G: 245, B: 245, A: 255}},
+	},
+}
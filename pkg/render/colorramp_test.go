@@ -0,0 +1,113 @@
+package render
+
+import (
+	"encoding/json"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func TestJSONColor(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		want    color.NRGBA
+		wantErr bool
+	}{
+		{name: "rgb array", json: `[0, 97, 71]`, want: color.NRGBA{0, 97, 71, 255}},
+		{name: "rgba array", json: ` [1, 2, 3, 4]`, want: color.NRGBA{1, 2, 3, 4}},
+		{name: "hex", json: `"#1f4e79"`, want: color.NRGBA{0x1f, 0x4e, 0x79, 255}},
+		{name: "hex with alpha", json: `"#1f4e7980"`, want: color.NRGBA{0x1f, 0x4e, 0x79, 0x80}},
+		// Valid base64, which must not be decoded as bytes
+		{name: "hex without hash", json: `"1f4e79ff"`, want: color.NRGBA{0x1f, 0x4e, 0x79, 255}},
+		{name: "short hex without hash", json: `"ffffff"`, want: color.NRGBA{255, 255, 255, 255}},
+		{name: "two components", json: `[1, 2]`, wantErr: true},
+		{name: "component out of range", json: `[0, 300, 0]`, wantErr: true},
+		{name: "short hex", json: `"#fff"`, wantErr: true},
+		{name: "not hex", json: `"#gggggg"`, wantErr: true},
+		{name: "number", json: `255`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c jsonColor
+			err := json.Unmarshal([]byte(tt.json), &c)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", color.NRGBA(c))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if color.NRGBA(c) != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, color.NRGBA(c))
+			}
+		})
+	}
+}
+
+func TestParseGDALColorRamp(t *testing.T) {
+	tests := []struct {
+		name    string
+		ramp    string
+		wantErr bool
+	}{
+		{name: "components", ramp: "0 0 97 71\n3000 255 255 255\n"},
+		{name: "separators and comments", ramp: "# topo\n0,0,97,71\n3000:white\n\nnv 0 0 0 0\nocean 31 78 121\n"},
+		{name: "discrete", ramp: "mode discrete\n0 0 0 0\n"},
+		{name: "only separators", ramp: "0 0 0 0\n,,, ::\n", wantErr: true},
+		{name: "percentage", ramp: "50% 0 0 0\n", wantErr: true},
+		{name: "unknown color", ramp: "0 chartreuse\n", wantErr: true},
+		{name: "two components", ramp: "0 1 2\n", wantErr: true},
+		{name: "unknown mode", ramp: "mode smooth\n0 0 0 0\n", wantErr: true},
+		{name: "no stops", ramp: "nv 0 0 0 0\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseGDALColorRamp("test", strings.NewReader(tt.ramp))
+			if tt.wantErr && err == nil {
+				t.Fatalf("expected an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestColorRampColor(t *testing.T) {
+	ramp, err := ParseGDALColorRamp("test", strings.NewReader("1000 200 200 200\n0 0 100 0\nocean 0 0 255\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	discrete, err := ParseGDALColorRamp("test", strings.NewReader("mode discrete\n0 0 100 0\n1000 200 200 200\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		ramp   *ColorRamp
+		height float64
+		want   color.NRGBA
+	}{
+		{name: "ocean", ramp: ramp, height: -1, want: color.NRGBA{0, 0, 255, 255}},
+		{name: "first stop", ramp: ramp, height: 0, want: color.NRGBA{0, 100, 0, 255}},
+		{name: "between stops", ramp: ramp, height: 500, want: color.NRGBA{100, 150, 100, 255}},
+		{name: "last stop", ramp: ramp, height: 1000, want: color.NRGBA{200, 200, 200, 255}},
+		{name: "above the stops", ramp: ramp, height: 9000, want: color.NRGBA{200, 200, 200, 255}},
+		{name: "below the stops without ocean", ramp: discrete, height: -1, want: color.NRGBA{0, 100, 0, 255}},
+		{name: "discrete between stops", ramp: discrete, height: 999, want: color.NRGBA{0, 100, 0, 255}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.ramp.Color(tt.height); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
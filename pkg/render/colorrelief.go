@@ -0,0 +1,24 @@
+package render
+
+import (
+	"image"
+)
+
+// ColorRelief colors each elevation in heights using the given ramp.
+func ColorRelief(heights *Heights, ramp *ColorRamp) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, heights.Width, heights.Height))
+
+	for i, h := range heights.Values {
+		c := ramp.NoData
+		if heights.Valid[i] {
+			c = ramp.Color(h)
+		}
+
+		dst.Pix[i*4] = c.R
+		dst.Pix[i*4+1] = c.G
+		dst.Pix[i*4+2] = c.B
+		dst.Pix[i*4+3] = c.A
+	}
+
+	return dst
+}
@@ -0,0 +1,74 @@
+package render
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Heights is a grid of decoded elevations in meters, stored row by row.
+type Heights struct {
+	Width, Height int
+	Values        []float64
+	// Valid marks the pixels that carried data. Pixels with an alpha of 0 in the source image are treated as nodata.
+	Valid []bool
+}
+
+func (h *Heights) At(x, y int) (float64, bool) {
+	i := y*h.Width + x
+	return h.Values[i], h.Valid[i]
+}
+
+// DecodeTerrarium converts a Terrarium encoded image into elevations.
+// See https://github.com/tilezen/joerd/blob/master/docs/formats.md#terrarium
+func DecodeTerrarium(img image.Image) *Heights {
+	return decodeElevations(img, func(r, g, b uint8) float64 {
+		return float64(r)*256 + float64(g) + float64(b)/256 - 32768
+	})
+}
+
+// DecodeMapbox converts a Mapbox Terrain-RGB encoded image into elevations.
+// See https://docs.mapbox.com/data/tilesets/reference/mapbox-terrain-rgb-v1/
+func DecodeMapbox(img image.Image) *Heights {
+	return decodeElevations(img, func(r, g, b uint8) float64 {
+		return (float64(r)*65536+float64(g)*256+float64(b))*0.1 - 10000
+	})
+}
+
+func decodeElevations(img image.Image, decode func(r, g, b uint8) float64) *Heights {
+	rgba := toRGBA(img)
+	bounds := rgba.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	heights := &Heights{
+		Width:  w,
+		Height: h,
+		Values: make([]float64, w*h),
+		Valid:  make([]bool, w*h),
+	}
+
+	for y := 0; y < h; y++ {
+		row := rgba.Pix[y*rgba.Stride : y*rgba.Stride+w*4]
+		for x := 0; x < w; x++ {
+			p := row[x*4 : x*4+4]
+			if p[3] == 0 {
+				continue
+			}
+
+			heights.Values[y*w+x] = decode(p[0], p[1], p[2])
+			heights.Valid[y*w+x] = true
+		}
+	}
+
+	return heights
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Bounds().Min == (image.Point{}) {
+		return rgba
+	}
+
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	return rgba
+}
@@ -0,0 +1,199 @@
+package render
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+type HillshadeMode string
+
+const (
+	// HillshadeMode_STANDARD lights the terrain from a single azimuth.
+	HillshadeMode_STANDARD = HillshadeMode("standard")
+	// HillshadeMode_MULTIDIRECTIONAL combines light from 225, 270, 315 and 360 degrees, weighting each by the aspect
+	// of the slope as described in https://pubs.usgs.gov/of/1992/of92-422/of92-422.pdf
+	HillshadeMode_MULTIDIRECTIONAL = HillshadeMode("multidirectional")
+	// HillshadeMode_IGOR only darkens slopes facing away from the light and leaves flat areas white, which makes it
+	// suitable to be drawn over other layers.
+	HillshadeMode_IGOR = HillshadeMode("igor")
+)
+
+type HillshadeOptions struct {
+	Mode HillshadeMode
+	// Azimuth is the direction of the light in degrees clockwise from north.
+	Azimuth float64
+	// Altitude is the angle of the light above the horizon in degrees.
+	Altitude float64
+	// ZFactor exaggerates the elevations before shading.
+	ZFactor float64
+}
+
+// DefaultHillshadeOptions matches the defaults of `gdaldem hillshade`.
+var DefaultHillshadeOptions = HillshadeOptions{
+	Mode:     HillshadeMode_STANDARD,
+	Azimuth:  315,
+	Altitude: 45,
+	ZFactor:  1,
+}
+
+func (o HillshadeOptions) Validate() error {
+	switch o.Mode {
+	case HillshadeMode_STANDARD, HillshadeMode_MULTIDIRECTIONAL, HillshadeMode_IGOR:
+	default:
+		return fmt.Errorf("unknown hillshade mode %s", o.Mode)
+	}
+
+	if o.Azimuth < 0 || o.Azimuth > 360 {
+		return fmt.Errorf("azimuth must be between 0 and 360")
+	}
+
+	if o.Altitude < 0 || o.Altitude > 90 {
+		return fmt.Errorf("altitude must be between 0 and 90")
+	}
+
+	if o.ZFactor <= 0 {
+		return fmt.Errorf("z factor must be positive")
+	}
+
+	return nil
+}
+
+// Hillshade computes the illumination of every pixel in heights as a value between 0 and 1. The slope at each pixel
+// is estimated from its 3x3 neighbourhood using Horn's method, with the neighbourhood clamped at the edges of the
+// grid, so callers that need seamless tiles should pass heights with a buffer around the area they keep. resolution
+// holds the ground size of a pixel in meters for each row. Pixels without data are reported as NaN.
+func Hillshade(heights *Heights, resolution []float64, opts HillshadeOptions) []float64 {
+	w, h := heights.Width, heights.Height
+	shade := make([]float64, w*h)
+
+	azimuth := opts.Azimuth * math.Pi / 180
+	altitude := opts.Altitude * math.Pi / 180
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			center, ok := heights.At(x, y)
+			if !ok {
+				shade[y*w+x] = math.NaN()
+				continue
+			}
+
+			at := func(dx, dy int) float64 {
+				nx, ny := clamp(x+dx, 0, w-1), clamp(y+dy, 0, h-1)
+				if v, ok := heights.At(nx, ny); ok {
+					return v
+				}
+				return center
+			}
+
+			a, b, c := at(-1, -1), at(0, -1), at(1, -1)
+			d, f := at(-1, 0), at(1, 0)
+			g, hh, i := at(-1, 1), at(0, 1), at(1, 1)
+
+			// Gradients towards the east and the north (rows grow towards the south)
+			scale := opts.ZFactor / (8 * resolution[y])
+			p := ((c + 2*f + i) - (a + 2*d + g)) * scale
+			q := ((a + 2*b + c) - (g + 2*hh + i)) * scale
+
+			switch opts.Mode {
+			case HillshadeMode_MULTIDIRECTIONAL:
+				// The four weights sum to 2
+				aspect := math.Atan2(-p, -q)
+				var sum float64
+				for _, deg := range []float64{225, 270, 315, 360} {
+					az := deg * math.Pi / 180
+					weight := math.Pow(math.Sin(aspect-az), 2)
+					sum += weight * illumination(p, q, az, altitude)
+				}
+				shade[y*w+x] = sum / 2
+			case HillshadeMode_IGOR:
+				slope := math.Atan(math.Hypot(p, q))
+				aspect := math.Atan2(-p, -q)
+				shade[y*w+x] = 1 - (slope/(math.Pi/2))*(angleBetween(aspect, azimuth)/math.Pi)
+			default:
+				shade[y*w+x] = illumination(p, q, azimuth, altitude)
+			}
+		}
+	}
+
+	return shade
+}
+
+// illumination is the cosine of the angle between the surface normal (-p, -q, 1) and the light.
+func illumination(p, q, azimuth, altitude float64) float64 {
+	lx := math.Sin(azimuth) * math.Cos(altitude)
+	ly := math.Cos(azimuth) * math.Cos(altitude)
+	lz := math.Sin(altitude)
+
+	v := (lz - p*lx - q*ly) / math.Sqrt(1+p*p+q*q)
+	return math.Max(0, v)
+}
+
+// angleBetween returns the absolute difference between two angles in radians, between 0 and Pi.
+func angleBetween(a, b float64) float64 {
+	d := math.Mod(math.Abs(a-b), 2*math.Pi)
+	if d > math.Pi {
+		d = 2*math.Pi - d
+	}
+	return d
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// ShadeImage converts hillshade values into a grayscale image. Pixels without data are transparent.
+func ShadeImage(shade []float64, width, height int) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	for i, s := range shade {
+		if math.IsNaN(s) {
+			continue
+		}
+
+		v := uint8(math.Round(s * 255))
+		dst.Pix[i*4] = v
+		dst.Pix[i*4+1] = v
+		dst.Pix[i*4+2] = v
+		dst.Pix[i*4+3] = 255
+	}
+
+	return dst
+}
+
+// BlendShade multiplies the colors of img by the hillshade. opacity controls how strongly the shading is applied,
+// from 0 (no shading) to 1 (full multiply).
+func BlendShade(img *image.NRGBA, shade []float64, opacity float64) *image.NRGBA {
+	dst := image.NewNRGBA(img.Bounds())
+
+	for i, s := range shade {
+		factor := 1.0
+		if !math.IsNaN(s) {
+			factor = 1 - opacity + opacity*s
+		}
+
+		c := color.NRGBA{R: img.Pix[i*4], G: img.Pix[i*4+1], B: img.Pix[i*4+2], A: img.Pix[i*4+3]}
+		dst.Pix[i*4] = uint8(math.Round(float64(c.R) * factor))
+		dst.Pix[i*4+1] = uint8(math.Round(float64(c.G) * factor))
+		dst.Pix[i*4+2] = uint8(math.Round(float64(c.B) * factor))
+		dst.Pix[i*4+3] = c.A
+	}
+
+	return dst
+}
+
+// GroundResolution returns the size in meters of a pixel at the given global pixel row of a web mercator world that is
+// worldSize pixels tall.
+func GroundResolution(globalY float64, worldSize float64) float64 {
+	const earthCircumference = 2 * math.Pi * 6378137
+
+	lat := math.Atan(math.Sinh(math.Pi * (1 - 2*globalY/worldSize)))
+	return earthCircumference * math.Cos(lat) / worldSize
+}
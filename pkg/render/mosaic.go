@@ -0,0 +1,151 @@
+package render
+
+import (
+	"image"
+	"math"
+)
+
+// MaskNodata marks the pixels whose elevation is nodata as invalid.
+func (h *Heights) MaskNodata(nodata float64) {
+	// Half the resolution of Terrarium, so that neighbouring values aren't masked
+	const tolerance = 1.0 / 512
+
+	for i, v := range h.Values {
+		if h.Valid[i] && math.Abs(v-nodata) < tolerance {
+			h.Valid[i] = false
+		}
+	}
+}
+
+// EncodeTerrarium converts elevations into a Terrarium encoded image. Invalid pixels are transparent.
+func EncodeTerrarium(h *Heights) *image.RGBA {
+	return encodeElevations(h, func(v float64) (uint8, uint8, uint8) {
+		v = math.Max(0, math.Min(v+32768, 65535+255.0/256))
+		whole := uint32(v)
+		return uint8(whole >> 8), uint8(whole), uint8((v - float64(whole)) * 256)
+	})
+}
+
+// EncodeMapbox converts elevations into a Mapbox Terrain-RGB encoded image. Invalid pixels are transparent.
+func EncodeMapbox(h *Heights) *image.RGBA {
+	return encodeElevations(h, func(v float64) (uint8, uint8, uint8) {
+		n := uint32(math.Max(0, math.Min(math.Round((v+10000)*10), 1<<24-1)))
+		return uint8(n >> 16), uint8(n >> 8), uint8(n)
+	})
+}
+
+func encodeElevations(h *Heights, encode func(v float64) (uint8, uint8, uint8)) *image.RGBA {
+	rgba := image.NewRGBA(image.Rect(0, 0, h.Width, h.Height))
+	for i, v := range h.Values {
+		if !h.Valid[i] {
+			continue
+		}
+
+		p := rgba.Pix[i*4 : i*4+4]
+		p[0], p[1], p[2] = encode(v)
+		p[3] = 255
+	}
+	return rgba
+}
+
+// MosaicElevations merges layers of the same size pixel by pixel. The first layer has the highest priority, and lower
+// layers show through where it's invalid. If feather is positive, each layer fades out over feather pixels towards
+// its invalid pixels instead of ending in a step.
+func MosaicElevations(layers []*Heights, feather int) *Heights {
+	w, h := layers[0].Width, layers[0].Height
+	mosaic := &Heights{
+		Width:  w,
+		Height: h,
+		Values: make([]float64, w*h),
+		Valid:  make([]bool, w*h),
+	}
+
+	// Layers are laid over each other from the lowest priority up
+	for l := len(layers) - 1; l >= 0; l-- {
+		layer := layers[l]
+
+		var distances []float64
+		if feather > 0 {
+			distances = distanceToInvalid(layer)
+		}
+
+		for i, v := range layer.Values {
+			if !layer.Valid[i] {
+				continue
+			}
+
+			weight := 1.0
+			if distances != nil && mosaic.Valid[i] {
+				weight = math.Min(distances[i]/float64(feather), 1)
+			}
+
+			mosaic.Values[i] = weight*v + (1-weight)*mosaic.Values[i]
+			mosaic.Valid[i] = true
+		}
+	}
+
+	return mosaic
+}
+
+// MosaicImages merges images of the same size pixel by pixel, taking each pixel from the first image where it isn't
+// transparent.
+func MosaicImages(layers []image.Image) *image.RGBA {
+	bounds := layers[0].Bounds()
+	mosaic := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+
+	for l := len(layers) - 1; l >= 0; l-- {
+		layer := toRGBA(layers[l])
+		for i := 0; i < len(layer.Pix); i += 4 {
+			if layer.Pix[i+3] != 0 {
+				copy(mosaic.Pix[i:i+4], layer.Pix[i:i+4])
+			}
+		}
+	}
+
+	return mosaic
+}
+
+// distanceToInvalid returns the distance in pixels from each pixel to the nearest invalid pixel, using a two pass
+// chamfer transform. Pixels past the edges count as valid, so layers don't fade out at the edge of the tile.
+func distanceToInvalid(h *Heights) []float64 {
+	const diagonal = math.Sqrt2
+
+	w, ht := h.Width, h.Height
+	d := make([]float64, w*ht)
+	for i, valid := range h.Valid {
+		if valid {
+			d[i] = math.Inf(1)
+		}
+	}
+
+	relax := func(i, x, y int, cost float64) {
+		if x < 0 || x >= w || y < 0 || y >= ht {
+			return
+		}
+		if v := d[y*w+x] + cost; v < d[i] {
+			d[i] = v
+		}
+	}
+
+	for y := 0; y < ht; y++ {
+		for x := 0; x < w; x++ {
+			i := y*w + x
+			relax(i, x-1, y, 1)
+			relax(i, x, y-1, 1)
+			relax(i, x-1, y-1, diagonal)
+			relax(i, x+1, y-1, diagonal)
+		}
+	}
+
+	for y := ht - 1; y >= 0; y-- {
+		for x := w - 1; x >= 0; x-- {
+			i := y*w + x
+			relax(i, x+1, y, 1)
+			relax(i, x, y+1, 1)
+			relax(i, x+1, y+1, diagonal)
+			relax(i, x-1, y+1, diagonal)
+		}
+	}
+
+	return d
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tilezen/go-zaloa/pkg/auth"
+	"github.com/tilezen/go-zaloa/pkg/common"
+	"github.com/tilezen/go-zaloa/pkg/fetcher"
+	"github.com/tilezen/go-zaloa/pkg/signing"
+)
+
+// ParseCacheMaxAge parses a comma separated list of version=duration pairs, like "v1=24h,v2=720h", into the
+// Cache-Control max-age to use for each version.
+func ParseCacheMaxAge(s string) (map[common.TileVersion]time.Duration, error) {
+	maxAges := map[common.TileVersion]time.Duration{}
+	if s == "" {
+		return maxAges, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		versionStr, durationStr, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("expected version=duration, got %s", pair)
+		}
+
+		version, ok := parseTileVersion(versionStr)
+		if !ok {
+			return nil, fmt.Errorf("unknown version %s", versionStr)
+		}
+
+		maxAge, err := time.ParseDuration(durationStr)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing max-age for %s: %w", versionStr, err)
+		}
+
+		maxAges[version] = maxAge
+	}
+
+	return maxAges, nil
+}
+
+// tileETag derives a strong ETag for a rendered tile from the ETags of its source tiles and the parameters used to
+// render it, including the debug overlay. It returns an empty string if any source tile came without an ETag.
+func tileETag(sources []*fetcher.FetchResponse, version string, tileset string, tileSize uint64, encoding common.TileEncoding, style *tileStyle, overlay bool) string {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%s/%s/%d/%s/%s\n", version, tileset, tileSize, encoding, style.key())
+	if overlay {
+		_, _ = fmt.Fprintf(h, "overlay\n")
+	}
+
+	for _, source := range sources {
+		if source.ETag == "" {
+			return ""
+		}
+		_, _ = fmt.Fprintf(h, "%s %s\n", source.Tile, source.ETag)
+	}
+
+	return fmt.Sprintf(`"%x"`, h.Sum(nil)[:16])
+}
+
+// etagMatches implements the weak comparison used for If-None-Match.
+// See https://www.rfc-editor.org/rfc/rfc9110#name-if-none-match
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setCacheHeaders sets the ETag and Cache-Control headers of a tile. Tiles served to an API key are private, so that
+// a shared cache in front of Zaloa doesn't hand them out to clients without a key, and their quota headers stay
+// accurate. Tiles served for a signed URL aren't cached past the signature's expiry.
+func (z zaloaService) setCacheHeaders(ctx context.Context, writer http.ResponseWriter, req *tileRequest, etag string) {
+	if etag != "" {
+		writer.Header().Set("ETag", etag)
+	}
+
+	if req.overlay {
+		// Debug overlays aren't meant to be kept by anyone
+		writer.Header().Set("Cache-Control", "no-store")
+		return
+	}
+
+	scope := "public"
+	if auth.KeyFromContext(ctx) != nil {
+		scope = "private"
+	}
+
+	maxAge, ok := z.cacheMaxAge[req.version]
+	if claims := signing.ClaimsFromContext(ctx); ok && claims != nil {
+		maxAge = min(maxAge, max(time.Until(claims.Expires), 0))
+	}
+
+	switch {
+	case ok:
+		// Tiles never change within a version
+		writer.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d, immutable", scope, int(maxAge.Seconds())))
+	case scope == "private":
+		writer.Header().Set("Cache-Control", scope)
+	}
+}
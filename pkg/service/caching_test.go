@@ -0,0 +1,250 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/tilezen/go-zaloa/pkg/cache"
+	"github.com/tilezen/go-zaloa/pkg/common"
+	"github.com/tilezen/go-zaloa/pkg/fetcher"
+)
+
+func TestEtagMatches(t *testing.T) {
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		etag        string
+		want        bool
+	}{
+		{name: "no header", ifNoneMatch: "", etag: `"a"`, want: false},
+		{name: "same", ifNoneMatch: `"a"`, etag: `"a"`, want: true},
+		{name: "different", ifNoneMatch: `"b"`, etag: `"a"`, want: false},
+		{name: "weak", ifNoneMatch: `W/"a"`, etag: `"a"`, want: true},
+		{name: "list", ifNoneMatch: `"b", "a"`, etag: `"a"`, want: true},
+		{name: "list without match", ifNoneMatch: `"b","c"`, etag: `"a"`, want: false},
+		{name: "any", ifNoneMatch: `*`, etag: `"a"`, want: true},
+		{name: "unquoted", ifNoneMatch: `a`, etag: `"a"`, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := etagMatches(tt.ifNoneMatch, tt.etag); got != tt.want {
+				t.Errorf("etagMatches(%q, %q) = %v, expected %v", tt.ifNoneMatch, tt.etag, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTileETag(t *testing.T) {
+	sources := func(etags ...string) []*fetcher.FetchResponse {
+		responses := make([]*fetcher.FetchResponse, len(etags))
+		for i, etag := range etags {
+			responses[i] = &fetcher.FetchResponse{Tile: common.Tile{Z: 1, X: uint(i)}, ETag: etag}
+		}
+		return responses
+	}
+	base := tileETag(sources(`"a"`, `"b"`), "v1", "terrarium", 512, common.TileEncoding_PNG, nil, false)
+
+	tests := []struct {
+		name string
+		etag string
+		same bool
+	}{
+		{name: "same sources", etag: tileETag(sources(`"a"`, `"b"`), "v1", "terrarium", 512, common.TileEncoding_PNG, nil, false), same: true},
+		{name: "changed source", etag: tileETag(sources(`"a"`, `"c"`), "v1", "terrarium", 512, common.TileEncoding_PNG, nil, false)},
+		{name: "version", etag: tileETag(sources(`"a"`, `"b"`), "v2", "terrarium", 512, common.TileEncoding_PNG, nil, false)},
+		{name: "tileset", etag: tileETag(sources(`"a"`, `"b"`), "v1", "hillshade", 512, common.TileEncoding_PNG, nil, false)},
+		{name: "size", etag: tileETag(sources(`"a"`, `"b"`), "v1", "terrarium", 516, common.TileEncoding_PNG, nil, false)},
+		{name: "format", etag: tileETag(sources(`"a"`, `"b"`), "v1", "terrarium", 512, common.TileEncoding_WEBP, nil, false)},
+		{name: "overlay", etag: tileETag(sources(`"a"`, `"b"`), "v1", "terrarium", 512, common.TileEncoding_PNG, nil, true)},
+	}
+
+	if base == "" || base[0] != '"' || base[len(base)-1] != '"' {
+		t.Fatalf("expected a quoted ETag, got %s", base)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if (tt.etag == base) != tt.same {
+				t.Errorf("expected the ETag to be the same: %v, got %s and %s", tt.same, tt.etag, base)
+			}
+		})
+	}
+
+	if etag := tileETag(sources(`"a"`, ""), "v1", "terrarium", 512, common.TileEncoding_PNG, nil, false); etag != "" {
+		t.Errorf("expected no ETag when a source has none, got %s", etag)
+	}
+}
+
+func TestParseCacheMaxAge(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[common.TileVersion]time.Duration
+		wantErr bool
+	}{
+		{value: "", want: map[common.TileVersion]time.Duration{}},
+		{value: "v1=24h, v2=720h", want: map[common.TileVersion]time.Duration{common.TileVersion_V1: 24 * time.Hour, common.TileVersion_V2: 720 * time.Hour}},
+		{value: "v1", wantErr: true},
+		{value: "v3=1h", wantErr: true},
+		{value: "v1=forever", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseCacheMaxAge(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+type notFoundFetcher struct{}
+
+func (notFoundFetcher) GetTile(context.Context, common.Tile, common.TileKind, common.TileVersion) (*fetcher.FetchResponse, error) {
+	return nil, fetcher.ErrNotFound
+}
+
+func TestTileContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		fetcher     fetcher.TileFetcher
+		status      int
+		contentType string
+	}{
+		{name: "tile", fetcher: stubFetcher{data: testTileData(t)}, status: http.StatusOK, contentType: "image/png"},
+		{name: "missing tile", fetcher: notFoundFetcher{}, status: http.StatusNotFound, contentType: "text/plain; charset=utf-8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A real server is needed for the content type of the plain text errors to be sniffed
+			router := mux.NewRouter()
+			router.HandleFunc("/tilezen/terrain/{version}/{tilesize}/{tileset}/{z}/{x}/{y}.{fmt}", NewZaloaService(tt.fetcher).GetTileHandler())
+			server := httptest.NewServer(router)
+			defer server.Close()
+
+			resp, err := http.Get(server.URL + "/tilezen/terrain/v1/256/terrarium/1/0/0.png")
+			if err != nil {
+				t.Fatalf("error requesting tile: %v", err)
+			}
+			_ = resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+			if got := resp.Header.Get("Content-Type"); got != tt.contentType {
+				t.Errorf("expected content type %s, got %s", tt.contentType, got)
+			}
+		})
+	}
+}
+
+type etagFetcher struct {
+	data []byte
+}
+
+func (e etagFetcher) GetTile(_ context.Context, t common.Tile, _ common.TileKind, _ common.TileVersion) (*fetcher.FetchResponse, error) {
+	return &fetcher.FetchResponse{Data: e.data, Tile: t, ETag: fmt.Sprintf(`"%s"`, t)}, nil
+}
+
+func TestConditionalTileRequest(t *testing.T) {
+	getSpans := setupTestTracing(t)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/tilezen/terrain/{version}/{tilesize}/{tileset}/{z}/{x}/{y}.{fmt}", NewZaloaService(etagFetcher{data: testTileData(t)}).GetTileHandler())
+	server := httptest.NewServer(router)
+	defer server.Close()
+	url := server.URL + "/tilezen/terrain/v1/512/terrarium/1/0/0.png"
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("error requesting tile: %v", err)
+	}
+	_ = resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatalf("expected an ETag")
+	}
+	rendered := len(spansNamed(getSpans(), "EncodeTile"))
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		status      int
+		rendered    int
+	}{
+		{name: "matching", ifNoneMatch: etag, status: http.StatusNotModified},
+		{name: "stale", ifNoneMatch: `"stale"`, status: http.StatusOK, rendered: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, _ := http.NewRequest(http.MethodGet, url, nil)
+			request.Header.Set("If-None-Match", tt.ifNoneMatch)
+			resp, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatalf("error requesting tile: %v", err)
+			}
+			_ = resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+			if resp.Header.Get("ETag") != etag {
+				t.Errorf("expected ETag %s, got %s", etag, resp.Header.Get("ETag"))
+			}
+			// A matching request is answered from the source ETags, without decoding or encoding anything
+			spans := getSpans()
+			if got := len(spansNamed(spans, "EncodeTile")) - rendered; got != tt.rendered {
+				t.Errorf("expected %d renders, got %d", tt.rendered, got)
+			}
+			rendered = len(spansNamed(spans, "EncodeTile"))
+		})
+	}
+}
+
+type sourceFetcher struct {
+	data []byte
+}
+
+func (s sourceFetcher) GetTile(_ context.Context, t common.Tile, _ common.TileKind, _ common.TileVersion) (*fetcher.FetchResponse, error) {
+	return &fetcher.FetchResponse{Data: s.data, Tile: t, Source: "national"}, nil
+}
+
+func TestCachedTileSource(t *testing.T) {
+	router := mux.NewRouter()
+	z := NewZaloaService(sourceFetcher{data: testTileData(t)}, WithRenderCache(cache.NewDiskCache(t.TempDir())))
+	router.HandleFunc("/tilezen/terrain/{version}/{tilesize}/{tileset}/{z}/{x}/{y}.{fmt}", z.GetTileHandler())
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	for _, status := range []string{"miss", "hit"} {
+		resp, err := http.Get(server.URL + "/tilezen/terrain/v1/256/terrarium/1/0/0.png")
+		if err != nil {
+			t.Fatalf("error requesting tile: %v", err)
+		}
+		_ = resp.Body.Close()
+
+		if got := resp.Header.Get("X-Zaloa-Cache"); got != status {
+			t.Errorf("expected a cache %s, got %s", status, got)
+		}
+		if got := resp.Header.Get("X-Zaloa-Source"); got != "national" {
+			t.Errorf("expected the source on a cache %s, got %q", status, got)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/tilezen/go-zaloa/pkg/admission"
+	"github.com/tilezen/go-zaloa/pkg/cache"
+	"github.com/tilezen/go-zaloa/pkg/common"
+	"github.com/tilezen/go-zaloa/pkg/fetcher"
+	"github.com/tilezen/go-zaloa/pkg/logging"
+	"github.com/tilezen/go-zaloa/pkg/metrics"
+	"github.com/tilezen/go-zaloa/pkg/render"
+	"github.com/tilezen/go-zaloa/pkg/tilesets"
+)
+
+// Option configures optional behaviour of the ZaloaService.
+type Option func(*zaloaService)
+
+// WithColorRamps sets the color ramps that can be selected with the `ramp` query parameter on the color-relief
+// tileset. A ramp named "default" replaces the built-in default ramp.
+func WithColorRamps(ramps map[string]*render.ColorRamp) Option {
+	return func(z *zaloaService) {
+		z.colorRamps = ramps
+	}
+}
+
+// WithMetrics reports request, stage and in-flight measurements to recorder.
+func WithMetrics(recorder metrics.Recorder) Option {
+	return func(z *zaloaService) {
+		z.metrics = recorder
+	}
+}
+
+// WithLogger sets the logger used for access and application logs.
+func WithLogger(logger *slog.Logger) Option {
+	return func(z *zaloaService) {
+		z.logger = logging.WithContext(logger)
+	}
+}
+
+// WithCacheMaxAge sets the Cache-Control max-age sent with the tiles of each version. Versions without an entry get
+// no Cache-Control header.
+func WithCacheMaxAge(maxAges map[common.TileVersion]time.Duration) Option {
+	return func(z *zaloaService) {
+		z.cacheMaxAge = maxAges
+	}
+}
+
+// WithRenderLimiter bounds the number of tiles that are rendered at once, rather than served from the render cache,
+// with limiter. Concurrent requests for the same tile share a render and a slot. Requests for renders that don't fit in
+// its queue get a 503.
+func WithRenderLimiter(limiter *admission.Limiter) Option {
+	return func(z *zaloaService) {
+		z.renderLimiter = limiter
+	}
+}
+
+// WithRenderCache stores encoded tiles in c so that repeated requests for a tile skip fetching and rendering.
+func WithRenderCache(c cache.Cache) Option {
+	return func(z *zaloaService) {
+		z.renderCache = c
+	}
+}
+
+// WithTilesets replaces the Tilezen tilesets with the tilesets in registry. Tilesets that don't use the default fetcher
+// are fetched with the fetcher of that name in fetchers.
+func WithTilesets(registry *tilesets.Registry, fetchers map[string]fetcher.TileFetcher) Option {
+	return func(z *zaloaService) {
+		z.tilesets = registry
+		z.fetchers = fetchers
+	}
+}
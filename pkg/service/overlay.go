@@ -0,0 +1,90 @@
+package service
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+var (
+	overlaySourceColor  = color.NRGBA{R: 0, G: 255, B: 0, A: 255}
+	overlayWrappedColor = color.NRGBA{R: 0, G: 160, B: 255, A: 255}
+	overlayClampedColor = color.NRGBA{R: 255, G: 0, B: 0, A: 255}
+	overlayBufferColor  = color.NRGBA{R: 255, G: 255, B: 0, A: 96}
+	overlayLabelColor   = color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	overlayLabelBack    = color.NRGBA{R: 0, G: 0, B: 0, A: 160}
+)
+
+// drawOverlay draws the outline and z/x/y of each source tile over a rendered tile, and highlights the buffer strips of
+// 260 and 516 tiles. Wrapped tiles are outlined in blue and clamped tiles in red.
+func (z zaloaService) drawOverlay(img image.Image, req *tileRequest) image.Image {
+	dst := image.NewNRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	if req.tileSize == 260 || req.tileSize == 516 {
+		inner := dst.Bounds().Inset(hillshadeBuffer)
+		for _, strip := range []image.Rectangle{
+			image.Rect(0, 0, dst.Bounds().Dx(), inner.Min.Y),
+			image.Rect(0, inner.Max.Y, dst.Bounds().Dx(), dst.Bounds().Dy()),
+			image.Rect(0, inner.Min.Y, inner.Min.X, inner.Max.Y),
+			image.Rect(inner.Max.X, inner.Min.Y, dst.Bounds().Dx(), inner.Max.Y),
+		} {
+			draw.Draw(dst, strip, image.NewUniform(overlayBufferColor), image.Point{}, draw.Over)
+		}
+	}
+
+	// Hillshaded tiles are stitched with a buffer that's cropped off after rendering
+	plan, _ := z.planTile(req)
+	offset := int(plan.FetchSize-plan.TileSize) / 2
+
+	face := basicfont.Face7x13
+	for _, piece := range plan.Pieces {
+		crop := image.Rect(piece.Crop.MinX, piece.Crop.MinY, piece.Crop.MaxX, piece.Crop.MaxY)
+		placed := crop.Sub(crop.Min).Add(image.Pt(piece.Location[0]-offset, piece.Location[1]-offset))
+		placed = placed.Intersect(dst.Bounds())
+		if placed.Empty() {
+			continue
+		}
+
+		outline := overlaySourceColor
+		label := piece.Tile
+		if piece.Wrapped {
+			outline = overlayWrappedColor
+			label += " wrapped"
+		}
+		if piece.Clamped {
+			outline = overlayClampedColor
+			label += " clamped"
+		}
+		drawOutline(dst, placed, outline)
+
+		// Buffer strips are too thin to label
+		width := font.MeasureString(face, label).Ceil()
+		if placed.Dx() < width+8 || placed.Dy() < face.Height+8 {
+			continue
+		}
+		labelRect := image.Rect(placed.Min.X+3, placed.Min.Y+3, placed.Min.X+width+5, placed.Min.Y+face.Height+5)
+		draw.Draw(dst, labelRect, image.NewUniform(overlayLabelBack), image.Point{}, draw.Over)
+		drawer := &font.Drawer{
+			Dst:  dst,
+			Src:  image.NewUniform(overlayLabelColor),
+			Face: face,
+			Dot:  fixed.P(labelRect.Min.X+1, labelRect.Min.Y+face.Ascent+1),
+		}
+		drawer.DrawString(label)
+	}
+
+	return dst
+}
+
+func drawOutline(dst draw.Image, r image.Rectangle, c color.Color) {
+	src := image.NewUniform(c)
+	draw.Draw(dst, image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+1), src, image.Point{}, draw.Src)
+	draw.Draw(dst, image.Rect(r.Min.X, r.Max.Y-1, r.Max.X, r.Max.Y), src, image.Point{}, draw.Src)
+	draw.Draw(dst, image.Rect(r.Min.X, r.Min.Y, r.Min.X+1, r.Max.Y), src, image.Point{}, draw.Src)
+	draw.Draw(dst, image.Rect(r.Max.X-1, r.Min.Y, r.Max.X, r.Max.Y), src, image.Point{}, draw.Src)
+}
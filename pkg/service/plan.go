@@ -0,0 +1,195 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"image"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/tilezen/go-zaloa/pkg/common"
+	"github.com/tilezen/go-zaloa/pkg/fetcher"
+)
+
+// TilePlan describes how a tile is put together from source tiles.
+type TilePlan struct {
+	Tile     string `json:"tile"`
+	Tileset  string `json:"tileset"`
+	TileSize uint64 `json:"tileSize"`
+	// FetchSize is the size of the stitched image, which is bigger than TileSize when rendering needs a buffer
+	FetchSize uint64      `json:"fetchSize"`
+	Format    string      `json:"format"`
+	Key       string      `json:"key"`
+	Pieces    []PlanPiece `json:"pieces"`
+}
+
+// PlanPiece is one source tile, the part of it that's used and where it goes in the stitched image.
+type PlanPiece struct {
+	Tile     string   `json:"tile"`
+	Crop     PlanRect `json:"crop"`
+	Location [2]int   `json:"location"`
+	// Wrapped is set when the neighbour past the antimeridian was replaced by the tile on the other side of the world
+	Wrapped bool `json:"wrapped,omitempty"`
+	// Clamped is set when the neighbour past the top or bottom of the world was replaced by the edge tile
+	Clamped bool `json:"clamped,omitempty"`
+	// Source is where the tile is fetched from, if the fetcher can tell
+	Source string `json:"source,omitempty"`
+	// The fetch is only reported by the debug plan handler
+	FetchMillis float64 `json:"fetchMs,omitempty"`
+	Bytes       int     `json:"bytes,omitempty"`
+	Error       string  `json:"error,omitempty"`
+	// ServedBy names the source of a composite fetcher the tile was fetched from
+	ServedBy string `json:"servedBy,omitempty"`
+}
+
+type PlanRect struct {
+	MinX int `json:"minX"`
+	MinY int `json:"minY"`
+	MaxX int `json:"maxX"`
+	MaxY int `json:"maxY"`
+}
+
+func planRect(r image.Rectangle) PlanRect {
+	return PlanRect{MinX: r.Min.X, MinY: r.Min.Y, MaxX: r.Max.X, MaxY: r.Max.Y}
+}
+
+// PlanTile returns the source tiles that would be fetched to render the tile, without fetching anything.
+func (z zaloaService) PlanTile(params TileParams) (*TilePlan, error) {
+	req, err := z.newTileRequest(params)
+	if err != nil {
+		return nil, err
+	}
+
+	plan, _ := z.planTile(req)
+	return plan, nil
+}
+
+func (z zaloaService) planTile(req *tileRequest) (*TilePlan, []instruction) {
+	fetchSize := req.style.fetchSize(req.tileSize)
+	plan := &TilePlan{
+		Tile:      req.tile.String(),
+		Tileset:   req.tilesetName,
+		TileSize:  req.tileSize,
+		FetchSize: fetchSize,
+		Format:    string(req.encoding),
+		Key:       req.key(),
+	}
+
+	// The 512 and 516 tiles are stitched from the tiles of the next zoom
+	base := req.tile
+	if fetchSize == 512 || fetchSize == 516 {
+		base = common.Tile{Z: req.tile.Z + 1, X: req.tile.X * 2, Y: req.tile.Y * 2}
+	}
+	buffer := 0
+	if fetchSize == 260 || fetchSize == 516 {
+		buffer = hillshadeBuffer
+	}
+	n := 1 << base.Z
+
+	locator, _ := req.fetcher.(fetcher.Locator)
+	instructions := generateInstructions(req.tile, fetchSize)
+	for _, inst := range instructions {
+		// Work out which tile would be here if the world went on forever, to see if it was wrapped or clamped
+		wantX := int(base.X) + floorDiv(inst.spec.Location.X-buffer, 256)
+		wantY := int(base.Y) + floorDiv(inst.spec.Location.Y-buffer, 256)
+
+		piece := PlanPiece{
+			Tile:     inst.tileToFetch.String(),
+			Crop:     planRect(inst.spec.Crop),
+			Location: [2]int{inst.spec.Location.X, inst.spec.Location.Y},
+			Wrapped:  wantX < 0 || wantX >= n,
+			Clamped:  wantY < 0 || wantY >= n,
+		}
+		if locator != nil {
+			piece.Source = locator.Locate(inst.tileToFetch, req.tileset, req.version)
+		}
+		plan.Pieces = append(plan.Pieces, piece)
+	}
+
+	return plan, instructions
+}
+
+func floorDiv(a int, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// GetDebugPlanHandler explains how a tile is built: the source tiles, where they're fetched from, how they're cropped
+// and placed, and which were wrapped or clamped at the edges of the world. Each source tile is fetched to report its
+// latency and size. It takes the same path variables as the tile handler.
+func (z zaloaService) GetDebugPlanHandler() func(http.ResponseWriter, *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		vars := mux.Vars(request)
+
+		tileSize := uint64(256)
+		if vars["tilesize"] != "" {
+			var err error
+			tileSize, err = strconv.ParseUint(vars["tilesize"], 10, 32)
+			if err != nil {
+				writer.WriteHeader(http.StatusNotFound)
+				_, _ = writer.Write([]byte("Invalid tilesize"))
+				return
+			}
+		}
+
+		parsedTile, err := common.ParseTile(vars["z"], vars["x"], vars["y"])
+		if err != nil {
+			writer.WriteHeader(http.StatusNotFound)
+			_, _ = writer.Write([]byte("Invalid Tile coordinate"))
+			return
+		}
+
+		req, err := z.newTileRequest(TileParams{
+			Version:  vars["version"],
+			Tileset:  vars["tileset"],
+			TileSize: tileSize,
+			Format:   vars["fmt"],
+			Tile:     *parsedTile,
+			Query:    request.URL.Query(),
+		})
+		if err != nil {
+			invalid := &invalidRequestError{status: http.StatusBadRequest, message: err.Error()}
+			errors.As(err, &invalid)
+			writer.WriteHeader(invalid.status)
+			_, _ = writer.Write([]byte(invalid.message))
+			return
+		}
+
+		plan, instructions := z.planTile(req)
+
+		wg := sync.WaitGroup{}
+		for i, inst := range instructions {
+			i, inst := i, inst
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				piece := &plan.Pieces[i]
+
+				start := time.Now()
+				resp, err := req.fetcher.GetTile(ctx, inst.tileToFetch, req.tileset, req.version)
+				piece.FetchMillis = float64(time.Since(start).Microseconds()) / 1000
+				if err != nil {
+					piece.Error = err.Error()
+					return
+				}
+				piece.Bytes = len(resp.Data)
+				piece.ServedBy = resp.Source
+			}()
+		}
+		wg.Wait()
+
+		writer.Header().Set("content-type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(plan)
+	}
+}
@@ -0,0 +1,296 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tilezen/go-zaloa/pkg/cache"
+	"github.com/tilezen/go-zaloa/pkg/common"
+	"github.com/tilezen/go-zaloa/pkg/fetcher"
+	"github.com/tilezen/go-zaloa/pkg/metrics"
+	"github.com/tilezen/go-zaloa/pkg/tilesets"
+)
+
+// TileParams describes a tile to render, with the same values as the tile URLs.
+type TileParams struct {
+	Version  string
+	Tileset  string
+	TileSize uint64
+	Format   string
+	Tile     common.Tile
+	// Query holds the style parameters, like ramp or azimuth
+	Query url.Values
+}
+
+// contentTypes maps each encoding to the content-type it's served with.
+var contentTypes = map[common.TileEncoding]string{
+	common.TileEncoding_PNG:  "image/png",
+	common.TileEncoding_WEBP: "image/webp",
+}
+
+// ErrInvalidTileParams is wrapped by the errors returned for tile parameters that can't be rendered.
+var ErrInvalidTileParams = errors.New("invalid tile parameters")
+
+// invalidRequestError is returned for tile parameters that can't be rendered, with the response to send for them.
+type invalidRequestError struct {
+	status  int
+	message string
+}
+
+func (e *invalidRequestError) Error() string {
+	return e.message
+}
+
+func (e *invalidRequestError) Unwrap() error {
+	return ErrInvalidTileParams
+}
+
+// tileRequest is a validated request for a rendered tile.
+type tileRequest struct {
+	tile     common.Tile
+	tileSize uint64
+	version  common.TileVersion
+	// versionName is the version as it appears in the URL, which is empty for v1 in common.TileVersion
+	versionName string
+	// tileset is the kind of the source tiles, fetched with fetcher
+	tileset common.TileKind
+	fetcher fetcher.TileFetcher
+	// sourceEncoding is how the source tiles are encoded
+	sourceEncoding tilesets.Encoding
+	// tilesetName is the requested tileset, which may be a style rendered from tileset
+	tilesetName string
+	encoding    common.TileEncoding
+	style       *tileStyle
+	// overlay draws the source tile boundaries over the tile, for debugging
+	overlay bool
+}
+
+func (z zaloaService) newTileRequest(params TileParams) (*tileRequest, error) {
+	version, ok := parseTileVersion(params.Version)
+	if !ok {
+		return nil, &invalidRequestError{status: http.StatusNotFound, message: "Invalid version"}
+	}
+
+	tileset, ok := z.tilesets.Get(params.Tileset)
+	if !ok {
+		return nil, &invalidRequestError{status: http.StatusNotFound, message: "Invalid tileset"}
+	}
+
+	tileFetcher, ok := z.tilesetFetcher(tileset)
+	if !ok {
+		return nil, fmt.Errorf("no fetcher %s for tileset %s", tileset.Fetcher, tileset.Name)
+	}
+
+	var style *tileStyle
+	if tileset.Render != "" {
+		var err error
+		style, err = z.parseStyle(tileset, params.Query)
+		if err != nil {
+			return nil, &invalidRequestError{status: http.StatusBadRequest, message: fmt.Sprintf("Invalid style: %s", err)}
+		}
+	}
+
+	tileEncoding := common.TileEncoding(params.Format)
+	if !tileset.AllowsFormat(tileEncoding) {
+		return nil, &invalidRequestError{status: http.StatusNotFound, message: "Invalid format"}
+	}
+
+	if !tileset.AllowsSize(params.TileSize) {
+		return nil, &invalidRequestError{status: http.StatusNotFound, message: "Invalid tilesize"}
+	}
+
+	if params.Tile.Z < tileset.MinTileZoom(params.TileSize) || params.Tile.Z > tileset.MaxTileZoom(params.TileSize) {
+		return nil, &invalidRequestError{status: http.StatusNotFound, message: "Invalid zoom"}
+	}
+
+	var overlay bool
+	switch params.Query.Get("debug") {
+	case "":
+	case "overlay":
+		overlay = true
+	default:
+		return nil, &invalidRequestError{status: http.StatusBadRequest, message: "Invalid debug option"}
+	}
+
+	return &tileRequest{
+		tile:        params.Tile,
+		tileSize:    params.TileSize,
+		version:     version,
+		versionName: params.Version,
+		tileset:     tileset.Kind,
+		fetcher:     tileFetcher,
+		tilesetName: params.Tileset,
+		encoding:    tileEncoding,
+		style:       style,
+		overlay:     overlay,
+
+		sourceEncoding: tileset.Encoding,
+	}, nil
+}
+
+// key identifies the rendered tile. Two requests with the same key produce the same bytes as long as the source tiles
+// don't change.
+func (r *tileRequest) key() string {
+	key := fmt.Sprintf("%s/%s/%d/%s", r.versionName, r.tilesetName, r.tileSize, r.tile)
+	if styleKey := r.style.key(); styleKey != "" {
+		sum := sha256.Sum256([]byte(styleKey))
+		key += "@" + hex.EncodeToString(sum[:8])
+	}
+	if r.overlay {
+		key += "+overlay"
+	}
+	return key + "." + string(r.encoding)
+}
+
+// generateInstructions returns the source tiles to fetch and how to place them to build a stitched tile of the given
+// size, or nil for an unsupported size.
+func generateInstructions(t common.Tile, size uint64) []instruction {
+	switch size {
+	case 256:
+		return generate256Instructions(t)
+	case 260:
+		return generate260Instructions(t)
+	case 512:
+		return generate512Instructions(t)
+	case 516:
+		return generate516Instructions(t)
+	default:
+		return nil
+	}
+}
+
+// getCachedTile looks up a rendered tile. It returns nil when there's no render cache or the tile isn't in it. Debug
+// overlays are never cached.
+func (z zaloaService) getCachedTile(ctx context.Context, req *tileRequest) (*cache.Entry, error) {
+	if z.renderCache == nil || req.overlay {
+		return nil, nil
+	}
+	return z.renderCache.Get(ctx, req.key())
+}
+
+func (z zaloaService) RenderTile(ctx context.Context, params TileParams) (*cache.Entry, error) {
+	req, err := z.newTileRequest(params)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := z.getCachedTile(ctx, req)
+	if err != nil {
+		z.logger.WarnContext(ctx, "error reading render cache", "key", req.key(), "error", err)
+	}
+	if entry != nil {
+		return entry, nil
+	}
+
+	return z.renderShared(ctx, req, nil)
+}
+
+// renderShared renders req once for all the concurrent callers asking for the same tile. The render carries on if the
+// caller that started it goes away while others are still waiting for it, and is cancelled once they all have. With a
+// render limiter, the render holds a single slot however many callers share it, and returns admission.ErrQueueFull if
+// it can't wait for one. sources are the source tiles if the caller already fetched them, or nil.
+func (z zaloaService) renderShared(ctx context.Context, req *tileRequest, sources []*fetcher.FetchResponse) (*cache.Entry, error) {
+	shared, err := z.renderCalls.do(ctx, req.key(), func(ctx context.Context) (interface{}, error) {
+		if z.renderLimiter != nil {
+			release, err := z.renderLimiter.Acquire(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error waiting to render: %w", err)
+			}
+			defer release()
+		}
+
+		return z.renderTile(ctx, req, sources)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return shared.(*cache.Entry), nil
+}
+
+// fetchShared fetches the source tiles of req once for all the concurrent callers that need them, which is enough for
+// conditional requests to be answered without rendering anything. Like renders, the fetches are cancelled once no
+// callers are left waiting for them.
+func (z zaloaService) fetchShared(ctx context.Context, req *tileRequest) ([]*fetcher.FetchResponse, error) {
+	fetchSize := req.style.fetchSize(req.tileSize)
+	key := fmt.Sprintf("%s/%s/%d/%s", req.versionName, req.tilesetName, fetchSize, req.tile)
+	shared, err := z.fetchCalls.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		instructions := generateInstructions(req.tile, fetchSize)
+		if instructions == nil {
+			return nil, fmt.Errorf("unsupported tile size %d", fetchSize)
+		}
+
+		sources, err := z.FetchTiles(ctx, req.fetcher, req.tileset, req.version, instructions)
+		if err != nil {
+			return nil, fmt.Errorf("error during FetchTiles: %w", err)
+		}
+		return sources, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return shared.([]*fetcher.FetchResponse), nil
+}
+
+// renderTile renders and encodes the tile for req from its source tiles, which it fetches if sources is nil, and stores
+// the result in the render cache.
+func (z zaloaService) renderTile(ctx context.Context, req *tileRequest, sources []*fetcher.FetchResponse) (*cache.Entry, error) {
+	if sources == nil {
+		var err error
+		sources, err = z.fetchShared(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	etag := tileETag(sources, req.versionName, req.tilesetName, req.tileSize, req.encoding, req.style, req.overlay)
+
+	fetchSize := req.style.fetchSize(req.tileSize)
+	tileImage, err := z.ProcessTile(ctx, int(fetchSize), sources, req.sourceEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("error during ProcessTile: %w", err)
+	}
+
+	if req.style != nil {
+		styleStart := time.Now()
+		tileImage = req.style.render(tileImage, req.tile, int(req.tileSize))
+		z.metrics.ObserveStage(metrics.Stage_STYLE, time.Since(styleStart))
+	}
+
+	if req.overlay {
+		tileImage = z.drawOverlay(tileImage, req)
+	}
+
+	tileData, err := z.EncodeTile(ctx, tileImage, req.encoding)
+	if err != nil {
+		return nil, fmt.Errorf("error during EncodeTile: %w", err)
+	}
+
+	entry := &cache.Entry{Data: tileData, ETag: etag, Source: tileSource(sources)}
+	if z.renderCache != nil && !req.overlay {
+		if err := z.renderCache.Set(ctx, req.key(), entry); err != nil {
+			z.logger.WarnContext(ctx, "error writing render cache", "key", req.key(), "error", err)
+		}
+	}
+
+	return entry, nil
+}
+
+// tileSource lists the sources the source tiles came from, in the order they're first used.
+func tileSource(sources []*fetcher.FetchResponse) string {
+	var names []string
+	for _, s := range sources {
+		if s.Source == "" || slices.Contains(names, s.Source) {
+			continue
+		}
+		names = append(names, s.Source)
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"context"
+	"sync"
+)
+
+// sharedCall is a call that concurrent callers with the same key wait for together.
+type sharedCall struct {
+	// waiters is the number of callers still waiting for the call
+	waiters int
+	cancel  context.CancelFunc
+	done    chan struct{}
+	value   interface{}
+	err     error
+}
+
+// sharedCalls runs a function once for all the concurrent callers asking for the same key, like singleflight, but
+// cancels it once every caller waiting for it has gone away.
+type sharedCalls struct {
+	mu    sync.Mutex
+	calls map[string]*sharedCall
+}
+
+func newSharedCalls() *sharedCalls {
+	return &sharedCalls{calls: map[string]*sharedCall{}}
+}
+
+// do runs fn, or waits for the call of another caller with the same key, until ctx is done. fn gets a context with the
+// values of the caller that started the call, which is cancelled when no callers are left waiting.
+func (s *sharedCalls) do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	s.mu.Lock()
+	call, ok := s.calls[key]
+	if !ok {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &sharedCall{cancel: cancel, done: make(chan struct{})}
+		s.calls[key] = call
+
+		go func() {
+			call.value, call.err = fn(callCtx)
+			s.forget(key, call)
+			cancel()
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	s.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		s.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// Later callers start a new call rather than wait for this cancelled one
+			call.cancel()
+			s.forgetLocked(key, call)
+		}
+		s.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (s *sharedCalls) forget(key string, call *sharedCall) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forgetLocked(key, call)
+}
+
+// forgetLocked removes call if it's still the call for key. It must be called with mu held.
+func (s *sharedCalls) forgetLocked(key string, call *sharedCall) {
+	if s.calls[key] == call {
+		delete(s.calls, key)
+	}
+}
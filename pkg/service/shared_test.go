@@ -0,0 +1,92 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSharedCalls(t *testing.T) {
+	tests := []struct {
+		name    string
+		callers int
+		// cancelled callers go away before the call finishes
+		cancelled     int
+		wantCancelled bool
+	}{
+		{name: "shared", callers: 5},
+		{name: "some callers gone", callers: 5, cancelled: 4},
+		{name: "all callers gone", callers: 3, cancelled: 3, wantCancelled: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSharedCalls()
+			var calls atomic.Int32
+			finish := make(chan struct{})
+			callCancelled := make(chan bool, 1)
+
+			fn := func(ctx context.Context) (interface{}, error) {
+				calls.Add(1)
+				select {
+				case <-finish:
+					callCancelled <- false
+					return "tile", nil
+				case <-ctx.Done():
+					callCancelled <- true
+					return nil, ctx.Err()
+				}
+			}
+
+			var wg sync.WaitGroup
+			cancels := make([]context.CancelFunc, tt.callers)
+			results := make([]interface{}, tt.callers)
+			for i := 0; i < tt.callers; i++ {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancels[i] = cancel
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					results[i], _ = s.do(ctx, "key", fn)
+				}(i)
+			}
+
+			// Wait for all the callers to join the call
+			for {
+				s.mu.Lock()
+				call := s.calls["key"]
+				joined := call != nil && call.waiters == tt.callers
+				s.mu.Unlock()
+				if joined {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			for i := 0; i < tt.cancelled; i++ {
+				cancels[i]()
+			}
+			if !tt.wantCancelled {
+				close(finish)
+			}
+			wg.Wait()
+			for _, cancel := range cancels {
+				cancel()
+			}
+
+			if calls.Load() != 1 {
+				t.Errorf("expected 1 call, got %d", calls.Load())
+			}
+			if cancelled := <-callCancelled; cancelled != tt.wantCancelled {
+				t.Errorf("expected the call to be cancelled: %v, got %v", tt.wantCancelled, cancelled)
+			}
+			for i := tt.cancelled; i < tt.callers; i++ {
+				if results[i] != "tile" {
+					t.Errorf("expected caller %d to get the tile, got %v", i, results[i])
+				}
+			}
+		})
+	}
+}
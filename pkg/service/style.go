@@ -0,0 +1,167 @@
+package service
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/tilezen/go-zaloa/pkg/common"
+	"github.com/tilezen/go-zaloa/pkg/render"
+	"github.com/tilezen/go-zaloa/pkg/tilesets"
+)
+
+const (
+	// hillshadeBuffer is the number of pixels on each side of a 260 or 516 tile that overlap with its neighbours.
+	hillshadeBuffer = 2
+	// defaultHillshadeBlend is the opacity of the hillshade drawn over the color relief in the color-hillshade tileset.
+	defaultHillshadeBlend = 0.6
+)
+
+// tileStyle describes how the stitched elevation tiles are rendered into the requested tile.
+type tileStyle struct {
+	// encoding is the encoding of the source tiles
+	encoding  tilesets.Encoding
+	ramp      *render.ColorRamp
+	hillshade *render.HillshadeOptions
+	// blend is the opacity of the hillshade when it's drawn over the color relief
+	blend float64
+}
+
+func parseHillshadeOptions(query url.Values) (*render.HillshadeOptions, error) {
+	opts := render.DefaultHillshadeOptions
+
+	if mode := query.Get("mode"); mode != "" {
+		opts.Mode = render.HillshadeMode(mode)
+	}
+
+	for param, dst := range map[string]*float64{
+		"azimuth":  &opts.Azimuth,
+		"altitude": &opts.Altitude,
+		"zfactor":  &opts.ZFactor,
+	} {
+		if query.Get(param) == "" {
+			continue
+		}
+
+		v, err := strconv.ParseFloat(query.Get(param), 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %w", param, err)
+		}
+		*dst = v
+	}
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &opts, nil
+}
+
+func parseBlend(query url.Values) (float64, error) {
+	if query.Get("blend") == "" {
+		return defaultHillshadeBlend, nil
+	}
+
+	blend, err := strconv.ParseFloat(query.Get("blend"), 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing blend: %w", err)
+	}
+
+	if blend < 0 || blend > 1 {
+		return 0, fmt.Errorf("blend must be between 0 and 1")
+	}
+
+	return blend, nil
+}
+
+// key identifies the parameters of the style, for use in ETags and cache keys.
+func (s *tileStyle) key() string {
+	if s == nil {
+		return ""
+	}
+
+	var parts []string
+	if s.ramp != nil {
+		parts = append(parts, fmt.Sprintf("ramp=%s@%s", s.ramp.Name, s.ramp.Digest()))
+	}
+	if s.hillshade != nil {
+		parts = append(parts, fmt.Sprintf("hillshade=%s,%g,%g,%g", s.hillshade.Mode, s.hillshade.Azimuth, s.hillshade.Altitude, s.hillshade.ZFactor))
+	}
+	if s.ramp != nil && s.hillshade != nil {
+		parts = append(parts, fmt.Sprintf("blend=%g", s.blend))
+	}
+
+	return strings.Join(parts, ";")
+}
+
+// fetchSize returns the size of the stitched image needed to render a tile of the given size. Hillshading looks at
+// the neighbours of each pixel, so 256 and 512 tiles are rendered from the buffered 260 and 516 tiles and then cropped
+// to keep them seamless.
+func (s *tileStyle) fetchSize(tileSize uint64) uint64 {
+	if s == nil || s.hillshade == nil {
+		return tileSize
+	}
+
+	switch tileSize {
+	case 256, 512:
+		return tileSize + 2*hillshadeBuffer
+	default:
+		return tileSize
+	}
+}
+
+// render turns the stitched terrarium image for tile t into the styled tile of the given size.
+func (s *tileStyle) render(img image.Image, t common.Tile, tileSize int) image.Image {
+	var heights *render.Heights
+	if s.encoding == tilesets.Encoding_MAPBOX {
+		heights = render.DecodeMapbox(img)
+	} else {
+		heights = render.DecodeTerrarium(img)
+	}
+
+	var dst *image.NRGBA
+	if s.ramp != nil {
+		dst = render.ColorRelief(heights, s.ramp)
+	}
+
+	if s.hillshade != nil {
+		shade := render.Hillshade(heights, rowResolutions(t, heights.Height), *s.hillshade)
+		if dst == nil {
+			dst = render.ShadeImage(shade, heights.Width, heights.Height)
+		} else {
+			dst = render.BlendShade(dst, shade, s.blend)
+		}
+	}
+
+	if heights.Width == tileSize {
+		return dst
+	}
+
+	offset := (heights.Width - tileSize) / 2
+	cropped := image.NewNRGBA(image.Rect(0, 0, tileSize, tileSize))
+	draw.Draw(cropped, cropped.Bounds(), dst, image.Pt(offset, offset), draw.Src)
+	return cropped
+}
+
+// rowResolutions returns the ground size of a pixel for each row of a stitched image of the given size for tile t.
+func rowResolutions(t common.Tile, size int) []float64 {
+	// 512 and 516 tiles are made of tiles from the next zoom so their pixels are half the size
+	baseSize := 256
+	if size >= 512 {
+		baseSize = 512
+	}
+	buffer := (size - baseSize) / 2
+	worldSize := float64(baseSize) * math.Pow(2, float64(t.Z))
+
+	resolutions := make([]float64, size)
+	for row := range resolutions {
+		globalY := float64(int(t.Y)*baseSize+row-buffer) + 0.5
+		resolutions[row] = render.GroundResolution(globalY, worldSize)
+	}
+
+	return resolutions
+}
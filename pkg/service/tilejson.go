@@ -0,0 +1,130 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/tilezen/go-zaloa/pkg/common"
+)
+
+const (
+	attribution = `<a href="https://github.com/tilezen/joerd/blob/master/docs/attribution.md">&copy; Mapzen, and others</a>`
+)
+
+type tileJSON struct {
+	TileJSON    string    `json:"tilejson"`
+	Name        string    `json:"name"`
+	Attribution string    `json:"attribution"`
+	Scheme      string    `json:"scheme"`
+	Tiles       []string  `json:"tiles"`
+	MinZoom     uint      `json:"minzoom"`
+	MaxZoom     uint      `json:"maxzoom"`
+	Bounds      []float64 `json:"bounds"`
+	TileSize    uint64    `json:"tileSize"`
+	Encoding    string    `json:"encoding,omitempty"`
+}
+
+// GetTileJSONHandler describes a tileset at a given tile size as TileJSON 3.0.0, so that clients like MapLibre can
+// configure raster-dem sources from it. The tile format defaults to the first format of the tileset, which is png
+// unless configured otherwise, and can be changed with the `format` query parameter. Any other query parameters (like
+// `ramp`) are carried over to the tile URLs.
+func (z zaloaService) GetTileJSONHandler() func(http.ResponseWriter, *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		vars := mux.Vars(request)
+
+		tileSize, err := strconv.ParseUint(vars["tilesize"], 10, 32)
+		if err != nil {
+			writer.WriteHeader(http.StatusNotFound)
+			_, _ = writer.Write([]byte("Invalid tilesize"))
+			return
+		}
+
+		switch vars["version"] {
+		case "v1", "v2":
+		default:
+			writer.WriteHeader(http.StatusNotFound)
+			_, _ = writer.Write([]byte("Invalid version"))
+			return
+		}
+
+		tileset, ok := z.tilesets.Get(vars["tileset"])
+		if !ok {
+			writer.WriteHeader(http.StatusNotFound)
+			_, _ = writer.Write([]byte("Invalid tileset"))
+			return
+		}
+
+		if !tileset.AllowsSize(tileSize) {
+			writer.WriteHeader(http.StatusNotFound)
+			_, _ = writer.Write([]byte("Invalid tilesize"))
+			return
+		}
+
+		query := request.URL.Query()
+		format := query.Get("format")
+		query.Del("format")
+		switch format {
+		case "":
+			format = string(tileset.Formats[0])
+		default:
+			if !tileset.AllowsFormat(common.TileEncoding(format)) {
+				writer.WriteHeader(http.StatusNotFound)
+				_, _ = writer.Write([]byte("Invalid format"))
+				return
+			}
+		}
+
+		tileURL := fmt.Sprintf("%s/tilezen/terrain/%s/%d/%s/{z}/{x}/{y}.%s", baseURL(request), vars["version"], tileSize, vars["tileset"], format)
+		if len(query) > 0 {
+			tileURL += "?" + query.Encode()
+		}
+
+		tj := tileJSON{
+			TileJSON:    "3.0.0",
+			Name:        fmt.Sprintf("tilezen %s %s %d", vars["tileset"], vars["version"], tileSize),
+			Attribution: attribution,
+			Scheme:      "xyz",
+			Tiles:       []string{tileURL},
+			MinZoom:     tileset.MinTileZoom(tileSize),
+			MaxZoom:     tileset.MaxTileZoom(tileSize),
+			Bounds:      []float64{-180, -85.051129, 180, 85.051129},
+			TileSize:    tileSize,
+			Encoding:    tileset.RasterDEMEncoding(),
+		}
+
+		data, err := json.Marshal(tj)
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			_, _ = writer.Write([]byte("Error encoding TileJSON"))
+			z.logger.ErrorContext(request.Context(), "error encoding TileJSON", "error", err)
+			return
+		}
+
+		writer.Header().Set("content-type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		_, _ = writer.Write(data)
+	}
+}
+
+// baseURL rebuilds the scheme and host the client used to reach us, taking proxies into account.
+func baseURL(request *http.Request) string {
+	u := url.URL{Scheme: "http", Host: request.Host}
+	if request.TLS != nil {
+		u.Scheme = "https"
+	}
+
+	if proto := request.Header.Get("X-Forwarded-Proto"); proto != "" {
+		u.Scheme = proto
+	}
+
+	if host := request.Header.Get("X-Forwarded-Host"); host != "" {
+		u.Host = host
+	}
+
+	return u.String()
+}
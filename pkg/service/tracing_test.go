@@ -0,0 +1,209 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/tilezen/go-zaloa/pkg/common"
+	"github.com/tilezen/go-zaloa/pkg/fetcher"
+	"github.com/tilezen/go-zaloa/pkg/tracing"
+)
+
+// setupTestTracing installs a tracer provider that samples every span into an in-memory exporter. The returned
+// function flushes the provider and returns the spans ended so far.
+func setupTestTracing(t *testing.T) func() tracetest.SpanStubs {
+	t.Helper()
+
+	previousProvider, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	exporter := tracetest.NewInMemoryExporter()
+	shutdown := tracing.SetupWithExporter(tracing.Config{SampleRatio: 1}, exporter)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	provider := otel.GetTracerProvider().(*sdktrace.TracerProvider)
+
+	t.Cleanup(func() {
+		_ = shutdown(context.Background())
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+
+	return func() tracetest.SpanStubs {
+		// Shutting the provider down would reset the exporter, so flush it instead
+		if err := provider.ForceFlush(context.Background()); err != nil {
+			t.Fatalf("error flushing spans: %v", err)
+		}
+		return exporter.GetSpans()
+	}
+}
+
+func testTileData(t *testing.T) []byte {
+	t.Helper()
+
+	b := &bytes.Buffer{}
+	if err := png.Encode(b, image.NewRGBA(image.Rect(0, 0, 256, 256))); err != nil {
+		t.Fatalf("error encoding tile: %v", err)
+	}
+	return b.Bytes()
+}
+
+type stubFetcher struct {
+	data []byte
+}
+
+func (s stubFetcher) GetTile(_ context.Context, t common.Tile, _ common.TileKind, _ common.TileVersion) (*fetcher.FetchResponse, error) {
+	return &fetcher.FetchResponse{Data: s.data, Tile: t}, nil
+}
+
+// getTile sends a request for a 512px tile, which is stitched from four source tiles, to the tile handler.
+func getTile(t *testing.T, z ZaloaService) {
+	t.Helper()
+
+	request := httptest.NewRequest(http.MethodGet, "/tilezen/terrain/v1/512/terrarium/1/0/0.png", nil)
+	request = mux.SetURLVars(request, map[string]string{
+		"version":  "v1",
+		"tilesize": "512",
+		"tileset":  "terrarium",
+		"z":        "1",
+		"x":        "0",
+		"y":        "0",
+		"fmt":      "png",
+	})
+
+	recorder := httptest.NewRecorder()
+	z.GetTileHandler()(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func spansNamed(spans tracetest.SpanStubs, name string) tracetest.SpanStubs {
+	var named tracetest.SpanStubs
+	for _, span := range spans {
+		if span.Name == name {
+			named = append(named, span)
+		}
+	}
+	return named
+}
+
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) (string, bool) {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value.Emit(), true
+		}
+	}
+	return "", false
+}
+
+func TestTileHandlerSpans(t *testing.T) {
+	getSpans := setupTestTracing(t)
+
+	getTile(t, NewZaloaService(stubFetcher{data: testTileData(t)}))
+	spans := getSpans()
+
+	handlerSpans := spansNamed(spans, "GetTileHandler")
+	if len(handlerSpans) != 1 {
+		t.Fatalf("expected 1 GetTileHandler span, got %d", len(handlerSpans))
+	}
+	root := handlerSpans[0]
+	if root.Parent.IsValid() {
+		t.Errorf("expected GetTileHandler to be a root span, got parent %s", root.Parent.SpanID())
+	}
+
+	fetchSpans := spansNamed(spans, "FetchTile")
+	if len(fetchSpans) != 4 {
+		t.Fatalf("expected 4 FetchTile spans, got %d", len(fetchSpans))
+	}
+
+	tiles := map[string]bool{}
+	for _, span := range fetchSpans {
+		if span.Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Errorf("expected FetchTile to be a child of GetTileHandler, got parent %s", span.Parent.SpanID())
+		}
+		tile, ok := spanAttribute(span, "zaloa.tile")
+		if !ok {
+			t.Errorf("expected FetchTile span to have a zaloa.tile attribute")
+		}
+		tiles[tile] = true
+	}
+	for _, tile := range []string{"2/0/0", "2/1/0", "2/0/1", "2/1/1"} {
+		if !tiles[tile] {
+			t.Errorf("expected a FetchTile span for %s, got %v", tile, tiles)
+		}
+	}
+
+	for _, name := range []string{"ProcessTile", "EncodeTile"} {
+		named := spansNamed(spans, name)
+		if len(named) != 1 {
+			t.Fatalf("expected 1 %s span, got %d", name, len(named))
+		}
+		if named[0].Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Errorf("expected %s to be a child of GetTileHandler, got parent %s", name, named[0].Parent.SpanID())
+		}
+	}
+
+	for _, span := range spans {
+		if span.SpanContext.TraceID() != root.SpanContext.TraceID() {
+			t.Errorf("expected %s to be in trace %s, got %s", span.Name, root.SpanContext.TraceID(), span.SpanContext.TraceID())
+		}
+	}
+}
+
+func TestHTTPFetcherPropagatesTrace(t *testing.T) {
+	getSpans := setupTestTracing(t)
+
+	data := testTileData(t)
+	var mu sync.Mutex
+	traceparents := map[string]string{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mu.Lock()
+		traceparents[request.URL.Path] = request.Header.Get("traceparent")
+		mu.Unlock()
+		_, _ = writer.Write(data)
+	}))
+	defer upstream.Close()
+
+	getTile(t, NewZaloaService(fetcher.NewHTTPTileFetcher(upstream.URL, slog.Default())))
+	spans := getSpans()
+
+	fetchSpans := spansNamed(spans, "FetchTile")
+	if len(fetchSpans) != 4 {
+		t.Fatalf("expected 4 FetchTile spans, got %d", len(fetchSpans))
+	}
+	if len(traceparents) != 4 {
+		t.Fatalf("expected 4 upstream requests, got %d", len(traceparents))
+	}
+
+	for _, span := range fetchSpans {
+		key, ok := spanAttribute(span, "zaloa.key")
+		if !ok {
+			t.Errorf("expected FetchTile span to have a zaloa.key attribute")
+			continue
+		}
+		if !strings.HasPrefix(key, upstream.URL) {
+			t.Errorf("expected zaloa.key to be an upstream URL, got %s", key)
+			continue
+		}
+
+		// The upstream continues the trace from the FetchTile span
+		path := strings.TrimPrefix(key, upstream.URL)
+		expected := "00-" + span.SpanContext.TraceID().String() + "-" + span.SpanContext.SpanID().String() + "-01"
+		if traceparents[path] != expected {
+			t.Errorf("expected traceparent %s for %s, got %q", expected, path, traceparents[path])
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package service
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/gorilla/mux"
+
+	"github.com/tilezen/go-zaloa/pkg/common"
+	"github.com/tilezen/go-zaloa/pkg/tilesets"
+)
+
+const (
+	wmtsDefaultStyle = "default"
+	// Scale denominator of zoom 0 in the GoogleMapsCompatible well-known scale set
+	googleMapsScaleDenominator = 559082264.0287178
+	webMercatorExtent          = 20037508.3427892
+)
+
+var wmtsFormats = map[string]string{
+	"image/png":  "png",
+	"image/webp": "webp",
+}
+
+// wmtsTileMatrixSet is a GoogleMapsCompatible tile matrix set for one of the unbuffered tile sizes. The buffered 260
+// and 516 tiles overlap their neighbours so they can't be described as a WMTS tile matrix.
+type wmtsTileMatrixSet struct {
+	Identifier        string
+	WellKnownScaleSet string
+	TileSize          uint64
+	// MaxZoom is the highest zoom of any layer
+	MaxZoom uint
+}
+
+var wmtsTileMatrixSets = []wmtsTileMatrixSet{
+	{Identifier: "GoogleMapsCompatible", WellKnownScaleSet: "urn:ogc:def:wkss:OGC:1.0:GoogleMapsCompatible", TileSize: 256},
+	{Identifier: "GoogleMapsCompatible_512", TileSize: 512},
+}
+
+type wmtsTileMatrix struct {
+	Identifier       uint
+	ScaleDenominator float64
+	MatrixSize       uint
+}
+
+func (s wmtsTileMatrixSet) Matrices() []wmtsTileMatrix {
+	matrices := make([]wmtsTileMatrix, 0, s.MaxZoom+1)
+	for z := uint(0); z <= s.MaxZoom; z++ {
+		matrices = append(matrices, wmtsTileMatrix{
+			Identifier:       z,
+			ScaleDenominator: googleMapsScaleDenominator * 256 / float64(s.TileSize) / math.Pow(2, float64(z)),
+			MatrixSize:       1 << z,
+		})
+	}
+	return matrices
+}
+
+type wmtsLayer struct {
+	Identifier string
+	Tileset    string
+	Version    string
+	Styles     []string
+	// Formats maps the mime types the layer is available in to their extension
+	Formats        map[string]string
+	TileMatrixSets []wmtsTileMatrixSetLink
+}
+
+// wmtsTileMatrixSetLink links a layer to a tile matrix set. Layers that don't cover every zoom of the set list the
+// zooms they do cover.
+type wmtsTileMatrixSetLink struct {
+	Identifier string
+	Limits     []wmtsTileMatrixLimits
+}
+
+type wmtsTileMatrixLimits struct {
+	TileMatrix uint
+	MaxTile    uint
+}
+
+var wmtsCapabilitiesTemplate = template.Must(template.New("capabilities").Funcs(template.FuncMap{
+	"xml": func(s string) (string, error) {
+		b := &bytes.Buffer{}
+		err := xml.EscapeText(b, []byte(s))
+		return b.String(), err
+	},
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<Capabilities xmlns="http://www.opengis.net/wmts/1.0" xmlns:ows="http://www.opengis.net/ows/1.1" xmlns:xlink="http://www.w3.org/1999/xlink" version="1.0.0">
+  <ows:ServiceIdentification>
+    <ows:Title>Tilezen terrain tiles</ows:Title>
+    <ows:ServiceType>OGC WMTS</ows:ServiceType>
+    <ows:ServiceTypeVersion>1.0.0</ows:ServiceTypeVersion>
+  </ows:ServiceIdentification>
+  <ows:OperationsMetadata>
+    <ows:Operation name="GetCapabilities">
+      <ows:DCP><ows:HTTP><ows:Get xlink:href="{{xml .BaseURL}}/wmts?{{with .Query}}{{xml .}}&{{end}}"><ows:Constraint name="GetEncoding"><ows:AllowedValues><ows:Value>KVP</ows:Value></ows:AllowedValues></ows:Constraint></ows:Get></ows:HTTP></ows:DCP>
+      <ows:DCP><ows:HTTP><ows:Get xlink:href="{{xml .BaseURL}}/wmts/1.0.0/WMTSCapabilities.xml{{with .Query}}?{{xml .}}{{end}}"><ows:Constraint name="GetEncoding"><ows:AllowedValues><ows:Value>RESTful</ows:Value></ows:AllowedValues></ows:Constraint></ows:Get></ows:HTTP></ows:DCP>
+    </ows:Operation>
+    <ows:Operation name="GetTile">
+      <ows:DCP><ows:HTTP><ows:Get xlink:href="{{xml .BaseURL}}/wmts?{{with .Query}}{{xml .}}&{{end}}"><ows:Constraint name="GetEncoding"><ows:AllowedValues><ows:Value>KVP</ows:Value></ows:AllowedValues></ows:Constraint></ows:Get></ows:HTTP></ows:DCP>
+      <ows:DCP><ows:HTTP><ows:Get xlink:href="{{xml .BaseURL}}/wmts/1.0.0/"><ows:Constraint name="GetEncoding"><ows:AllowedValues><ows:Value>RESTful</ows:Value></ows:AllowedValues></ows:Constraint></ows:Get></ows:HTTP></ows:DCP>
+    </ows:Operation>
+  </ows:OperationsMetadata>
+  <Contents>
+{{- range $layer := .Layers}}
+    <Layer>
+      <ows:Title>{{xml $layer.Tileset}} {{xml $layer.Version}}</ows:Title>
+      <ows:Identifier>{{xml $layer.Identifier}}</ows:Identifier>
+      <ows:WGS84BoundingBox>
+        <ows:LowerCorner>-180 -85.051129</ows:LowerCorner>
+        <ows:UpperCorner>180 85.051129</ows:UpperCorner>
+      </ows:WGS84BoundingBox>
+{{- range $i, $style := $layer.Styles}}
+      <Style{{if eq $i 0}} isDefault="true"{{end}}><ows:Identifier>{{xml $style}}</ows:Identifier></Style>
+{{- end}}
+{{- range $mime, $ext := $layer.Formats}}
+      <Format>{{$mime}}</Format>
+{{- end}}
+{{- range $layer.TileMatrixSets}}
+{{- if .Limits}}
+      <TileMatrixSetLink>
+        <TileMatrixSet>{{.Identifier}}</TileMatrixSet>
+        <TileMatrixSetLimits>
+{{- range .Limits}}
+          <TileMatrixLimits><TileMatrix>{{.TileMatrix}}</TileMatrix><MinTileRow>0</MinTileRow><MaxTileRow>{{.MaxTile}}</MaxTileRow><MinTileCol>0</MinTileCol><MaxTileCol>{{.MaxTile}}</MaxTileCol></TileMatrixLimits>
+{{- end}}
+        </TileMatrixSetLimits>
+      </TileMatrixSetLink>
+{{- else}}
+      <TileMatrixSetLink><TileMatrixSet>{{.Identifier}}</TileMatrixSet></TileMatrixSetLink>
+{{- end}}
+{{- end}}
+{{- range $mime, $ext := $layer.Formats}}
+      <ResourceURL format="{{$mime}}" resourceType="tile" template="{{xml $.BaseURL}}/wmts/1.0.0/{{xml $layer.Identifier}}/{Style}/{TileMatrixSet}/{TileMatrix}/{TileRow}/{TileCol}.{{$ext}}{{with $.Query}}?{{xml .}}{{end}}"/>
+{{- end}}
+    </Layer>
+{{- end}}
+{{- range .TileMatrixSets}}
+    <TileMatrixSet>
+      <ows:Identifier>{{.Identifier}}</ows:Identifier>
+      <ows:SupportedCRS>urn:ogc:def:crs:EPSG::3857</ows:SupportedCRS>
+{{- if .WellKnownScaleSet}}
+      <WellKnownScaleSet>{{.WellKnownScaleSet}}</WellKnownScaleSet>
+{{- end}}
+{{- $tileSize := .TileSize}}
+{{- range .Matrices}}
+      <TileMatrix>
+        <ows:Identifier>{{.Identifier}}</ows:Identifier>
+        <ScaleDenominator>{{printf "%.10f" .ScaleDenominator}}</ScaleDenominator>
+        <TopLeftCorner>{{$.TopLeft}}</TopLeftCorner>
+        <TileWidth>{{$tileSize}}</TileWidth>
+        <TileHeight>{{$tileSize}}</TileHeight>
+        <MatrixWidth>{{.MatrixSize}}</MatrixWidth>
+        <MatrixHeight>{{.MatrixSize}}</MatrixHeight>
+      </TileMatrix>
+{{- end}}
+    </TileMatrixSet>
+{{- end}}
+  </Contents>
+  <ServiceMetadataURL xlink:href="{{xml .BaseURL}}/wmts/1.0.0/WMTSCapabilities.xml{{with .Query}}?{{xml .}}{{end}}"/>
+</Capabilities>
+`))
+
+// wmtsTileMatrixSets returns the tile matrix sets, covering the zooms of every tileset.
+func (z zaloaService) wmtsTileMatrixSets() []wmtsTileMatrixSet {
+	sets := make([]wmtsTileMatrixSet, 0, len(wmtsTileMatrixSets))
+	for _, tms := range wmtsTileMatrixSets {
+		for _, tileset := range z.tilesets.Tilesets() {
+			if tileset.AllowsSize(tms.TileSize) && tileset.MaxTileZoom(tms.TileSize) > tms.MaxZoom {
+				tms.MaxZoom = tileset.MaxTileZoom(tms.TileSize)
+			}
+		}
+		sets = append(sets, tms)
+	}
+	return sets
+}
+
+func (z zaloaService) wmtsLayers(sets []wmtsTileMatrixSet) []wmtsLayer {
+	ramps := []string{wmtsDefaultStyle}
+	for name := range z.colorRamps {
+		if name != wmtsDefaultStyle {
+			ramps = append(ramps, name)
+		}
+	}
+	sort.Strings(ramps[1:])
+
+	var layers []wmtsLayer
+	for _, tileset := range z.tilesets.Tilesets() {
+		styles := []string{wmtsDefaultStyle}
+		switch tileset.Render {
+		case tilesets.Render_COLOR_RELIEF, tilesets.Render_COLOR_HILLSHADE:
+			styles = ramps
+		case tilesets.Render_HILLSHADE:
+			styles = []string{wmtsDefaultStyle, "multidirectional", "igor"}
+		}
+
+		formats := map[string]string{}
+		for mime, ext := range wmtsFormats {
+			if tileset.AllowsFormat(common.TileEncoding(ext)) {
+				formats[mime] = ext
+			}
+		}
+
+		var links []wmtsTileMatrixSetLink
+		for _, tms := range sets {
+			if !tileset.AllowsSize(tms.TileSize) {
+				continue
+			}
+
+			link := wmtsTileMatrixSetLink{Identifier: tms.Identifier}
+			minZoom, maxZoom := tileset.MinTileZoom(tms.TileSize), tileset.MaxTileZoom(tms.TileSize)
+			if minZoom > 0 || maxZoom < tms.MaxZoom {
+				for z := minZoom; z <= maxZoom; z++ {
+					link.Limits = append(link.Limits, wmtsTileMatrixLimits{TileMatrix: z, MaxTile: 1<<z - 1})
+				}
+			}
+			links = append(links, link)
+		}
+
+		// Layers need a tile matrix set, and the buffered sizes can't be published as one
+		if len(links) == 0 {
+			continue
+		}
+
+		for _, version := range []string{"v1", "v2"} {
+			layers = append(layers, wmtsLayer{
+				Identifier:     tileset.Name + "-" + version,
+				Tileset:        tileset.Name,
+				Version:        version,
+				Styles:         styles,
+				Formats:        formats,
+				TileMatrixSets: links,
+			})
+		}
+	}
+
+	return layers
+}
+
+// wmtsCapabilitiesParams are the KVP parameters of GetCapabilities requests, which aren't carried over to the URLs in
+// the capabilities document.
+var wmtsCapabilitiesParams = map[string]bool{
+	"SERVICE":        true,
+	"REQUEST":        true,
+	"VERSION":        true,
+	"ACCEPTVERSIONS": true,
+	"SECTIONS":       true,
+	"UPDATESEQUENCE": true,
+	"ACCEPTFORMATS":  true,
+}
+
+// wmtsPassThroughQuery returns the query parameters that the URLs in the capabilities document should carry, like an
+// API key, so that clients send them with their tile requests.
+func wmtsPassThroughQuery(request *http.Request) string {
+	query := url.Values{}
+	for k, v := range request.URL.Query() {
+		if !wmtsCapabilitiesParams[strings.ToUpper(k)] {
+			query[k] = v
+		}
+	}
+	return query.Encode()
+}
+
+// GetWMTSCapabilitiesHandler serves the WMTS 1.0.0 capabilities document. Each tileset and version is published as a
+// layer, the color ramps and hillshade modes are published as styles, and the 256 and 512 tile sizes are published as
+// GoogleMapsCompatible tile matrix sets.
+func (z zaloaService) GetWMTSCapabilitiesHandler() func(http.ResponseWriter, *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		sets := z.wmtsTileMatrixSets()
+
+		b := &bytes.Buffer{}
+		err := wmtsCapabilitiesTemplate.Execute(b, map[string]interface{}{
+			"BaseURL":        baseURL(request),
+			"Query":          wmtsPassThroughQuery(request),
+			"Layers":         z.wmtsLayers(sets),
+			"TileMatrixSets": sets,
+			"TopLeft":        fmt.Sprintf("%.7f %.7f", -webMercatorExtent, webMercatorExtent),
+		})
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			_, _ = writer.Write([]byte("Error building capabilities"))
+			z.logger.ErrorContext(request.Context(), "error building WMTS capabilities", "error", err)
+			return
+		}
+
+		writer.Header().Set("content-type", "application/xml")
+		writer.WriteHeader(http.StatusOK)
+		_, _ = writer.Write(b.Bytes())
+	}
+}
+
+// GetWMTSTileHandler answers RESTful WMTS GetTile requests of the form
+// /wmts/1.0.0/{layer}/{style}/{tilematrixset}/{tilematrix}/{tilerow}/{tilecol}.{fmt}
+func (z zaloaService) GetWMTSTileHandler(tiles http.Handler) func(http.ResponseWriter, *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		vars := mux.Vars(request)
+		z.serveWMTSTile(writer, request, tiles, request.URL.Query(), vars["layer"], vars["style"], vars["tilematrixset"], vars["tilematrix"], vars["tilerow"], vars["tilecol"], vars["fmt"])
+	}
+}
+
+// wmtsGetTileParams are the KVP parameters of GetTile requests. The others, like an API key or a signature, are passed
+// on to the tile request.
+var wmtsGetTileParams = map[string]bool{
+	"SERVICE":       true,
+	"REQUEST":       true,
+	"VERSION":       true,
+	"LAYER":         true,
+	"STYLE":         true,
+	"FORMAT":        true,
+	"TILEMATRIXSET": true,
+	"TILEMATRIX":    true,
+	"TILEROW":       true,
+	"TILECOL":       true,
+}
+
+// IsWMTSGetTile returns true for KVP encoded WMTS GetTile requests, which need to be authenticated like tile requests
+// rather than like the rest of the WMTS service.
+func IsWMTSGetTile(request *http.Request) bool {
+	for k, v := range request.URL.Query() {
+		if strings.EqualFold(k, "REQUEST") && len(v) > 0 && strings.EqualFold(v[0], "GetTile") {
+			return true
+		}
+	}
+	return false
+}
+
+// GetWMTSHandler answers KVP encoded WMTS GetCapabilities and GetTile requests.
+func (z zaloaService) GetWMTSHandler(tiles http.Handler) func(http.ResponseWriter, *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		// KVP parameter names are case insensitive
+		params := url.Values{}
+		for k, v := range request.URL.Query() {
+			params[strings.ToUpper(k)] = v
+		}
+
+		if service := params.Get("SERVICE"); !strings.EqualFold(service, "WMTS") {
+			z.writeWMTSException(writer, http.StatusBadRequest, "InvalidParameterValue", "service", "SERVICE must be WMTS")
+			return
+		}
+
+		switch strings.ToLower(params.Get("REQUEST")) {
+		case "getcapabilities":
+			z.GetWMTSCapabilitiesHandler()(writer, request)
+		case "gettile":
+			format, ok := wmtsFormats[params.Get("FORMAT")]
+			if !ok {
+				z.writeWMTSException(writer, http.StatusBadRequest, "InvalidParameterValue", "format", "Unsupported FORMAT")
+				return
+			}
+
+			query := url.Values{}
+			for k, v := range request.URL.Query() {
+				if !wmtsGetTileParams[strings.ToUpper(k)] {
+					query[k] = v
+				}
+			}
+
+			z.serveWMTSTile(writer, request, tiles, query, params.Get("LAYER"), params.Get("STYLE"), params.Get("TILEMATRIXSET"), params.Get("TILEMATRIX"), params.Get("TILEROW"), params.Get("TILECOL"), format)
+		case "":
+			z.writeWMTSException(writer, http.StatusBadRequest, "MissingParameterValue", "request", "REQUEST is required")
+		default:
+			z.writeWMTSException(writer, http.StatusBadRequest, "OperationNotSupported", "request", "Unsupported REQUEST")
+		}
+	}
+}
+
+// serveWMTSTile translates a WMTS tile request into a request for the tile endpoint, with its path, path variables and
+// query parameters, and hands it over to tiles. query holds the parameters to pass on, like an API key or a signature,
+// which is checked against the path of the tile endpoint.
+func (z zaloaService) serveWMTSTile(writer http.ResponseWriter, request *http.Request, tiles http.Handler, query url.Values, layer, style, tileMatrixSet, tileMatrix, tileRow, tileCol, format string) {
+	sep := strings.LastIndex(layer, "-")
+	if sep == -1 {
+		z.writeWMTSException(writer, http.StatusBadRequest, "InvalidParameterValue", "layer", "Unknown LAYER")
+		return
+	}
+	tileset, version := layer[:sep], layer[sep+1:]
+
+	var tileSize uint64
+	for _, tms := range wmtsTileMatrixSets {
+		if tms.Identifier == tileMatrixSet {
+			tileSize = tms.TileSize
+		}
+	}
+	if tileSize == 0 {
+		z.writeWMTSException(writer, http.StatusBadRequest, "InvalidParameterValue", "tilematrixset", "Unknown TILEMATRIXSET")
+		return
+	}
+
+	for name, value := range map[string]string{"tilematrix": tileMatrix, "tilerow": tileRow, "tilecol": tileCol} {
+		if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+			z.writeWMTSException(writer, http.StatusBadRequest, "InvalidParameterValue", name, "Invalid "+strings.ToUpper(name))
+			return
+		}
+	}
+
+	if style != "" && style != wmtsDefaultStyle {
+		var render tilesets.Render
+		if t, ok := z.tilesets.Get(tileset); ok {
+			render = t.Render
+		}
+
+		switch render {
+		case tilesets.Render_COLOR_RELIEF, tilesets.Render_COLOR_HILLSHADE:
+			query.Set("ramp", style)
+		case tilesets.Render_HILLSHADE:
+			query.Set("mode", style)
+		default:
+			z.writeWMTSException(writer, http.StatusBadRequest, "InvalidParameterValue", "style", "Unknown STYLE")
+			return
+		}
+	}
+
+	tileRequest := request.Clone(request.Context())
+	tileRequest.URL.Path = fmt.Sprintf("/tilezen/terrain/%s/%d/%s/%s/%s/%s.%s", version, tileSize, tileset, tileMatrix, tileCol, tileRow, format)
+	tileRequest.URL.RawPath = ""
+	tileRequest.URL.RawQuery = query.Encode()
+	tileRequest = mux.SetURLVars(tileRequest, map[string]string{
+		"version":  version,
+		"tilesize": strconv.FormatUint(tileSize, 10),
+		"tileset":  tileset,
+		"z":        tileMatrix,
+		"x":        tileCol,
+		"y":        tileRow,
+		"fmt":      format,
+	})
+
+	tiles.ServeHTTP(writer, tileRequest)
+}
+
+type wmtsExceptionReport struct {
+	XMLName   xml.Name `xml:"http://www.opengis.net/ows/1.1 ExceptionReport"`
+	Version   string   `xml:"version,attr"`
+	Exception struct {
+		Code    string `xml:"exceptionCode,attr"`
+		Locator string `xml:"locator,attr,omitempty"`
+		Text    string `xml:"ExceptionText"`
+	} `xml:"Exception"`
+}
+
+func (z zaloaService) writeWMTSException(writer http.ResponseWriter, status int, code string, locator string, text string) {
+	report := wmtsExceptionReport{Version: "1.0.0"}
+	report.Exception.Code = code
+	report.Exception.Locator = locator
+	report.Exception.Text = text
+
+	data, err := xml.Marshal(report)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		z.logger.Error("error encoding WMTS exception", "error", err)
+		return
+	}
+
+	writer.Header().Set("content-type", "application/xml")
+	writer.WriteHeader(status)
+	_, _ = writer.Write([]byte(xml.Header))
+	_, _ = writer.Write(data)
+}
@@ -3,43 +3,86 @@ package service
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"image"
 	"image/draw"
 	"image/png"
-	"log"
+	"log/slog"
 	"math"
 	"net/http"
+	"net/url"
 	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/chai2010/webp"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 
+	"github.com/tilezen/go-zaloa/pkg/admission"
+	"github.com/tilezen/go-zaloa/pkg/cache"
 	"github.com/tilezen/go-zaloa/pkg/common"
 	"github.com/tilezen/go-zaloa/pkg/fetcher"
-)
-
-const (
-	maxZoom = 15
+	"github.com/tilezen/go-zaloa/pkg/logging"
+	"github.com/tilezen/go-zaloa/pkg/metrics"
+	"github.com/tilezen/go-zaloa/pkg/render"
+	"github.com/tilezen/go-zaloa/pkg/tilesets"
+	"github.com/tilezen/go-zaloa/pkg/tracing"
 )
 
 type ZaloaService interface {
 	GetHealthCheckHandler() func(http.ResponseWriter, *http.Request)
 	GetTileHandler() func(http.ResponseWriter, *http.Request)
+	GetTileJSONHandler() func(http.ResponseWriter, *http.Request)
+	GetWMTSCapabilitiesHandler() func(http.ResponseWriter, *http.Request)
+	// GetWMTSTileHandler and GetWMTSHandler translate WMTS tile requests into requests for the tile endpoint and hand
+	// them to tiles, which authenticates them like other tile requests before they reach the tile handler.
+	GetWMTSTileHandler(tiles http.Handler) func(http.ResponseWriter, *http.Request)
+	GetWMTSHandler(tiles http.Handler) func(http.ResponseWriter, *http.Request)
+	// RenderTile renders a tile outside of an HTTP request, going through the render cache like the tile handler.
+	RenderTile(ctx context.Context, params TileParams) (*cache.Entry, error)
+	PlanTile(params TileParams) (*TilePlan, error)
+	GetDebugPlanHandler() func(http.ResponseWriter, *http.Request)
+	// Tilesets returns the tilesets that can be requested.
+	Tilesets() *tilesets.Registry
 }
 
 type zaloaService struct {
+	// fetcher is the default fetcher
 	fetcher fetcher.TileFetcher
+	// fetchers are the other fetchers tilesets can use, by name
+	fetchers   map[string]fetcher.TileFetcher
+	tilesets   *tilesets.Registry
+	colorRamps map[string]*render.ColorRamp
+	metrics    metrics.Recorder
+	logger     *slog.Logger
+	// renderCache holds encoded tiles. It's optional.
+	renderCache cache.Cache
+	renderCalls *sharedCalls
+	// fetchCalls shares the source tiles between concurrent requests that need the same ones
+	fetchCalls *sharedCalls
+	// cacheMaxAge is the Cache-Control max-age sent with the tiles of each version
+	cacheMaxAge map[common.TileVersion]time.Duration
+	// renderLimiter bounds the number of tiles that are rendered at once. It's optional.
+	renderLimiter *admission.Limiter
 }
 
+// renderRetryAfter is how long clients are asked to wait when too many tiles are being rendered
+const renderRetryAfter = time.Second
+
 func (z zaloaService) GetHealthCheckHandler() func(http.ResponseWriter, *http.Request) {
 	return func(writer http.ResponseWriter, request *http.Request) {
 		ctx := request.Context()
 		_, err := z.fetcher.GetTile(ctx, common.Tile{Z: 0, X: 0, Y: 0}, common.TileType_TERRARIUM, common.TileVersion_V1)
 		if err != nil {
 			writer.WriteHeader(http.StatusInternalServerError)
-			log.Printf("Couldn't get healthcheck Tile: %+v", err)
+			z.logger.ErrorContext(ctx, "couldn't get healthcheck tile", "error", err)
 		}
 
 		writer.WriteHeader(http.StatusOK)
@@ -53,131 +96,373 @@ type instruction struct {
 	spec        fetcher.ImageSpec
 }
 
+// statusRecorder keeps track of the status code and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(data []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(data)
+	s.bytes += n
+	return n, err
+}
+
+// tileRequestInfo collects details about a tile request for the metrics and the access log.
+type tileRequestInfo struct {
+	labels metrics.RequestLabels
+	tile   string
+	// fetches counts the upstream fetches made for the request
+	fetches atomic.Int32
+}
+
+type contextKey int
+
+const (
+	tileRequestInfoKey contextKey = iota
+)
+
+func requestInfoFromContext(ctx context.Context) *tileRequestInfo {
+	info, _ := ctx.Value(tileRequestInfoKey).(*tileRequestInfo)
+	return info
+}
+
 func (z zaloaService) GetTileHandler() func(http.ResponseWriter, *http.Request) {
 	return func(writer http.ResponseWriter, request *http.Request) {
-		ctx := request.Context()
-		vars := mux.Vars(request)
-		var err error
+		start := time.Now()
+		z.metrics.AddInFlight(1)
 
-		tileSize := uint64(256)
-		if vars["tilesize"] != "" {
-			tileSize, err = strconv.ParseUint(vars["tilesize"], 10, 32)
-			if err != nil {
-				writer.WriteHeader(http.StatusNotFound)
-				_, _ = writer.Write([]byte("Invalid tilesize"))
-				return
-			}
+		requestID := request.Header.Get("X-Request-Id")
+		if requestID == "" || len(requestID) > 128 {
+			requestID = logging.NewRequestID()
 		}
+		writer.Header().Set("X-Request-Id", requestID)
 
-		var version common.TileVersion
-		switch vars["version"] {
-		case "v1":
-			version = common.TileVersion_V1
-		case "v2":
-			version = common.TileVersion_V2
-		default:
-			writer.WriteHeader(http.StatusNotFound)
-			_, _ = writer.Write([]byte("Invalid version"))
-			return
-		}
+		info := &tileRequestInfo{labels: metrics.InvalidRequestLabels}
+		ctx := context.WithValue(logging.WithRequestID(request.Context(), requestID), tileRequestInfoKey, info)
 
-		var tileset common.TileKind
-		switch vars["tileset"] {
-		case "terrarium":
-			tileset = common.TileType_TERRARIUM
-		case "normal":
-			tileset = common.TileType_NORMAL
-		default:
-			writer.WriteHeader(http.StatusNotFound)
-			_, _ = writer.Write([]byte("Invalid tileset"))
-			return
-		}
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(request.Header))
+		ctx, span := tracing.Tracer().Start(ctx, "GetTileHandler", trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
 
-		var tileEncoding common.TileEncoding
-		switch vars["fmt"] {
-		case "png":
-			tileEncoding = common.TileEncoding_PNG
-			writer.Header().Set("content-type", "image/png")
-		case "webp":
-			tileEncoding = common.TileEncoding_WEBP
-			writer.Header().Set("content-type", "image/webp")
-		default:
-			writer.WriteHeader(http.StatusNotFound)
-			_, _ = writer.Write([]byte("Invalid format"))
-			return
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+		z.serveTile(recorder, request.WithContext(ctx), info)
+		duration := time.Since(start)
+
+		span.SetAttributes(
+			attribute.String("zaloa.tileset", info.labels.Tileset),
+			attribute.String("zaloa.tilesize", info.labels.TileSize),
+			attribute.String("zaloa.format", info.labels.Format),
+			attribute.Int("http.status_code", recorder.status),
+		)
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
 		}
 
-		parsedTile, err := common.ParseTile(vars["z"], vars["x"], vars["y"])
+		z.metrics.AddInFlight(-1)
+		z.metrics.ObserveRequest(info.labels, recorder.status, duration, recorder.bytes)
+
+		z.logger.LogAttrs(ctx, slog.LevelInfo, "access",
+			slog.String("method", request.Method),
+			slog.String("path", request.URL.Path),
+			slog.String("tile", info.tile),
+			slog.String("tileset", info.labels.Tileset),
+			slog.String("size", info.labels.TileSize),
+			slog.String("format", info.labels.Format),
+			slog.Int("status", recorder.status),
+			slog.Int("bytes", recorder.bytes),
+			slog.Float64("duration_ms", float64(duration.Microseconds())/1000),
+			slog.Int("fetches", int(info.fetches.Load())),
+		)
+	}
+}
+
+// serveTile validates and renders a tile request. info is filled in once the request is known to be valid.
+func (z zaloaService) serveTile(writer http.ResponseWriter, request *http.Request, info *tileRequestInfo) {
+	ctx := request.Context()
+	vars := mux.Vars(request)
+	var err error
+
+	tileSize := uint64(256)
+	if vars["tilesize"] != "" {
+		tileSize, err = strconv.ParseUint(vars["tilesize"], 10, 32)
 		if err != nil {
 			writer.WriteHeader(http.StatusNotFound)
-			_, _ = writer.Write([]byte("Invalid Tile coordinate"))
+			_, _ = writer.Write([]byte("Invalid tilesize"))
 			return
 		}
+	}
 
-		if parsedTile.Z > maxZoom {
-			writer.WriteHeader(http.StatusNotFound)
-			_, _ = writer.Write([]byte("Invalid zoom"))
-			return
+	parsedTile, err := common.ParseTile(vars["z"], vars["x"], vars["y"])
+	if err != nil {
+		writer.WriteHeader(http.StatusNotFound)
+		_, _ = writer.Write([]byte("Invalid Tile coordinate"))
+		return
+	}
+
+	req, err := z.newTileRequest(TileParams{
+		Version:  vars["version"],
+		Tileset:  vars["tileset"],
+		TileSize: tileSize,
+		Format:   vars["fmt"],
+		Tile:     *parsedTile,
+		Query:    request.URL.Query(),
+	})
+	if err != nil {
+		invalid := &invalidRequestError{status: http.StatusBadRequest, message: err.Error()}
+		errors.As(err, &invalid)
+		writer.WriteHeader(invalid.status)
+		_, _ = writer.Write([]byte(invalid.message))
+		return
+	}
+
+	info.labels = metrics.RequestLabels{Tileset: vars["tileset"], TileSize: strconv.FormatUint(tileSize, 10), Format: vars["fmt"]}
+	info.tile = parsedTile.String()
+	z.logger.DebugContext(ctx, "requested tile", "tile", parsedTile.String())
+
+	key := req.key()
+
+	entry, err := z.getCachedTile(ctx, req)
+	if err != nil {
+		z.logger.WarnContext(ctx, "error reading render cache", "key", key, "error", err)
+	}
+
+	if z.renderCache != nil && !req.overlay {
+		if entry != nil {
+			writer.Header().Set("X-Zaloa-Cache", "hit")
+		} else {
+			writer.Header().Set("X-Zaloa-Cache", "miss")
 		}
+	}
 
-		if parsedTile.Z == maxZoom && tileSize != 260 {
-			writer.WriteHeader(http.StatusNotFound)
-			_, _ = writer.Write([]byte("Invalid zoom"))
-			return
+	if entry == nil {
+		var sources []*fetcher.FetchResponse
+		if ifNoneMatch := request.Header.Get("If-None-Match"); ifNoneMatch != "" {
+			// The source tiles are enough to tell if the client already has this tile, without decoding or encoding
+			// anything. They're passed on to the render otherwise, so they aren't fetched twice.
+			sources, err = z.fetchShared(ctx, req)
+			if err != nil {
+				z.writeRenderError(ctx, writer, err)
+				return
+			}
+
+			etag := tileETag(sources, req.versionName, req.tilesetName, req.tileSize, req.encoding, req.style, req.overlay)
+			if etag != "" && etagMatches(ifNoneMatch, etag) {
+				z.setCacheHeaders(ctx, writer, req, etag)
+				if source := tileSource(sources); source != "" {
+					writer.Header().Set("X-Zaloa-Source", source)
+				}
+				writer.WriteHeader(http.StatusNotModified)
+				return
+			}
 		}
 
-		// Build parsedTile coordinates to request
-		log.Printf("Requested Tile: %s", *parsedTile)
-		var imageInstructions []instruction
-		switch tileSize {
-		case 256:
-			imageInstructions = generate256Instructions(*parsedTile)
-		case 260:
-			imageInstructions = generate260Instructions(*parsedTile)
-		case 512:
-			imageInstructions = generate512Instructions(*parsedTile)
-		case 516:
-			imageInstructions = generate516Instructions(*parsedTile)
-		default:
-			writer.WriteHeader(http.StatusNotFound)
-			_, _ = writer.Write([]byte("Invalid tilesize"))
+		entry, err = z.renderShared(ctx, req, sources)
+		if err != nil {
+			z.writeRenderError(ctx, writer, err)
 			return
 		}
+	}
 
-		tileImage, err := z.ProcessTile(ctx, int(tileSize), imageInstructions, tileset, version)
+	z.setCacheHeaders(ctx, writer, req, entry.ETag)
+	if entry.Source != "" {
+		writer.Header().Set("X-Zaloa-Source", entry.Source)
+	}
+	if entry.ETag != "" && etagMatches(request.Header.Get("If-None-Match"), entry.ETag) {
+		writer.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Only the tile itself is an image, the errors above are plain text
+	writer.Header().Set("content-type", contentTypes[req.encoding])
+	writer.WriteHeader(http.StatusOK)
+	_, _ = writer.Write(entry.Data)
+}
+
+// writeRenderError writes the response for a tile that couldn't be fetched or rendered.
+func (z zaloaService) writeRenderError(ctx context.Context, writer http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, admission.ErrQueueFull):
+		writer.Header().Set("Retry-After", strconv.Itoa(int(renderRetryAfter.Seconds())))
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = writer.Write([]byte("Too many tiles being rendered"))
+		z.logger.WarnContext(ctx, "tile not rendered", "error", err)
+	case errors.Is(err, fetcher.ErrNotFound):
+		writer.WriteHeader(http.StatusNotFound)
+		_, _ = writer.Write([]byte("Tile not found"))
+		z.logger.WarnContext(ctx, "source tile not found", "error", err)
+	default:
+		writer.WriteHeader(http.StatusInternalServerError)
+		_, _ = writer.Write([]byte("Error rendering tile"))
+		z.logger.ErrorContext(ctx, "error rendering tile", "error", err)
+	}
+}
+
+func parseTileVersion(s string) (common.TileVersion, bool) {
+	switch s {
+	case "v1":
+		return common.TileVersion_V1, true
+	case "v2":
+		return common.TileVersion_V2, true
+	default:
+		return "", false
+	}
+}
+
+func (z zaloaService) parseStyle(tileset *tilesets.Tileset, query url.Values) (*tileStyle, error) {
+	style := &tileStyle{encoding: tileset.Encoding}
+	var err error
+
+	if tileset.Render == tilesets.Render_COLOR_RELIEF || tileset.Render == tilesets.Render_COLOR_HILLSHADE {
+		style.ramp = z.colorRamp(query.Get("ramp"))
+		if style.ramp == nil {
+			return nil, fmt.Errorf("unknown ramp %s", query.Get("ramp"))
+		}
+	}
+
+	if tileset.Render == tilesets.Render_HILLSHADE || tileset.Render == tilesets.Render_COLOR_HILLSHADE {
+		style.hillshade, err = parseHillshadeOptions(query)
 		if err != nil {
-			writer.WriteHeader(http.StatusInternalServerError)
-			_, _ = writer.Write([]byte("Error fetching parsedTile"))
-			log.Printf("Error during ProcessTile: %+v", err)
-			return
+			return nil, err
 		}
+	}
 
-		tileData, err := z.EncodeTile(ctx, tileImage, tileEncoding)
+	if tileset.Render == tilesets.Render_COLOR_HILLSHADE {
+		style.blend, err = parseBlend(query)
 		if err != nil {
-			writer.WriteHeader(http.StatusInternalServerError)
-			_, _ = writer.Write([]byte("Error encoding tile"))
-			log.Printf("Error during EncodeTile: %+v", err)
-			return
+			return nil, err
 		}
+	}
 
-		writer.WriteHeader(http.StatusOK)
-		_, _ = writer.Write(tileData)
-		return
+	return style, nil
+}
+
+func (z zaloaService) colorRamp(name string) *render.ColorRamp {
+	if name == "" {
+		name = "default"
 	}
+
+	if ramp, ok := z.colorRamps[name]; ok {
+		return ramp
+	}
+
+	if name == "default" {
+		return render.DefaultColorRamp
+	}
+
+	return nil
 }
 
-func (z zaloaService) ProcessTile(ctx context.Context, tileSize int, instructions []instruction, tileset common.TileKind, version common.TileVersion) (image.Image, error) {
+// ProcessTile decodes the fetched source tiles and draws them into a single image of the given size. The tiles of a
+// mosaic fetcher are merged pixel by pixel, decoding the elevations of the given encoding.
+func (z zaloaService) ProcessTile(ctx context.Context, tileSize int, sources []*fetcher.FetchResponse, encoding tilesets.Encoding) (image.Image, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "ProcessTile", trace.WithAttributes(attribute.Int("zaloa.tilesize", tileSize)))
+	defer span.End()
 
-	// Fetch the tiles required to process the requested Tile
-	imageInputs, err := z.FetchTiles(ctx, tileset, version, instructions)
-	if err != nil {
-		return nil, fmt.Errorf("error fetching tiles: %w", err)
+	if len(sources) > 0 && sources[0].Layers != nil {
+		return z.processMosaic(ctx, tileSize, sources, encoding)
 	}
 
+	decodeStart := time.Now()
+	imageInputs := make([]fetcher.ImageInput, 0, len(sources))
+	for _, source := range sources {
+		decodedImage, _, err := image.Decode(bytes.NewBuffer(source.Data))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode image data for Tile %s: %w", source.Tile, err)
+		}
+
+		imageInputs = append(imageInputs, fetcher.ImageInput{
+			Image: decodedImage,
+			Tile:  source.Tile,
+			Spec:  source.Spec,
+		})
+	}
+	z.metrics.ObserveStage(metrics.Stage_DECODE, time.Since(decodeStart))
+
 	// Reduce the images into a single output Tile
+	drawStart := time.Now()
 	dst := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
-	for _, input := range imageInputs {
-		log.Printf("take crop %s and put at %s", input.Spec.Crop, input.Spec.Location)
+	z.drawInputs(ctx, dst, imageInputs)
+	z.metrics.ObserveStage(metrics.Stage_DRAW, time.Since(drawStart))
+
+	return dst, nil
+}
+
+// processMosaic stitches the tiles of each source of a mosaic fetcher separately and merges the stitched images pixel
+// by pixel, so that the feathering crosses the seams between source tiles.
+func (z zaloaService) processMosaic(ctx context.Context, tileSize int, sources []*fetcher.FetchResponse, encoding tilesets.Encoding) (image.Image, error) {
+	layerCount := len(sources[0].Layers)
+
+	decodeStart := time.Now()
+	layerInputs := make([][]fetcher.ImageInput, layerCount)
+	for _, source := range sources {
+		if len(source.Layers) != layerCount {
+			return nil, fmt.Errorf("mosaic of Tile %s has %d layers instead of %d", source.Tile, len(source.Layers), layerCount)
+		}
+
+		for l, layer := range source.Layers {
+			if layer.Data == nil {
+				continue
+			}
+
+			decodedImage, _, err := image.Decode(bytes.NewBuffer(layer.Data))
+			if err != nil {
+				return nil, fmt.Errorf("couldn't decode image data for Tile %s from %s: %w", source.Tile, layer.Source, err)
+			}
+
+			layerInputs[l] = append(layerInputs[l], fetcher.ImageInput{
+				Image: decodedImage,
+				Tile:  source.Tile,
+				Spec:  source.Spec,
+			})
+		}
+	}
+	z.metrics.ObserveStage(metrics.Stage_DECODE, time.Since(decodeStart))
+
+	drawStart := time.Now()
+	defer func() {
+		z.metrics.ObserveStage(metrics.Stage_DRAW, time.Since(drawStart))
+	}()
+
+	layers := make([]image.Image, layerCount)
+	for l, inputs := range layerInputs {
+		dst := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+		z.drawInputs(ctx, dst, inputs)
+		layers[l] = dst
+	}
+
+	var decode func(image.Image) *render.Heights
+	var encode func(*render.Heights) *image.RGBA
+	switch encoding {
+	case tilesets.Encoding_TERRARIUM:
+		decode, encode = render.DecodeTerrarium, render.EncodeTerrarium
+	case tilesets.Encoding_MAPBOX:
+		decode, encode = render.DecodeMapbox, render.EncodeMapbox
+	default:
+		// Without elevations, pixels can only be told apart by their alpha
+		return render.MosaicImages(layers), nil
+	}
+
+	heights := make([]*render.Heights, layerCount)
+	for l, layer := range layers {
+		heights[l] = decode(layer)
+		if nodata := sources[0].Layers[l].Nodata; nodata != nil {
+			heights[l].MaskNodata(*nodata)
+		}
+	}
+
+	return encode(render.MosaicElevations(heights, sources[0].Feather)), nil
+}
+
+func (z zaloaService) drawInputs(ctx context.Context, dst draw.Image, inputs []fetcher.ImageInput) {
+	for _, input := range inputs {
+		z.logger.DebugContext(ctx, "drawing source tile", "tile", input.Tile.String(), "crop", input.Spec.Crop.String(), "location", input.Spec.Location.String())
 		draw.Draw(
 			dst,
 			image.Rect(input.Spec.Location.X, input.Spec.Location.Y, input.Spec.Location.X+256, input.Spec.Location.Y+256),
@@ -186,26 +471,39 @@ func (z zaloaService) ProcessTile(ctx context.Context, tileSize int, instruction
 			draw.Src,
 		)
 	}
-
-	return dst, nil
 }
 
-func (z zaloaService) FetchTiles(ctx context.Context, tileset common.TileKind, version common.TileVersion, instructions []instruction) ([]fetcher.ImageInput, error) {
+// FetchTiles fetches the source tile of every instruction concurrently. The responses are returned in the same order
+// as the instructions.
+func (z zaloaService) FetchTiles(ctx context.Context, tileFetcher fetcher.TileFetcher, tileset common.TileKind, version common.TileVersion, instructions []instruction) ([]*fetcher.FetchResponse, error) {
 	errs, ctx := errgroup.WithContext(ctx)
-	fetchResults := make(chan *fetcher.FetchResponse, len(instructions))
+	fetchResults := make([]*fetcher.FetchResponse, len(instructions))
 
-	for _, inst := range instructions {
+	for i, inst := range instructions {
 		// https://golang.org/doc/faq#closures_and_goroutines
-		inst := inst
+		i, inst := i, inst
 
 		errs.Go(func() error {
-			resp, err := z.fetcher.GetTile(ctx, inst.tileToFetch, tileset, version)
+			ctx, span := tracing.Tracer().Start(ctx, "FetchTile", trace.WithAttributes(
+				attribute.String("zaloa.tile", inst.tileToFetch.String()),
+				attribute.String("zaloa.tileset", string(tileset)),
+				attribute.String("zaloa.version", string(version)),
+			))
+			defer span.End()
+
+			if info := requestInfoFromContext(ctx); info != nil {
+				info.fetches.Add(1)
+			}
+
+			resp, err := tileFetcher.GetTile(ctx, inst.tileToFetch, tileset, version)
 			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, "fetch failed")
 				return fmt.Errorf("couldn't fetch Tile %s: %w", inst.tileToFetch, err)
 			}
 
 			resp.Spec = inst.spec
-			fetchResults <- resp
+			fetchResults[i] = resp
 			return nil
 		})
 	}
@@ -214,25 +512,19 @@ func (z zaloaService) FetchTiles(ctx context.Context, tileset common.TileKind, v
 	if err != nil {
 		return nil, fmt.Errorf("error while fetching images: %w", err)
 	}
-	close(fetchResults)
-
-	inputResults := make([]fetcher.ImageInput, 0, len(instructions))
-	for result := range fetchResults {
-		decodedImage, _, err := image.Decode(bytes.NewBuffer(result.Data))
-		if err != nil {
-			return nil, fmt.Errorf("couldn't decode image data: %w", err)
-		}
-
-		inputResults = append(inputResults, fetcher.ImageInput{
-			Image: decodedImage,
-			Spec:  result.Spec,
-		})
-	}
 
-	return inputResults, nil
+	return fetchResults, nil
 }
 
 func (z zaloaService) EncodeTile(ctx context.Context, tileImage image.Image, encoding common.TileEncoding) ([]byte, error) {
+	_, span := tracing.Tracer().Start(ctx, "EncodeTile", trace.WithAttributes(attribute.String("zaloa.format", string(encoding))))
+	defer span.End()
+
+	encodeStart := time.Now()
+	defer func() {
+		z.metrics.ObserveStage(metrics.Stage_ENCODE, time.Since(encodeStart))
+	}()
+
 	b := &bytes.Buffer{}
 
 	var err error
@@ -352,34 +644,33 @@ func generate516Instructions(t common.Tile) []instruction {
 	xyMax := uint(math.Pow(2, float64(z))) - 1
 
 	// Tiles to fetch
+	// The loops use ints since the coordinates go below zero at the top and left edges
 	tiles := make([]common.Tile, 0, 16)
-	for yI := y - 1; yI < y+3; yI++ {
+	for yI := int(y) - 1; yI < int(y)+3; yI++ {
 		var yVal uint
 
 		switch {
 		case yI < 0:
 			yVal = 0
-		case yI > xyMax:
+		case yI > int(xyMax):
 			yVal = xyMax
 		default:
-			yVal = yI
+			yVal = uint(yI)
 		}
 
-		for xI := x - 1; xI < x+3; xI++ {
+		for xI := int(x) - 1; xI < int(x)+3; xI++ {
 			var xVal uint
 
 			switch {
 			case xI < 0:
 				xVal = xyMax
-			case xI > xyMax:
+			case xI > int(xyMax):
 				xVal = 0
 			default:
-				xVal = xI
+				xVal = uint(xI)
 			}
 
-			t := common.Tile{Z: z, X: xVal, Y: yVal}
-			log.Printf("%s", t)
-			tiles = append(tiles, t)
+			tiles = append(tiles, common.Tile{Z: z, X: xVal, Y: yVal})
 		}
 	}
 
@@ -487,8 +778,32 @@ func generate256Instructions(t common.Tile) []instruction {
 	}
 }
 
-func NewZaloaService(fetcher fetcher.TileFetcher) ZaloaService {
-	return &zaloaService{
-		fetcher: fetcher,
+func NewZaloaService(fetcher fetcher.TileFetcher, opts ...Option) ZaloaService {
+	z := &zaloaService{
+		fetcher:     fetcher,
+		tilesets:    tilesets.NewDefaultRegistry(),
+		metrics:     metrics.NewNopRecorder(),
+		logger:      logging.WithContext(slog.Default()),
+		renderCalls: newSharedCalls(),
+		fetchCalls:  newSharedCalls(),
+	}
+
+	for _, opt := range opts {
+		opt(z)
+	}
+
+	return z
+}
+
+func (z zaloaService) Tilesets() *tilesets.Registry {
+	return z.tilesets
+}
+
+// tilesetFetcher returns the fetcher the tileset's source tiles are fetched with.
+func (z zaloaService) tilesetFetcher(tileset *tilesets.Tileset) (fetcher.TileFetcher, bool) {
+	if tileset.Fetcher == tilesets.DefaultFetcher {
+		return z.fetcher, true
 	}
+	f, ok := z.fetchers[tileset.Fetcher]
+	return f, ok
 }
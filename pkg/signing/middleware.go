@@ -0,0 +1,89 @@
+package signing
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tilezen/go-zaloa/pkg/metrics"
+)
+
+type contextKey int
+
+const (
+	claimsContextKey contextKey = iota
+)
+
+// ClaimsFromContext returns the claims of the signed URL the request with the given context was let through with, or
+// nil if it wasn't signed.
+func ClaimsFromContext(ctx context.Context) *Claims {
+	c, _ := ctx.Value(claimsContextKey).(*Claims)
+	return c
+}
+
+type middleware struct {
+	signer   *Signer
+	unsigned func(http.Handler) http.Handler
+	recorder metrics.Recorder
+	logger   *slog.Logger
+}
+
+// NewMiddleware returns middleware that lets requests for tiles through if they're signed, unexpired and within the
+// signed area. Requests without a signature go through unsigned instead, or get a 401 if it's nil, so that signed URLs
+// can be handed out next to other ways of authenticating.
+func NewMiddleware(signer *Signer, unsigned func(http.Handler) http.Handler, recorder metrics.Recorder, logger *slog.Logger) func(http.Handler) http.Handler {
+	m := &middleware{
+		signer:   signer,
+		unsigned: unsigned,
+		recorder: recorder,
+		logger:   logger,
+	}
+	return m.wrap
+}
+
+func (m *middleware) wrap(next http.Handler) http.Handler {
+	var unsigned http.Handler
+	if m.unsigned != nil {
+		unsigned = m.unsigned(next)
+	}
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		query := request.URL.Query()
+		c, err := m.signer.Verify(request.URL.Path, query, time.Now())
+
+		// The secret ID is only used as a label if it's known, so that made up IDs can't add metrics
+		secretID := query.Get(ParamSecretID)
+		if _, ok := m.signer.secrets[secretID]; !ok {
+			secretID = "unknown"
+		}
+
+		switch {
+		case err == nil:
+			m.recorder.ObserveSignedURL(secretID, "allowed")
+			writer.Header().Set("X-Signature-Expires", strconv.FormatInt(c.Expires.Unix(), 10))
+			next.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), claimsContextKey, &c)))
+		case errors.Is(err, ErrUnsigned) && unsigned != nil:
+			unsigned.ServeHTTP(writer, request)
+		case errors.Is(err, ErrUnsigned):
+			m.recorder.ObserveSignedURL(secretID, "missing")
+			writer.WriteHeader(http.StatusUnauthorized)
+			_, _ = writer.Write([]byte("Missing signature"))
+		case errors.Is(err, ErrExpired):
+			m.recorder.ObserveSignedURL(secretID, "expired")
+			writer.WriteHeader(http.StatusForbidden)
+			_, _ = writer.Write([]byte("Signature expired"))
+		case errors.Is(err, ErrOutOfBounds):
+			m.recorder.ObserveSignedURL(secretID, "out_of_bounds")
+			writer.WriteHeader(http.StatusForbidden)
+			_, _ = writer.Write([]byte("Tile outside the signed area"))
+		default:
+			m.recorder.ObserveSignedURL(secretID, "invalid")
+			m.logger.DebugContext(request.Context(), "invalid signature", "path", request.URL.Path, "error", err)
+			writer.WriteHeader(http.StatusForbidden)
+			_, _ = writer.Write([]byte("Invalid signature"))
+		}
+	})
+}
@@ -0,0 +1,268 @@
+package signing
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/tilezen/go-zaloa/pkg/common"
+	"github.com/tilezen/go-zaloa/pkg/coverage"
+)
+
+// Query parameters of signed URLs
+const (
+	ParamExpires   = "exp"
+	ParamBBox      = "bbox"
+	ParamMinZoom   = "minzoom"
+	ParamMaxZoom   = "maxzoom"
+	ParamSecretID  = "kid"
+	ParamSignature = "sig"
+)
+
+var (
+	ErrUnsigned         = errors.New("missing signature")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrExpired          = errors.New("signature expired")
+	ErrOutOfBounds      = errors.New("tile outside the signed area")
+)
+
+// Secret is a secret that URLs can be signed with. Several secrets can be active at once so that they can be rotated
+// without breaking the URLs that were handed out.
+type Secret struct {
+	ID     string `yaml:"id" json:"id"`
+	Secret string `yaml:"secret" json:"secret"`
+}
+
+type secretsFile struct {
+	Secrets []Secret `yaml:"secrets" json:"secrets"`
+}
+
+// LoadSecrets reads the secrets in path, JSON if its name ends in .json and YAML otherwise, from a secrets list.
+func LoadSecrets(path string) ([]Secret, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading signing secrets: %w", err)
+	}
+
+	file := &secretsFile{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(file)
+	} else {
+		err = yaml.UnmarshalStrict(data, file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing signing secrets %s: %w", path, err)
+	}
+
+	return file.Secrets, nil
+}
+
+// Claims are what a signed URL grants access to.
+type Claims struct {
+	// Scope is the path the tile coordinates are appended to, e.g. /tilezen/terrain/v2/256/terrarium/
+	Scope   string
+	Expires time.Time
+	// BBox limits the URL to the tiles that intersect it, if it's set
+	BBox *coverage.BBox
+	// MinZoom and MaxZoom limit the URL to a range of zooms, if they're set
+	MinZoom *uint
+	MaxZoom *uint
+}
+
+// allows reports whether the claims cover t.
+func (c Claims) allows(t common.Tile) bool {
+	if c.MinZoom != nil && t.Z < *c.MinZoom {
+		return false
+	}
+	if c.MaxZoom != nil && t.Z > *c.MaxZoom {
+		return false
+	}
+	return c.BBox == nil || c.BBox.IntersectsTile(t)
+}
+
+// query returns the query parameters carrying the claims, apart from the scope which is the path of the URL.
+func (c Claims) query() url.Values {
+	query := url.Values{}
+	query.Set(ParamExpires, strconv.FormatInt(c.Expires.Unix(), 10))
+	if c.BBox != nil {
+		query.Set(ParamBBox, c.BBox.String())
+	}
+	if c.MinZoom != nil {
+		query.Set(ParamMinZoom, strconv.FormatUint(uint64(*c.MinZoom), 10))
+	}
+	if c.MaxZoom != nil {
+		query.Set(ParamMaxZoom, strconv.FormatUint(uint64(*c.MaxZoom), 10))
+	}
+	return query
+}
+
+// message is what gets signed. The claims are taken exactly as they appear in the URL so that the signature doesn't
+// depend on how numbers are formatted.
+func message(scope string, query url.Values) []byte {
+	return []byte(strings.Join([]string{
+		scope,
+		query.Get(ParamExpires),
+		query.Get(ParamBBox),
+		query.Get(ParamMinZoom),
+		query.Get(ParamMaxZoom),
+	}, "\n"))
+}
+
+func parseClaims(scope string, query url.Values) (Claims, error) {
+	c := Claims{Scope: scope}
+
+	exp, err := strconv.ParseInt(query.Get(ParamExpires), 10, 64)
+	if err != nil {
+		return c, fmt.Errorf("invalid %s: %w", ParamExpires, err)
+	}
+	c.Expires = time.Unix(exp, 0)
+
+	if s := query.Get(ParamBBox); s != "" {
+		bbox, err := coverage.ParseBBox(s)
+		if err != nil {
+			return c, err
+		}
+		c.BBox = &bbox
+	}
+
+	for _, z := range []struct {
+		param string
+		value **uint
+	}{{ParamMinZoom, &c.MinZoom}, {ParamMaxZoom, &c.MaxZoom}} {
+		s := query.Get(z.param)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return c, fmt.Errorf("invalid %s: %w", z.param, err)
+		}
+		zoom := uint(v)
+		*z.value = &zoom
+	}
+
+	return c, nil
+}
+
+// TileScope splits the path of a tile URL, ending in {z}/{x}/{y}.{format}, into the scope that's signed and the tile.
+// Templates, with placeholders instead of coordinates, have no tile.
+func TileScope(path string) (string, *common.Tile, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) < 4 {
+		return "", nil, fmt.Errorf("%s doesn't end in z/x/y", path)
+	}
+
+	scope := strings.Join(parts[:len(parts)-3], "/") + "/"
+	y, _, _ := strings.Cut(parts[len(parts)-1], ".")
+	t, err := common.ParseTile(parts[len(parts)-3], parts[len(parts)-2], y)
+	if err != nil {
+		return scope, nil, nil
+	}
+	return scope, t, nil
+}
+
+// Signer signs and verifies tile URLs with HMAC-SHA256.
+type Signer struct {
+	secrets map[string][]byte
+	// current is the secret that new URLs are signed with
+	current string
+}
+
+// NewSigner signs URLs with the first secret and accepts URLs signed with any of them.
+func NewSigner(secrets []Secret) (*Signer, error) {
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("no signing secrets")
+	}
+
+	s := &Signer{secrets: map[string][]byte{}, current: secrets[0].ID}
+	for _, secret := range secrets {
+		if secret.ID == "" || secret.Secret == "" {
+			return nil, fmt.Errorf("signing secrets need an id and a secret")
+		}
+		if _, ok := s.secrets[secret.ID]; ok {
+			return nil, fmt.Errorf("signing secret %s is defined twice", secret.ID)
+		}
+		s.secrets[secret.ID] = []byte(secret.Secret)
+	}
+	return s, nil
+}
+
+func (s *Signer) sign(secretID string, scope string, query url.Values) ([]byte, error) {
+	secret, ok := s.secrets[secretID]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing secret %s", secretID)
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(message(scope, query))
+	return mac.Sum(nil), nil
+}
+
+// Sign returns the query parameters that grant access to the claims, signed with the secret identified by secretID,
+// or the current secret if it's empty.
+func (s *Signer) Sign(secretID string, c Claims) (url.Values, error) {
+	if secretID == "" {
+		secretID = s.current
+	}
+
+	query := c.query()
+	sig, err := s.sign(secretID, c.Scope, query)
+	if err != nil {
+		return nil, err
+	}
+
+	query.Set(ParamSecretID, secretID)
+	query.Set(ParamSignature, base64.RawURLEncoding.EncodeToString(sig))
+	return query, nil
+}
+
+// Verify checks the signature of a request for a tile URL and that it's allowed the tile at now.
+func (s *Signer) Verify(path string, query url.Values, now time.Time) (Claims, error) {
+	if query.Get(ParamSignature) == "" {
+		return Claims{}, ErrUnsigned
+	}
+
+	scope, t, err := TileScope(path)
+	if err != nil || t == nil {
+		return Claims{}, fmt.Errorf("%s isn't a tile: %w", path, ErrInvalidSignature)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(query.Get(ParamSignature))
+	if err != nil {
+		return Claims{}, ErrInvalidSignature
+	}
+	expected, err := s.sign(query.Get(ParamSecretID), scope, query)
+	if err != nil {
+		return Claims{}, fmt.Errorf("%s: %w", err.Error(), ErrInvalidSignature)
+	}
+	if !hmac.Equal(sig, expected) {
+		return Claims{}, ErrInvalidSignature
+	}
+
+	c, err := parseClaims(scope, query)
+	if err != nil {
+		return Claims{}, fmt.Errorf("%s: %w", err.Error(), ErrInvalidSignature)
+	}
+	if !now.Before(c.Expires) {
+		return c, ErrExpired
+	}
+	if !c.allows(*t) {
+		return c, ErrOutOfBounds
+	}
+
+	return c, nil
+}
@@ -0,0 +1,143 @@
+package signing
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/tilezen/go-zaloa/pkg/coverage"
+)
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	current, err := NewSigner([]Secret{{ID: "new", Secret: "new secret"}, {ID: "old", Secret: "old secret"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	retired, err := NewSigner([]Secret{{ID: "new", Secret: "new secret"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	previous, err := NewSigner([]Secret{{ID: "old", Secret: "old secret"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	bbox, err := coverage.ParseBBox("5.9,45.8,10.5,47.8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	minZoom, maxZoom := uint(6), uint(14)
+	scope := "/tilezen/terrain/v2/256/terrarium/"
+
+	sign := func(signer *Signer, c Claims) url.Values {
+		query, err := signer.Sign("", c)
+		if err != nil {
+			t.Fatalf("error signing: %v", err)
+		}
+		return query
+	}
+	valid := sign(current, Claims{Scope: scope, Expires: now.Add(time.Hour)})
+	restricted := sign(current, Claims{Scope: scope, Expires: now.Add(time.Hour), BBox: &bbox, MinZoom: &minZoom, MaxZoom: &maxZoom})
+	fromPrevious := sign(previous, Claims{Scope: scope, Expires: now.Add(time.Hour)})
+
+	tampered := url.Values{}
+	for k, v := range restricted {
+		tampered[k] = v
+	}
+	tampered.Set(ParamMaxZoom, "20")
+
+	tests := []struct {
+		name    string
+		signer  *Signer
+		path    string
+		query   url.Values
+		now     time.Time
+		wantErr error
+	}{
+		{name: "valid", signer: current, path: scope + "3/4/2.png", query: valid, now: now},
+		{name: "unsigned", signer: current, path: scope + "3/4/2.png", query: url.Values{}, now: now, wantErr: ErrUnsigned},
+		{name: "other scope", signer: current, path: "/tilezen/terrain/v2/512/terrarium/3/4/2.png", query: valid, now: now, wantErr: ErrInvalidSignature},
+		{name: "not a tile", signer: current, path: scope + "tile.png", query: valid, now: now, wantErr: ErrInvalidSignature},
+		{name: "expired", signer: current, path: scope + "3/4/2.png", query: valid, now: now.Add(time.Hour), wantErr: ErrExpired},
+		{name: "inside the bbox", signer: current, path: scope + "8/134/90.png", query: restricted, now: now},
+		{name: "outside the bbox", signer: current, path: scope + "8/0/0.png", query: restricted, now: now, wantErr: ErrOutOfBounds},
+		{name: "below minzoom", signer: current, path: scope + "5/16/11.png", query: restricted, now: now, wantErr: ErrOutOfBounds},
+		{name: "above maxzoom", signer: current, path: scope + "15/17060/11530.png", query: restricted, now: now, wantErr: ErrOutOfBounds},
+		{name: "tampered claims", signer: current, path: scope + "8/134/90.png", query: tampered, now: now, wantErr: ErrInvalidSignature},
+		// Rotating keeps the URLs signed with the previous secret working until it's removed
+		{name: "previous secret", signer: current, path: scope + "3/4/2.png", query: fromPrevious, now: now},
+		{name: "removed secret", signer: retired, path: scope + "3/4/2.png", query: fromPrevious, now: now, wantErr: ErrInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.signer.Verify(tt.path, tt.query, tt.now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestTileScope(t *testing.T) {
+	tests := []struct {
+		path    string
+		scope   string
+		tile    string
+		wantErr bool
+	}{
+		{path: "/tilezen/terrain/v2/256/terrarium/3/4/2.png", scope: "/tilezen/terrain/v2/256/terrarium/", tile: "3/4/2"},
+		{path: "/tilezen/terrain/v1/terrarium/0/0/0.webp", scope: "/tilezen/terrain/v1/terrarium/", tile: "0/0/0"},
+		{path: "/tilezen/terrain/v2/256/terrarium/{z}/{x}/{y}.png", scope: "/tilezen/terrain/v2/256/terrarium/"},
+		{path: "/a/b", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			scope, tile, err := TileScope(tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if scope != tt.scope {
+				t.Errorf("expected scope %s, got %s", tt.scope, scope)
+			}
+			if (tile == nil) != (tt.tile == "") || (tile != nil && tile.String() != tt.tile) {
+				t.Errorf("expected tile %q, got %v", tt.tile, tile)
+			}
+		})
+	}
+}
+
+func TestNewSigner(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets []Secret
+		wantErr bool
+	}{
+		{name: "one secret", secrets: []Secret{{ID: "a", Secret: "s"}}},
+		{name: "no secrets", wantErr: true},
+		{name: "no id", secrets: []Secret{{Secret: "s"}}, wantErr: true},
+		{name: "no secret", secrets: []Secret{{ID: "a"}}, wantErr: true},
+		{name: "defined twice", secrets: []Secret{{ID: "a", Secret: "s"}, {ID: "a", Secret: "t"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewSigner(tt.secrets)
+			if tt.wantErr && err == nil {
+				t.Fatalf("expected an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
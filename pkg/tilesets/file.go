@@ -0,0 +1,232 @@
+package tilesets
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/tilezen/go-zaloa/pkg/coverage"
+)
+
+// FetcherConfig describes a fetcher that tilesets can fetch their source tiles with.
+type FetcherConfig struct {
+	// Method is http, s3, composite or mosaic
+	Method        string `yaml:"method" json:"method"`
+	HTTPPrefix    string `yaml:"http-prefix" json:"http-prefix"`
+	S3Bucket      string `yaml:"s3-bucket" json:"s3-bucket"`
+	RequesterPays bool   `yaml:"requester-pays" json:"requester-pays"`
+	// Region defaults to the region of the default fetcher
+	Region string `yaml:"region" json:"region"`
+	// Sources are the fetchers a composite fetcher tries, or a mosaic fetcher merges, in order
+	Sources []SourceConfig `yaml:"sources" json:"sources"`
+	// Feather is the width in pixels over which a mosaic fetcher blends its sources
+	Feather int `yaml:"feather" json:"feather"`
+	// MaxConcurrent bounds the number of fetches an http or s3 fetcher makes at once, or is unlimited if it's 0
+	MaxConcurrent int `yaml:"max-concurrent" json:"max-concurrent"`
+	// HedgePercentile is the percentile of recent latencies after which an http or s3 fetcher sends a second request,
+	// or 0 to not hedge. The budget and minimum delay default to the ones of the default fetcher.
+	HedgePercentile float64  `yaml:"hedge-percentile" json:"hedge-percentile"`
+	HedgeBudget     *float64 `yaml:"hedge-budget" json:"hedge-budget"`
+	HedgeMinDelayMS *int     `yaml:"hedge-min-delay-ms" json:"hedge-min-delay-ms"`
+}
+
+// IsComposite returns true for fetchers that are made of other fetchers.
+func (f FetcherConfig) IsComposite() bool {
+	return f.Method == "composite" || f.Method == "mosaic"
+}
+
+// SourceConfig is a source of a composite fetcher.
+type SourceConfig struct {
+	// Fetcher names an http or s3 fetcher, or DefaultFetcher
+	Fetcher string `yaml:"fetcher" json:"fetcher"`
+	// BBox is west,south,east,north
+	BBox string `yaml:"bbox" json:"bbox"`
+	// GeoJSON is a file of polygons, relative to the tileset file
+	GeoJSON string `yaml:"geojson" json:"geojson"`
+	MinZoom uint   `yaml:"minzoom" json:"minzoom"`
+	// MaxZoom defaults to every zoom
+	MaxZoom *uint `yaml:"maxzoom" json:"maxzoom"`
+	// Nodata is the elevation the source uses for missing data. A mosaic fetcher treats it, and pixels with an alpha of
+	// 0, as transparent.
+	Nodata *float64 `yaml:"nodata" json:"nodata"`
+
+	area coverage.Area
+}
+
+// Area returns the area the source covers, or nil if it covers the whole world.
+func (s SourceConfig) Area() coverage.Area {
+	return s.area
+}
+
+func (s *SourceConfig) load(dir string) error {
+	if s.BBox != "" && s.GeoJSON != "" {
+		return fmt.Errorf("source %s has both a bbox and a geojson", s.Fetcher)
+	}
+
+	if s.BBox != "" {
+		bbox, err := coverage.ParseBBox(s.BBox)
+		if err != nil {
+			return fmt.Errorf("source %s has an invalid bbox: %w", s.Fetcher, err)
+		}
+		s.area = bbox
+	}
+
+	if s.GeoJSON != "" {
+		path := s.GeoJSON
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("error opening geojson of source %s: %w", s.Fetcher, err)
+		}
+		defer f.Close()
+
+		polygon, err := coverage.ReadGeoJSON(f)
+		if err != nil {
+			return fmt.Errorf("error reading geojson of source %s: %w", s.Fetcher, err)
+		}
+		s.area = polygon
+	}
+
+	if s.MaxZoom != nil && s.MinZoom > *s.MaxZoom {
+		return fmt.Errorf("source %s has minzoom %d above maxzoom %d", s.Fetcher, s.MinZoom, *s.MaxZoom)
+	}
+
+	return nil
+}
+
+// File is a tileset registry file. Tilesets can use the fetchers it defines by name, as well as DefaultFetcher.
+type File struct {
+	Fetchers map[string]FetcherConfig `yaml:"fetchers" json:"fetchers"`
+	Tilesets []Tileset                `yaml:"tilesets" json:"tilesets"`
+}
+
+// fileZooms holds the maxzoom of each tileset of a File, which is nil if it's missing.
+type fileZooms struct {
+	Tilesets []struct {
+		MaxZoom *uint `yaml:"maxzoom" json:"maxzoom"`
+	} `yaml:"tilesets" json:"tilesets"`
+}
+
+// Load reads a registry file, which is JSON if its name ends in .json and YAML otherwise. It returns the registry and
+// the fetchers it defines.
+func Load(path string) (*Registry, map[string]FetcherConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading tileset file: %w", err)
+	}
+
+	file := &File{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(file)
+	} else {
+		err = yaml.UnmarshalStrict(data, file)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing tileset file %s: %w", path, err)
+	}
+
+	// A missing maxzoom can't be told apart from 0 in a Tileset, so the file is read again for the maxzooms alone
+	zooms := &fileZooms{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, zooms)
+	} else {
+		err = yaml.Unmarshal(data, zooms)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing tileset file %s: %w", path, err)
+	}
+	for i, t := range zooms.Tilesets {
+		if t.MaxZoom == nil {
+			file.Tilesets[i].MaxZoom = DefaultMaxZoom
+		}
+	}
+
+	if len(file.Tilesets) == 0 {
+		return nil, nil, fmt.Errorf("no tilesets in %s", path)
+	}
+
+	registry, err := NewRegistry(file.Tilesets)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid tileset file %s: %w", path, err)
+	}
+
+	for name, f := range file.Fetchers {
+		if name == DefaultFetcher {
+			return nil, nil, fmt.Errorf("invalid tileset file %s: the %s fetcher can't be redefined", path, DefaultFetcher)
+		}
+
+		if f.MaxConcurrent < 0 {
+			return nil, nil, fmt.Errorf("invalid tileset file %s: fetcher %s has a negative max-concurrent", path, name)
+		}
+		if f.MaxConcurrent > 0 && f.IsComposite() {
+			return nil, nil, fmt.Errorf("invalid tileset file %s: %s fetcher %s can't set max-concurrent, its sources do", path, f.Method, name)
+		}
+		if f.HedgePercentile < 0 || f.HedgePercentile >= 1 {
+			return nil, nil, fmt.Errorf("invalid tileset file %s: fetcher %s needs a hedge-percentile of at least 0 and less than 1", path, name)
+		}
+		if f.HedgeBudget != nil && (*f.HedgeBudget < 0 || *f.HedgeBudget > 1) {
+			return nil, nil, fmt.Errorf("invalid tileset file %s: fetcher %s needs a hedge-budget between 0 and 1", path, name)
+		}
+		if f.HedgeMinDelayMS != nil && *f.HedgeMinDelayMS < 0 {
+			return nil, nil, fmt.Errorf("invalid tileset file %s: fetcher %s has a negative hedge-min-delay-ms", path, name)
+		}
+		if f.HedgePercentile > 0 && f.IsComposite() {
+			return nil, nil, fmt.Errorf("invalid tileset file %s: %s fetcher %s can't hedge, its sources do", path, f.Method, name)
+		}
+
+		switch f.Method {
+		case "http":
+			if f.HTTPPrefix == "" {
+				return nil, nil, fmt.Errorf("invalid tileset file %s: fetcher %s needs an http-prefix", path, name)
+			}
+		case "s3":
+			if f.S3Bucket == "" {
+				return nil, nil, fmt.Errorf("invalid tileset file %s: fetcher %s needs an s3-bucket", path, name)
+			}
+		case "composite", "mosaic":
+			if f.Feather < 0 {
+				return nil, nil, fmt.Errorf("invalid tileset file %s: fetcher %s has a negative feather", path, name)
+			}
+			if len(f.Sources) == 0 {
+				return nil, nil, fmt.Errorf("invalid tileset file %s: fetcher %s needs sources", path, name)
+			}
+
+			for i := range f.Sources {
+				source := &f.Sources[i]
+				if source.Fetcher != DefaultFetcher {
+					sourceFetcher, ok := file.Fetchers[source.Fetcher]
+					if !ok {
+						return nil, nil, fmt.Errorf("invalid tileset file %s: fetcher %s uses unknown fetcher %s", path, name, source.Fetcher)
+					}
+					if sourceFetcher.IsComposite() {
+						return nil, nil, fmt.Errorf("invalid tileset file %s: fetcher %s can't use %s fetcher %s", path, name, sourceFetcher.Method, source.Fetcher)
+					}
+				}
+
+				if err := source.load(filepath.Dir(path)); err != nil {
+					return nil, nil, fmt.Errorf("invalid tileset file %s: fetcher %s: %w", path, name, err)
+				}
+			}
+		default:
+			return nil, nil, fmt.Errorf("invalid tileset file %s: fetcher %s has unknown method %q", path, name, f.Method)
+		}
+	}
+
+	for _, t := range registry.Tilesets() {
+		if _, ok := file.Fetchers[t.Fetcher]; !ok && t.Fetcher != DefaultFetcher {
+			return nil, nil, fmt.Errorf("invalid tileset file %s: tileset %s uses unknown fetcher %s", path, t.Name, t.Fetcher)
+		}
+	}
+
+	return registry, file.Fetchers, nil
+}
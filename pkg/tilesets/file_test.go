@@ -0,0 +1,86 @@
+package tilesets
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadMaxZoom(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		maxZoom uint
+		wantErr bool
+	}{
+		{name: "yaml", file: "tilesets.yaml", content: "tilesets:\n  - name: lidar\n    encoding: mapbox\n    maxzoom: 17\n", maxZoom: 17},
+		{name: "yaml zero", file: "tilesets.yaml", content: "tilesets:\n  - name: lidar\n    encoding: mapbox\n    maxzoom: 0\n", maxZoom: 0},
+		{name: "yaml missing", file: "tilesets.yaml", content: "tilesets:\n  - name: lidar\n    encoding: mapbox\n", maxZoom: DefaultMaxZoom},
+		{name: "json missing", file: "tilesets.json", content: `{"tilesets": [{"name": "lidar", "encoding": "mapbox"}]}`, maxZoom: DefaultMaxZoom},
+		{name: "json", file: "tilesets.json", content: `{"tilesets": [{"name": "lidar", "encoding": "mapbox", "maxzoom": 12}]}`, maxZoom: 12},
+		{name: "minzoom above default", file: "tilesets.yaml", content: "tilesets:\n  - name: lidar\n    encoding: mapbox\n    minzoom: 16\n", wantErr: true},
+		{name: "unknown field", file: "tilesets.yaml", content: "tilesets:\n  - name: lidar\n    encoding: mapbox\n    max-zoom: 12\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatalf("error writing tileset file: %v", err)
+			}
+
+			registry, _, err := Load(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			lidar, ok := registry.Get("lidar")
+			if !ok {
+				t.Fatalf("expected the lidar tileset")
+			}
+			if lidar.MaxZoom != tt.maxZoom {
+				t.Errorf("expected maxzoom %d, got %d", tt.maxZoom, lidar.MaxZoom)
+			}
+		})
+	}
+}
+
+func TestLoadFetchers(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "http", content: "fetchers:\n  a:\n    method: http\n    http-prefix: http://example.com\ntilesets:\n  - name: t\n    fetcher: a\n    encoding: terrarium\n"},
+		{name: "unknown fetcher", content: "tilesets:\n  - name: t\n    fetcher: a\n    encoding: terrarium\n", wantErr: true},
+		{name: "redefined default", content: "fetchers:\n  default:\n    method: http\n    http-prefix: http://example.com\ntilesets:\n  - name: t\n    encoding: terrarium\n", wantErr: true},
+		{name: "http without prefix", content: "fetchers:\n  a:\n    method: http\ntilesets:\n  - name: t\n    encoding: terrarium\n", wantErr: true},
+		{name: "composite of composite", content: "fetchers:\n  a:\n    method: composite\n    sources: [{fetcher: default}]\n  b:\n    method: composite\n    sources: [{fetcher: a}]\ntilesets:\n  - name: t\n    encoding: terrarium\n", wantErr: true},
+		{name: "hedge percentile", content: "fetchers:\n  a:\n    method: s3\n    s3-bucket: b\n    hedge-percentile: 1\ntilesets:\n  - name: t\n    encoding: terrarium\n", wantErr: true},
+		{name: "no tilesets", content: "fetchers: {}\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tilesets.yaml")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatalf("error writing tileset file: %v", err)
+			}
+
+			_, _, err := Load(path)
+			if tt.wantErr && err == nil {
+				t.Fatalf("expected an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package tilesets
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/tilezen/go-zaloa/pkg/common"
+)
+
+// Encoding is how the pixels of a tileset's tiles are encoded.
+type Encoding string
+
+// Render is a style rendered from the elevations of a tileset.
+type Render string
+
+const (
+	// Encoding_TERRARIUM holds elevations as (R * 256 + G + B / 256) - 32768
+	Encoding_TERRARIUM = Encoding("terrarium")
+	// Encoding_MAPBOX holds elevations as (R * 65536 + G * 256 + B) * 0.1 - 10000
+	Encoding_MAPBOX = Encoding("mapbox")
+	Encoding_NORMAL = Encoding("normal")
+	// Encoding_RGBA is any other imagery, which is passed through as it is
+	Encoding_RGBA = Encoding("rgba")
+
+	Render_COLOR_RELIEF    = Render("color-relief")
+	Render_HILLSHADE       = Render("hillshade")
+	Render_COLOR_HILLSHADE = Render("color-hillshade")
+
+	// DefaultFetcher names the fetcher configured on the command line.
+	DefaultFetcher = "default"
+)
+
+// DefaultMaxZoom is the maxzoom of the Tilezen tilesets, which tilesets in a file default to.
+const DefaultMaxZoom = 15
+
+// Tileset is a tileset that can be requested.
+type Tileset struct {
+	Name string `yaml:"name" json:"name"`
+	// Fetcher names the fetcher the source tiles are fetched with. It defaults to DefaultFetcher.
+	Fetcher string `yaml:"fetcher" json:"fetcher"`
+	// Kind is the directory the fetcher finds the source tiles in. It defaults to the name.
+	Kind     common.TileKind `yaml:"kind" json:"kind"`
+	Encoding Encoding        `yaml:"encoding" json:"encoding"`
+	// MinZoom and MaxZoom are the zooms of the source tiles. MaxZoom defaults to DefaultMaxZoom in a tileset file.
+	MinZoom uint `yaml:"minzoom" json:"minzoom"`
+	MaxZoom uint `yaml:"maxzoom" json:"maxzoom"`
+	// Sizes defaults to 256, 260, 512 and 516.
+	Sizes []uint64 `yaml:"sizes" json:"sizes"`
+	// MaxZoomSizes are the sizes served at MaxZoom, which defaults to 256 and 260. The others stop a zoom earlier.
+	MaxZoomSizes []uint64 `yaml:"maxzoom-sizes" json:"maxzoom-sizes"`
+	// Formats defaults to png and webp.
+	Formats []common.TileEncoding `yaml:"formats" json:"formats"`
+	// Render styles the elevations before they're served, instead of serving the source tiles.
+	Render Render `yaml:"render" json:"render"`
+}
+
+// RasterDEMEncoding returns the raster-dem encoding of the tiles that are served, or an empty string if they don't
+// carry elevations.
+func (t *Tileset) RasterDEMEncoding() string {
+	if t.Render != "" {
+		return ""
+	}
+
+	switch t.Encoding {
+	case Encoding_TERRARIUM, Encoding_MAPBOX:
+		return string(t.Encoding)
+	default:
+		return ""
+	}
+}
+
+// HasElevations returns true if the source tiles carry elevations that can be decoded and rendered.
+func (t *Tileset) HasElevations() bool {
+	return t.Encoding == Encoding_TERRARIUM || t.Encoding == Encoding_MAPBOX
+}
+
+func (t *Tileset) AllowsSize(size uint64) bool {
+	for _, s := range t.Sizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Tileset) AllowsFormat(format common.TileEncoding) bool {
+	for _, f := range t.Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxTileZoom returns the highest zoom served at the given size. 512 and 516 tiles are stitched from the tiles of the
+// next zoom, so they are never in MaxZoomSizes and stop a zoom earlier.
+func (t *Tileset) MaxTileZoom(size uint64) uint {
+	if !slices.Contains(t.MaxZoomSizes, size) && t.MaxZoom > 0 {
+		return t.MaxZoom - 1
+	}
+	return t.MaxZoom
+}
+
+// MinTileZoom returns the lowest zoom served at the given size.
+func (t *Tileset) MinTileZoom(size uint64) uint {
+	if (size == 512 || size == 516) && t.MinZoom > 0 {
+		return t.MinZoom - 1
+	}
+	return t.MinZoom
+}
+
+func (t *Tileset) setDefaults() {
+	if t.Fetcher == "" {
+		t.Fetcher = DefaultFetcher
+	}
+	if t.Kind == "" {
+		t.Kind = common.TileKind(t.Name)
+	}
+	if len(t.Sizes) == 0 {
+		t.Sizes = []uint64{256, 260, 512, 516}
+	}
+	if len(t.Formats) == 0 {
+		t.Formats = []common.TileEncoding{common.TileEncoding_PNG, common.TileEncoding_WEBP}
+	}
+	if len(t.MaxZoomSizes) == 0 {
+		t.MaxZoomSizes = []uint64{256, 260}
+	}
+}
+
+func (t *Tileset) validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("tileset without a name")
+	}
+
+	switch t.Encoding {
+	case Encoding_TERRARIUM, Encoding_MAPBOX, Encoding_NORMAL, Encoding_RGBA:
+	default:
+		return fmt.Errorf("tileset %s has unknown encoding %q", t.Name, t.Encoding)
+	}
+
+	switch t.Render {
+	case "":
+	case Render_COLOR_RELIEF, Render_HILLSHADE, Render_COLOR_HILLSHADE:
+		if !t.HasElevations() {
+			return fmt.Errorf("tileset %s can't render %s from %s tiles", t.Name, t.Render, t.Encoding)
+		}
+	default:
+		return fmt.Errorf("tileset %s has unknown render %q", t.Name, t.Render)
+	}
+
+	if t.MinZoom > t.MaxZoom {
+		return fmt.Errorf("tileset %s has minzoom %d above maxzoom %d", t.Name, t.MinZoom, t.MaxZoom)
+	}
+
+	for _, size := range t.Sizes {
+		switch size {
+		case 256, 260, 512, 516:
+		default:
+			return fmt.Errorf("tileset %s has unsupported size %d", t.Name, size)
+		}
+	}
+
+	for _, size := range t.MaxZoomSizes {
+		switch size {
+		case 256, 260:
+		default:
+			return fmt.Errorf("tileset %s can't serve size %d at maxzoom", t.Name, size)
+		}
+	}
+
+	for _, format := range t.Formats {
+		switch format {
+		case common.TileEncoding_PNG, common.TileEncoding_WEBP:
+		default:
+			return fmt.Errorf("tileset %s has unsupported format %q", t.Name, format)
+		}
+	}
+
+	return nil
+}
+
+// Registry holds the tilesets that can be requested.
+type Registry struct {
+	tilesets []*Tileset
+	byName   map[string]*Tileset
+}
+
+// NewRegistry fills in the defaults of tilesets and checks them.
+func NewRegistry(tilesets []Tileset) (*Registry, error) {
+	r := &Registry{byName: map[string]*Tileset{}}
+	for i := range tilesets {
+		t := tilesets[i]
+		t.setDefaults()
+		if err := t.validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := r.byName[t.Name]; ok {
+			return nil, fmt.Errorf("tileset %s is defined twice", t.Name)
+		}
+
+		r.tilesets = append(r.tilesets, &t)
+		r.byName[t.Name] = &t
+	}
+
+	return r, nil
+}
+
+// DefaultTilesets are the Tilezen tilesets, fetched with the default fetcher. Only 260 tiles are served at zoom 15.
+func DefaultTilesets() []Tileset {
+	maxZoomSizes := []uint64{260}
+	return []Tileset{
+		{Name: "terrarium", Encoding: Encoding_TERRARIUM, MaxZoom: DefaultMaxZoom, MaxZoomSizes: maxZoomSizes},
+		{Name: "normal", Encoding: Encoding_NORMAL, MaxZoom: DefaultMaxZoom, MaxZoomSizes: maxZoomSizes},
+		{Name: "color-relief", Kind: "terrarium", Encoding: Encoding_TERRARIUM, MaxZoom: DefaultMaxZoom, MaxZoomSizes: maxZoomSizes, Render: Render_COLOR_RELIEF},
+		{Name: "hillshade", Kind: "terrarium", Encoding: Encoding_TERRARIUM, MaxZoom: DefaultMaxZoom, MaxZoomSizes: maxZoomSizes, Render: Render_HILLSHADE},
+		{Name: "color-hillshade", Kind: "terrarium", Encoding: Encoding_TERRARIUM, MaxZoom: DefaultMaxZoom, MaxZoomSizes: maxZoomSizes, Render: Render_COLOR_HILLSHADE},
+	}
+}
+
+// NewDefaultRegistry returns a Registry of the DefaultTilesets.
+func NewDefaultRegistry() *Registry {
+	r, err := NewRegistry(DefaultTilesets())
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// Get returns the tileset with the given name.
+func (r *Registry) Get(name string) (*Tileset, bool) {
+	t, ok := r.byName[name]
+	return t, ok
+}
+
+// Tilesets returns every tileset in the order they were defined.
+func (r *Registry) Tilesets() []*Tileset {
+	return r.tilesets
+}
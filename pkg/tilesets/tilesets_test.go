@@ -0,0 +1,77 @@
+package tilesets
+
+import (
+	"testing"
+
+	"github.com/tilezen/go-zaloa/pkg/common"
+)
+
+func TestTileZooms(t *testing.T) {
+	registry, err := NewRegistry([]Tileset{
+		{Name: "lidar", Encoding: Encoding_MAPBOX, MinZoom: 8, MaxZoom: 17},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lidar, _ := registry.Get("lidar")
+	terrarium, _ := NewDefaultRegistry().Get("terrarium")
+
+	tests := []struct {
+		name    string
+		tileset *Tileset
+		size    uint64
+		minZoom uint
+		maxZoom uint
+	}{
+		// The Tilezen tilesets only serve 260 tiles at zoom 15
+		{name: "tilezen 256", tileset: terrarium, size: 256, minZoom: 0, maxZoom: 14},
+		{name: "tilezen 260", tileset: terrarium, size: 260, minZoom: 0, maxZoom: 15},
+		{name: "tilezen 512", tileset: terrarium, size: 512, minZoom: 0, maxZoom: 14},
+		{name: "tilezen 516", tileset: terrarium, size: 516, minZoom: 0, maxZoom: 14},
+		{name: "default 256", tileset: lidar, size: 256, minZoom: 8, maxZoom: 17},
+		{name: "default 260", tileset: lidar, size: 260, minZoom: 8, maxZoom: 17},
+		{name: "default 512", tileset: lidar, size: 512, minZoom: 7, maxZoom: 16},
+		{name: "default 516", tileset: lidar, size: 516, minZoom: 7, maxZoom: 16},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.tileset.MinTileZoom(tt.size); got != tt.minZoom {
+				t.Errorf("expected min zoom %d, got %d", tt.minZoom, got)
+			}
+			if got := tt.tileset.MaxTileZoom(tt.size); got != tt.maxZoom {
+				t.Errorf("expected max zoom %d, got %d", tt.maxZoom, got)
+			}
+		})
+	}
+}
+
+func TestNewRegistry(t *testing.T) {
+	tests := []struct {
+		name     string
+		tilesets []Tileset
+		wantErr  bool
+	}{
+		{name: "defaults", tilesets: DefaultTilesets()},
+		{name: "no name", tilesets: []Tileset{{Encoding: Encoding_TERRARIUM}}, wantErr: true},
+		{name: "unknown encoding", tilesets: []Tileset{{Name: "a", Encoding: "png"}}, wantErr: true},
+		{name: "render without elevations", tilesets: []Tileset{{Name: "a", Encoding: Encoding_NORMAL, Render: Render_HILLSHADE}}, wantErr: true},
+		{name: "minzoom above maxzoom", tilesets: []Tileset{{Name: "a", Encoding: Encoding_TERRARIUM, MinZoom: 5, MaxZoom: 4}}, wantErr: true},
+		{name: "unsupported size", tilesets: []Tileset{{Name: "a", Encoding: Encoding_TERRARIUM, Sizes: []uint64{1024}}}, wantErr: true},
+		{name: "stitched size at maxzoom", tilesets: []Tileset{{Name: "a", Encoding: Encoding_TERRARIUM, MaxZoomSizes: []uint64{512}}}, wantErr: true},
+		{name: "unsupported format", tilesets: []Tileset{{Name: "a", Encoding: Encoding_TERRARIUM, Formats: []common.TileEncoding{"jpg"}}}, wantErr: true},
+		{name: "defined twice", tilesets: []Tileset{{Name: "a", Encoding: Encoding_TERRARIUM}, {Name: "a", Encoding: Encoding_MAPBOX}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRegistry(tt.tilesets)
+			if tt.wantErr && err == nil {
+				t.Fatalf("expected an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
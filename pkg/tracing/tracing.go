@@ -0,0 +1,73 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "github.com/tilezen/go-zaloa"
+)
+
+type Config struct {
+	// Endpoint is the host:port of the OTLP/HTTP collector. Tracing is disabled when it's empty.
+	Endpoint string
+	// Insecure sends spans over plain HTTP instead of HTTPS.
+	Insecure bool
+	// SampleRatio is the fraction of new traces to sample. Traces started upstream follow the parent's decision.
+	SampleRatio float64
+	ServiceName string
+}
+
+// Tracer returns the tracer used for spans in this module.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Setup installs a global tracer provider that exports spans to the OTLP collector in cfg, and W3C trace context
+// propagation. The returned function flushes and stops the exporter.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating OTLP exporter: %w", err)
+	}
+
+	return SetupWithExporter(cfg, exporter), nil
+}
+
+// SetupWithExporter installs a global tracer provider that batches spans to exporter. It's split out of Setup so that
+// an in-memory exporter (go.opentelemetry.io/otel/sdk/trace/tracetest) can be used to inspect spans.
+func SetupWithExporter(cfg Config, exporter sdktrace.SpanExporter) func(context.Context) error {
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "zaloa"
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown
+}